@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhcmrlchtdj/dns/config"
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// at most one log of denied clients per interval
+const aclLogInterval = time.Second
+
+type acl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	// unix nano of the last log, and the denied queries not logged since
+	logged     int64
+	suppressed uint64
+}
+
+func parseCIDRs(cidrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Module("main").Error().Str("cidr", cidr).Err(err).Msg("invalid config")
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func newACL(cfg *config.ACL) *acl {
+	if cfg == nil {
+		return nil
+	}
+	return &acl{allow: parseCIDRs(cfg.Allow), deny: parseCIDRs(cfg.Deny)}
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP is the IP of a client over UDP or TCP, or nil.
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// allowed reports whether the client may query, a nil acl allows all.
+func (a *acl) allowed(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	ip := remoteIP(addr)
+	if ip != nil && !containsIP(a.deny, ip) && (len(a.allow) == 0 || containsIP(a.allow, ip)) {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&a.logged)
+	if now-last >= int64(aclLogInterval) && atomic.CompareAndSwapInt64(&a.logged, last, now) {
+		suppressed := atomic.SwapUint64(&a.suppressed, 0)
+		logger.Module("main").Warn().Str("client", addr.String()).Uint64("suppressed", suppressed).Msg("client denied")
+	} else {
+		atomic.AddUint64(&a.suppressed, 1)
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestACL(t *testing.T) {
+	lan := &config.ACL{Allow: []string{"127.0.0.0/8", "192.168.0.0/16", "fd00::/8"}, Deny: []string{"192.168.100.0/24"}}
+	denyOnly := &config.ACL{Deny: []string{"10.0.0.0/8"}}
+	tests := []struct {
+		name    string
+		acl     *config.ACL
+		addr    net.Addr
+		allowed bool
+	}{
+		{name: "no acl", addr: &net.UDPAddr{IP: net.ParseIP("8.8.8.8")}, allowed: true},
+		{name: "allowed udp", acl: lan, addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.1")}, allowed: true},
+		{name: "allowed tcp", acl: lan, addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, allowed: true},
+		{name: "allowed v6", acl: lan, addr: &net.UDPAddr{IP: net.ParseIP("fd00::1")}, allowed: true},
+		{name: "not allowed", acl: lan, addr: &net.UDPAddr{IP: net.ParseIP("8.8.8.8")}},
+		{name: "deny over allow", acl: lan, addr: &net.UDPAddr{IP: net.ParseIP("192.168.100.1")}},
+		{name: "mapped v4", acl: lan, addr: &net.UDPAddr{IP: net.ParseIP("::ffff:192.168.100.1")}},
+		{name: "deny only", acl: denyOnly, addr: &net.UDPAddr{IP: net.ParseIP("10.1.1.1")}},
+		{name: "deny only others", acl: denyOnly, addr: &net.UDPAddr{IP: net.ParseIP("8.8.8.8")}, allowed: true},
+		{name: "unknown address", acl: denyOnly, addr: &net.UnixAddr{Name: "/tmp/dns.sock", Net: "unix"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allowed := newACL(tt.acl).allowed(tt.addr); allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// flatten answers A/AAAA queries with the addresses of target, as it was a CNAME at zone apex.
+// Other types have no data. The target is resolved by routing, but not by another alias.
+func (c *DNSClient) flatten(target string) dnsClient {
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+			return nil, nil
+		}
+
+		c.rules.RLock()
+		up := c.view.router.route(target)
+		c.rules.RUnlock()
+		if up != nil && up.alias {
+			return nil, errors.New("alias to another alias: " + target)
+		}
+
+		r := c.lookup(context.Background(), target, qtype, QueryOptions{})
+		if r.Rcode != dns.RcodeSuccess {
+			return nil, rcodeError(r.Rcode)
+		}
+		var ans []Answer
+		ttl := 0
+		for _, a := range r.Answer {
+			if a.Type != qtype {
+				continue
+			}
+			if len(ans) == 0 || a.TTL < ttl {
+				ttl = a.TTL
+			}
+			ans = append(ans, Answer{Name: name, Type: qtype, Data: a.Data})
+		}
+		for idx := range ans {
+			ans[idx].TTL = ttl
+		}
+		return ans, nil
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestAlias(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		q := r.Question[0]
+		switch {
+		case q.Name == "nx.example.net.":
+			m.SetRcode(r, dns.RcodeNameError)
+		case q.Qtype == dns.TypeA:
+			m.SetReply(r)
+			for _, s := range []string{" 60 IN A 1.1.1.1", " 30 IN A 1.1.1.2", " 60 IN CNAME other.example.net."} {
+				rr, _ := dns.NewRR(q.Name + s)
+				m.Answer = append(m.Answer, rr)
+			}
+		case q.Qtype == dns.TypeAAAA:
+			m.SetReply(r)
+			rr, _ := dns.NewRR(q.Name + " 120 IN AAAA 2001:db8::1")
+			m.Answer = append(m.Answer, rr)
+		default:
+			m.SetReply(r)
+			rr, _ := dns.NewRR(q.Name + " 60 IN MX 10 mx.example.net.")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	tests := []struct {
+		name  string
+		query string
+		qtype uint16
+		rcode int
+		want  []Answer
+	}{
+		{name: "A with the lowest TTL", query: "example.com.", qtype: dns.TypeA, want: []Answer{
+			{Name: "example.com.", Type: dns.TypeA, TTL: 30, Data: "1.1.1.1"},
+			{Name: "example.com.", Type: dns.TypeA, TTL: 30, Data: "1.1.1.2"},
+		}},
+		{name: "AAAA", query: "example.com.", qtype: dns.TypeAAAA, want: []Answer{
+			{Name: "example.com.", Type: dns.TypeAAAA, TTL: 120, Data: "2001:db8::1"},
+		}},
+		{name: "other types have no data", query: "example.com.", qtype: dns.TypeMX},
+		{name: "static target", query: "static.example.com.", qtype: dns.TypeA, want: []Answer{
+			{Name: "static.example.com.", Type: dns.TypeA, TTL: 60, Data: "2.2.2.2"},
+		}},
+		{name: "target rcode", query: "nx.example.com.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "alias to alias", query: "chain.example.com.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{Forward: []config.Server{
+				{DNS: "alias://lb.cdn.example.net", Domain: []string{"example.com"}},
+				{DNS: "alias://static.example.org", Domain: []string{"static.example.com"}},
+				{DNS: "alias://nx.example.net", Domain: []string{"nx.example.com"}},
+				{DNS: "alias://example.com", Domain: []string{"chain.example.com"}},
+				{DNS: "ipv4://2.2.2.2", Domain: []string{"static.example.org"}},
+				{DNS: "udp://" + addr, Domain: []string{"example.net"}},
+			}})
+			defer c.Close()
+
+			r, _ := c.LookupContext(context.Background(), tt.query, tt.qtype, false)
+			if r.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if len(r.Answer) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(r.Answer, tt.want) {
+					t.Errorf("got %v, want %v", r.Answer, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ToRR parses the answer back into a record.
+// Answers from upstream are untrusted, malformed ones are reported as error.
+func (a Answer) ToRR() (dns.RR, error) {
+	if strings.ContainsAny(a.Name, " \t\r\n") || strings.ContainsAny(a.Data, "\r\n") {
+		return nil, errors.New("invalid answer: unexpected whitespace")
+	}
+	if len(a.Name) == 0 || strings.HasPrefix(a.Name, "$") {
+		// parsed as the owner of previous record, or a directive like $INCLUDE opening a file
+		return nil, errors.New("invalid answer: not a record name")
+	}
+	data := a.Data
+	if a.Type == dns.TypeSVCB || a.Type == dns.TypeHTTPS {
+		data = svcbToLegacy(data)
+	}
+	record := fmt.Sprintf("%s %d %s %s", a.Name, a.TTL, dns.Type(a.Type).String(), data)
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, errors.New("invalid answer: empty record")
+	}
+	return rr, nil
+}
+
+// truncate keeps the first answers within maxAnswers and maxDataLength, for JSON output.
+func (c *DNSClient) truncate(answer []Answer) ([]Answer, bool) {
+	if c.maxAnswers <= 0 && c.maxDataLength <= 0 {
+		return answer, false
+	}
+	length := 0
+	for idx, ans := range answer {
+		length += len(ans.Data)
+		if (c.maxAnswers > 0 && idx >= c.maxAnswers) || (c.maxDataLength > 0 && length > c.maxDataLength) {
+			return answer[:idx], true
+		}
+	}
+	return answer, false
+}
+
+// normalize makes the names of answers lowercase FQDN, if normalizeName is set.
+func (c *DNSClient) normalize(answer []Answer) []Answer {
+	if !c.normalizeName {
+		return answer
+	}
+	for idx := range answer {
+		answer[idx].Name = dns.Fqdn(strings.ToLower(answer[idx].Name))
+	}
+	return answer
+}
+
+const (
+	// answers without the query type are treated as NODATA
+	typeMismatchEmpty = "empty"
+	// or SERVFAIL
+	typeMismatchReject = "reject"
+)
+
+// answersType reports whether the answers have a record of qtype, or are only a CNAME/DNAME chain toward it.
+func answersType(qtype uint16, answer []Answer) bool {
+	if len(answer) == 0 || qtype == dns.TypeANY {
+		return true
+	}
+	chain := true
+	for _, ans := range answer {
+		switch ans.Type {
+		case qtype:
+			return true
+		case dns.TypeCNAME, dns.TypeDNAME, dns.TypeRRSIG:
+		default:
+			chain = false
+		}
+	}
+	return chain
+}
+
+func rr2ans(rr dns.RR) (Answer, error) {
+	hd := rr.Header()
+	var a Answer
+	a.Name = hd.Name
+	a.Type = hd.Rrtype
+	a.TTL = int(hd.Ttl)
+	// TODO: how to extract Data from RR
+	full, prefix := rr.String(), hd.String()
+	if strings.HasPrefix(full, prefix) {
+		a.Data = strings.TrimSpace(full[len(prefix):])
+	} else if fields := strings.SplitN(full, "\t", 5); len(fields) == 5 {
+		// the class of an unknown type is printed as "CLASS1" instead of "IN", RFC 3597
+		a.Data = strings.TrimSpace(fields[4])
+	} else {
+		return a, errors.New("invalid record: " + full)
+	}
+	if a.Type == dns.TypeSVCB || a.Type == dns.TypeHTTPS {
+		a.Data = svcbFromLegacy(a.Data)
+	}
+	return a, nil
+}
+
+///
+
+// miekg/dns v1.1.38 follows an early draft of SVCB, which names "ech" as "echconfig", and can't parse quoted values.
+// Data of SVCB/HTTPS answers is in the presentation of RFC 9460.
+
+// svcbToLegacy converts SvcParams of RFC 9460 for parsing.
+func svcbToLegacy(data string) string {
+	fields := splitQuoted(data)
+	for idx, field := range fields {
+		if idx < 2 {
+			// SvcPriority and TargetName
+			continue
+		}
+		key, value := field, ""
+		if i := strings.IndexByte(field, '='); i >= 0 {
+			key, value = field[:i], field[i:]
+		}
+		if key == "ech" {
+			key = "echconfig"
+		}
+		if len(value) >= 3 && value[1] == '"' && value[len(value)-1] == '"' {
+			value = "=" + value[2:len(value)-1]
+		}
+		fields[idx] = key + value
+	}
+	return strings.Join(fields, " ")
+}
+
+// svcbFromLegacy converts SvcParams printed by miekg/dns into RFC 9460.
+func svcbFromLegacy(data string) string {
+	fields := splitQuoted(data)
+	for idx, field := range fields {
+		if idx >= 2 && strings.HasPrefix(field, "echconfig=") {
+			fields[idx] = "ech=" + strings.TrimPrefix(field, "echconfig=")
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// splitQuoted splits by spaces, except in double quotes.
+func splitQuoted(data string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted, escaped := false, false
+	for _, r := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case (r == ' ' || r == '\t') && !quoted:
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteRune(r)
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
@@ -0,0 +1,310 @@
+package client
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+// answerCorpus is the regression corpus of ToRR, answers as a malformed upstream may return.
+var answerCorpus = []struct {
+	name   string
+	answer Answer
+	valid  bool
+}{
+	{name: "A", answer: Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}, valid: true},
+	{name: "TXT", answer: Answer{Name: "example.com.", Type: dns.TypeTXT, TTL: 60, Data: `"v=spf1 -all"`}, valid: true},
+	{name: "unknown type", answer: Answer{Name: "example.com.", Type: 65280, TTL: 60, Data: `\# 1 00`}, valid: true},
+	{name: "escaped name", answer: Answer{Name: `\000.example.com.`, Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}, valid: true},
+	{name: "short A", answer: Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1"}},
+	{name: "empty data", answer: Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60}},
+	{name: "two addresses", answer: Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1 2.2.2.2"}},
+	{name: "A as AAAA", answer: Answer{Name: "example.com.", Type: dns.TypeAAAA, TTL: 60, Data: "1.1.1.1"}},
+	{name: "negative TTL", answer: Answer{Name: "example.com.", Type: dns.TypeA, TTL: -1, Data: "1.1.1.1"}},
+	{name: "unbalanced quote", answer: Answer{Name: "example.com.", Type: dns.TypeTXT, TTL: 60, Data: `"unbalanced`}},
+	{name: "unbalanced brace", answer: Answer{Name: "example.com.", Type: dns.TypeTXT, TTL: 60, Data: "( 1.1.1.1"}},
+	{name: "bad rdata length", answer: Answer{Name: "example.com.", Type: 65280, TTL: 60, Data: `\# 2 zz`}},
+	{name: "MX without host", answer: Answer{Name: "example.com.", Type: dns.TypeMX, TTL: 60, Data: "10"}},
+	{name: "newline in data", answer: Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1\nexample.net. 60 A 2.2.2.2"}},
+	{name: "space in name", answer: Answer{Name: "example.com. 60 A 2.2.2.2", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}},
+	{name: "empty name", answer: Answer{Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}},
+	{name: "include directive", answer: Answer{Name: "$INCLUDE", Type: dns.TypeA, TTL: 60, Data: "/etc/passwd"}},
+	{name: "origin directive", answer: Answer{Name: "$ORIGIN", Type: dns.TypeA, TTL: 60, Data: "example.com."}},
+	{name: "type 0", answer: Answer{Name: "example.com.", TTL: 60, Data: "1.1.1.1"}},
+}
+
+func TestToRR(t *testing.T) {
+	for _, tt := range answerCorpus {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := tt.answer.ToRR()
+			if valid := err == nil; valid != tt.valid {
+				t.Fatalf("got %v %v, want valid = %v", rr, err, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+			// round trip
+			ans, err := rr2ans(rr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ans.Data != tt.answer.Data || ans.Type != tt.answer.Type || ans.TTL != tt.answer.TTL {
+				t.Errorf("got %v, want %v", ans, tt.answer)
+			}
+		})
+	}
+}
+
+func TestDoHJSONCorpus(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		// the answers are unmarshaled, and valid
+		unmarshaled bool
+		answers     int
+		valid       int
+	}{
+		{name: "answer", body: `{"Status":0,"Answer":[{"name":"a.","type":1,"TTL":60,"data":"1.1.1.1"}]}`, unmarshaled: true, answers: 1, valid: 1},
+		{name: "empty", body: ``},
+		{name: "truncated", body: `{"Answer":[`},
+		{name: "not object", body: `[1,2]`},
+		{name: "name not string", body: `{"Answer":[{"name":1}]}`},
+		{name: "TTL not number", body: `{"Answer":[{"name":"a.","type":1,"TTL":"x","data":"1.1.1.1"}]}`},
+		{name: "type overflow", body: `{"Answer":[{"name":"a.","type":70000,"TTL":1,"data":"1.1.1.1"}]}`},
+		{name: "null answers", body: `{"Answer":null}`, unmarshaled: true},
+		{name: "null answer", body: `{"Answer":[null]}`, unmarshaled: true, answers: 1},
+		{name: "negative TTL", body: `{"Answer":[{"name":"a.","type":1,"TTL":-5,"data":"1.1.1.1"}]}`, unmarshaled: true, answers: 1},
+		{name: "directive", body: `{"Answer":[{"name":"$INCLUDE","type":1,"TTL":60,"data":"/etc/passwd"}]}`, unmarshaled: true, answers: 1},
+		{name: "injected record", body: `{"Answer":[{"name":"a.","type":1,"TTL":60,"data":"1.1.1.1\nb. 60 A 2.2.2.2"}]}`, unmarshaled: true, answers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r dohResponse
+			err := json.Unmarshal([]byte(tt.body), &r)
+			if unmarshaled := err == nil; unmarshaled != tt.unmarshaled {
+				t.Fatalf("got %v, want unmarshaled = %v", err, tt.unmarshaled)
+			}
+			if !tt.unmarshaled {
+				return
+			}
+			if len(r.Answer) != tt.answers {
+				t.Fatalf("got %v, want %d answers", r.Answer, tt.answers)
+			}
+			valid := 0
+			for _, ans := range r.Answer {
+				if _, err := ans.ToRR(); err == nil {
+					valid++
+				}
+			}
+			if valid != tt.valid {
+				t.Errorf("%d valid answers, want %d", valid, tt.valid)
+			}
+		})
+	}
+}
+
+func TestSVCB(t *testing.T) {
+	const ech = "AEn+DQBFKwAgACABWIHUGj4u+PIggYXcR5JF0gYk3dCRioBW8uJq9H4mKAAIAAEAAQABAANAEnB1YmxpYy50bHMtZWNoLmRldgAA"
+	tests := []struct {
+		name  string
+		qtype uint16
+		data  string
+		// the data after round trip, if it isn't data. Values are quoted as printed by miekg/dns.
+		want string
+		// the SvcParamKey of ECH is parsed
+		ech bool
+	}{
+		{name: "HTTPS alias", qtype: dns.TypeHTTPS, data: "0 svc.example.com."},
+		{name: "HTTPS service", qtype: dns.TypeHTTPS, data: "1 . alpn=h2,h3 ipv4hint=1.1.1.1 ipv6hint=2001:db8::1",
+			want: `1 . alpn="h2,h3" ipv4hint="1.1.1.1" ipv6hint="2001:db8::1"`},
+		{name: "HTTPS ech", qtype: dns.TypeHTTPS, data: "1 . alpn=h2 ech=" + ech, want: `1 . alpn="h2" ech="` + ech + `"`, ech: true},
+		{name: "HTTPS quoted ech", qtype: dns.TypeHTTPS, data: `1 . ech="` + ech + `"`, ech: true},
+		{name: "SVCB", qtype: dns.TypeSVCB, data: "1 svc.example.com. port=8443", want: `1 svc.example.com. port="8443"`},
+		{name: "SVCB ech", qtype: dns.TypeSVCB, data: "2 svc.example.com. port=8443 ech=" + ech, want: `2 svc.example.com. port="8443" ech="` + ech + `"`, ech: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want == "" {
+				want = tt.data
+			}
+			rr, err := Answer{Name: "example.com.", Type: tt.qtype, TTL: 60, Data: tt.data}.ToRR()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var svcb *dns.SVCB
+			switch rr := rr.(type) {
+			case *dns.HTTPS:
+				svcb = &rr.SVCB
+			case *dns.SVCB:
+				svcb = rr
+			}
+			if svcb == nil || rr.Header().Rrtype != tt.qtype {
+				t.Fatalf("got %T", rr)
+			}
+			hasECH := false
+			for _, kv := range svcb.Value {
+				if kv.Key() == dns.SVCB_ECHCONFIG {
+					hasECH = kv.String() == ech
+				}
+			}
+			if hasECH != tt.ech {
+				t.Errorf("ech = %v, want %v", hasECH, tt.ech)
+			}
+
+			// through wire format, as from upstream
+			m := new(dns.Msg)
+			m.Answer = []dns.RR{rr}
+			packed, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Unpack(packed); err != nil {
+				t.Fatal(err)
+			}
+			ans, err := rr2ans(m.Answer[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ans.Type != tt.qtype || ans.Data != want {
+				t.Errorf("got %v, want %s", ans, want)
+			}
+			// and stable after that
+			rr, err = ans.ToRR()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := rr2ans(rr); again.Data != want {
+				t.Errorf("got %v again, want %s", again, want)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	var answer []Answer
+	for i := 1; i <= 5; i++ {
+		// 7 bytes each
+		answer = append(answer, Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1." + strconv.Itoa(i)})
+	}
+	tests := []struct {
+		name          string
+		maxAnswers    int
+		maxDataLength int
+		want          int
+		truncated     bool
+	}{
+		{name: "unlimited", want: 5},
+		{name: "more than limit", maxAnswers: 3, want: 3, truncated: true},
+		{name: "one", maxAnswers: 1, want: 1, truncated: true},
+		{name: "at limit", maxAnswers: 5, want: 5},
+		{name: "under limit", maxAnswers: 10, want: 5},
+		{name: "data length", maxDataLength: 15, want: 2, truncated: true},
+		{name: "data length exact", maxDataLength: 35, want: 5},
+		{name: "data length first too long", maxDataLength: 6, want: 0, truncated: true},
+		{name: "both", maxAnswers: 3, maxDataLength: 30, want: 3, truncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &DNSClient{maxAnswers: tt.maxAnswers, maxDataLength: tt.maxDataLength}
+			got, truncated := c.truncate(answer)
+			if len(got) != tt.want || truncated != tt.truncated {
+				t.Fatalf("got %d %v, want %d %v", len(got), truncated, tt.want, tt.truncated)
+			}
+			// the first ones are kept, in order
+			for idx := range got {
+				if got[idx] != answer[idx] {
+					t.Errorf("got %v, want %v", got[idx], answer[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateQuery(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for i := 1; i <= 5; i++ {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 1.1.1." + strconv.Itoa(i))
+			if r.Question[0].Qtype == dns.TypeAAAA {
+				rr, _ = dns.NewRR(r.Question[0].Name + " 60 IN AAAA 2001:db8::" + strconv.Itoa(i))
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	c := new(DNSClient)
+	c.Init(&config.Config{MaxAnswers: 3, Forward: []config.Server{{DNS: "udp://" + addr, Domain: []string{"example.com"}}}})
+	defer c.Close()
+
+	r := c.QueryWithMeta("www.example.com.", dns.TypeA)
+	if len(r.Answer) != 3 || !r.Truncated {
+		t.Errorf("QueryWithMeta: got %d %v", len(r.Answer), r.Truncated)
+	}
+	// the cached answers are complete
+	if ans := c.Query("www.example.com.", dns.TypeA); len(ans) != 5 {
+		t.Errorf("Query: got %d answers", len(ans))
+	}
+	body, err := c.QueryJSON("www.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dual dualAnswer
+	if err := json.Unmarshal(body, &dual); err != nil {
+		t.Fatal(err)
+	}
+	if len(dual.A) != 3 || len(dual.AAAA) != 3 || !dual.TC {
+		t.Errorf("QueryJSON: got %s", body)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		normalize bool
+		answer    Answer
+		want      Answer
+	}{
+		{name: "off", answer: Answer{Name: "WWW.Example.COM", Type: dns.TypeA, Data: "1.1.1.1"}, want: Answer{Name: "WWW.Example.COM", Type: dns.TypeA, Data: "1.1.1.1"}},
+		{name: "lowercase", normalize: true, answer: Answer{Name: "WWW.Example.COM.", Type: dns.TypeA, Data: "1.1.1.1"}, want: Answer{Name: "www.example.com.", Type: dns.TypeA, Data: "1.1.1.1"}},
+		{name: "fqdn", normalize: true, answer: Answer{Name: "www.example.com", Type: dns.TypeA, Data: "1.1.1.1"}, want: Answer{Name: "www.example.com.", Type: dns.TypeA, Data: "1.1.1.1"}},
+		{name: "data kept", normalize: true, answer: Answer{Name: "WWW.example.com", Type: dns.TypeCNAME, Data: "CDN.Example.NET."}, want: Answer{Name: "www.example.com.", Type: dns.TypeCNAME, Data: "CDN.Example.NET."}},
+		{name: "root", normalize: true, answer: Answer{Name: ".", Type: dns.TypeNS, Data: "a.root-servers.net."}, want: Answer{Name: ".", Type: dns.TypeNS, Data: "a.root-servers.net."}},
+	}
+	for _, tt := range tests {
+		c := &DNSClient{normalizeName: tt.normalize}
+		if got := c.normalize([]Answer{tt.answer}); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR("WWW.Example.COM. 60 IN A 1.1.1.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	for _, normalize := range []bool{false, true} {
+		c := new(DNSClient)
+		c.Init(&config.Config{NormalizeName: normalize, Forward: []config.Server{{DNS: "udp://" + addr, Domain: []string{"example.com"}}}})
+		want := "WWW.Example.COM."
+		if normalize {
+			want = "www.example.com."
+		}
+		// from upstream, then from cache
+		for i := 0; i < 2; i++ {
+			if ans := c.Query("www.example.com.", dns.TypeA); len(ans) != 1 || ans[0].Name != want {
+				t.Errorf("normalize %v: got %v, want %s", normalize, ans, want)
+			}
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// backgroundTimeout bounds the queries in background, e.g. revalidating a stale answer,
+// since they outlive the query which started them.
+var backgroundTimeout = 10 * time.Second
+
+// detachedContext keeps the values of a query context, e.g. client IP, tenant and DO bit,
+// without its deadline and cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+// background runs fn in a goroutine with the values of ctx and a timeout of backgroundTimeout.
+// It is counted as an in-flight query, so CloseContext waits for it. It reports false without running fn after Close.
+func (c *DNSClient) background(ctx context.Context, fn func(ctx context.Context)) bool {
+	c.closing.RLock()
+	if c.closed {
+		c.closing.RUnlock()
+		return false
+	}
+	c.inflight.Add(1)
+	c.closing.RUnlock()
+
+	go func() {
+		defer c.inflight.Done()
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, backgroundTimeout)
+		defer cancel()
+		fn(ctx)
+	}()
+	return true
+}
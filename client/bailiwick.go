@@ -0,0 +1,90 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const (
+	// a record is kept if its owner is the query name, or a target of the CNAME/DNAME chain
+	bailiwickLoose = "loose"
+	// as loose, but a CNAME/DNAME must come before the records of its target
+	bailiwickStrict = "strict"
+)
+
+// checkBailiwick drops the answers not on the chain of the query name, against cache poisoning.
+func checkBailiwick(up *upstream, name string, answer []Answer) []Answer {
+	if len(up.bailiwick) == 0 {
+		return answer
+	}
+
+	inChain := map[string]bool{strings.ToLower(name): true}
+	if up.bailiwick == bailiwickLoose {
+		// targets of all CNAME/DNAME, until fixed point
+		for changed := true; changed; {
+			changed = false
+			for _, ans := range answer {
+				if extendChain(inChain, name, ans) {
+					changed = true
+				}
+			}
+		}
+	}
+
+	filtered := answer[:0]
+	for _, ans := range answer {
+		owner := strings.ToLower(dns.Fqdn(ans.Name))
+		if inChain[owner] || (ans.Type == dns.TypeDNAME && underChain(inChain, owner)) {
+			extendChain(inChain, name, ans)
+			filtered = append(filtered, ans)
+			continue
+		}
+		logger.Module("client").Warn().Str("domain", name).Str("upstream", up.dns).Str("owner", ans.Name).Uint16("type", ans.Type).Msg("out-of-bailiwick record dropped")
+	}
+	return filtered
+}
+
+// extendChain adds the target of an in-chain CNAME/DNAME, reports whether the chain is changed.
+func extendChain(inChain map[string]bool, name string, ans Answer) bool {
+	owner := strings.ToLower(dns.Fqdn(ans.Name))
+	var target string
+	switch ans.Type {
+	case dns.TypeCNAME:
+		if !inChain[owner] {
+			return false
+		}
+		target = ans.Data
+	case dns.TypeDNAME:
+		// the names under owner are redirected to target, RFC 6672
+		for n := range inChain {
+			if n != owner && dns.IsSubDomain(owner, n) {
+				target = strings.TrimSuffix(n, owner) + strings.ToLower(dns.Fqdn(ans.Data))
+				if !inChain[target] {
+					inChain[target] = true
+					return true
+				}
+			}
+		}
+		return false
+	default:
+		return false
+	}
+	target = strings.ToLower(dns.Fqdn(target))
+	if inChain[target] {
+		return false
+	}
+	inChain[target] = true
+	return true
+}
+
+func underChain(inChain map[string]bool, owner string) bool {
+	for n := range inChain {
+		if dns.IsSubDomain(owner, n) {
+			return true
+		}
+	}
+	return false
+}
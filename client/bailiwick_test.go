@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestBailiwick(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		// the answers kept without bailiwick, and with loose and strict
+		off, loose, strict []string
+	}{
+		{
+			name:    "injected",
+			records: []string{"www.example.com. 60 IN A 1.1.1.1", "evil.example.net. 60 IN A 6.6.6.6"},
+			off:     []string{"www.example.com. A 1.1.1.1", "evil.example.net. A 6.6.6.6"},
+			loose:   []string{"www.example.com. A 1.1.1.1"},
+			strict:  []string{"www.example.com. A 1.1.1.1"},
+		},
+		{
+			name:    "cname chain",
+			records: []string{"www.example.com. 60 IN CNAME cdn.example.net.", "cdn.example.net. 60 IN A 2.2.2.2", "evil.example.net. 60 IN A 6.6.6.6"},
+			off:     []string{"www.example.com. CNAME cdn.example.net.", "cdn.example.net. A 2.2.2.2", "evil.example.net. A 6.6.6.6"},
+			loose:   []string{"www.example.com. CNAME cdn.example.net.", "cdn.example.net. A 2.2.2.2"},
+			strict:  []string{"www.example.com. CNAME cdn.example.net.", "cdn.example.net. A 2.2.2.2"},
+		},
+		{
+			name:    "cname after its target",
+			records: []string{"cdn.example.net. 60 IN A 2.2.2.2", "www.example.com. 60 IN CNAME cdn.example.net."},
+			off:     []string{"cdn.example.net. A 2.2.2.2", "www.example.com. CNAME cdn.example.net."},
+			loose:   []string{"cdn.example.net. A 2.2.2.2", "www.example.com. CNAME cdn.example.net."},
+			strict:  []string{"www.example.com. CNAME cdn.example.net."},
+		},
+		{
+			name:    "cname toward the query name",
+			records: []string{"evil.example.net. 60 IN CNAME www.example.com.", "www.example.com. 60 IN A 1.1.1.1"},
+			off:     []string{"evil.example.net. CNAME www.example.com.", "www.example.com. A 1.1.1.1"},
+			loose:   []string{"www.example.com. A 1.1.1.1"},
+			strict:  []string{"www.example.com. A 1.1.1.1"},
+		},
+		{
+			name:    "dname",
+			records: []string{"example.com. 60 IN DNAME example.org.", "www.example.org. 60 IN A 3.3.3.3", "example.org. 60 IN A 6.6.6.6"},
+			off:     []string{"example.com. DNAME example.org.", "www.example.org. A 3.3.3.3", "example.org. A 6.6.6.6"},
+			loose:   []string{"example.com. DNAME example.org.", "www.example.org. A 3.3.3.3"},
+			strict:  []string{"example.com. DNAME example.org.", "www.example.org. A 3.3.3.3"},
+		},
+	}
+	for _, tt := range tests {
+		for _, mode := range []string{"", bailiwickLoose, bailiwickStrict} {
+			want := map[string][]string{"": tt.off, bailiwickLoose: tt.loose, bailiwickStrict: tt.strict}[mode]
+			t.Run(tt.name+" "+mode, func(t *testing.T) {
+				addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+					m := new(dns.Msg)
+					m.SetReply(r)
+					for _, record := range tt.records {
+						rr, _ := dns.NewRR(record)
+						m.Answer = append(m.Answer, rr)
+					}
+					w.WriteMsg(m)
+				})
+				c := new(DNSClient)
+				c.Init(&config.Config{Forward: []config.Server{{DNS: "udp://" + addr, Domain: []string{"example.com"}, Bailiwick: mode}}})
+				defer c.Close()
+
+				// checked before being cached
+				for _, cached := range []bool{false, true} {
+					r := c.ResolveWithMeta(context.Background(), "www.example.com.", dns.TypeA)
+					var got []string
+					for _, ans := range r.Answer {
+						got = append(got, ans.Name+" "+dns.TypeToString[ans.Type]+" "+ans.Data)
+					}
+					if !reflect.DeepEqual(got, want) || r.FromCache != cached {
+						t.Errorf("cached %v: got %v %v, want %v", cached, r.FromCache, got, want)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// bootstrapResolver resolves hostnames of DoH/DoT upstreams with plain DNS servers.
+type bootstrapResolver struct {
+	servers []string // "ip:port"
+}
+
+func newBootstrapResolver(servers []string) *bootstrapResolver {
+	if len(servers) == 0 {
+		return nil
+	}
+	b := new(bootstrapResolver)
+	for _, server := range servers {
+		if net.ParseIP(server) != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		host, _, err := net.SplitHostPort(server)
+		if err != nil || net.ParseIP(host) == nil {
+			logger.Module("client.bootstrap").Error().Str("server", server).Msg("invalid config")
+			panic("bootstrap server should be an IP address: " + server)
+		}
+		b.servers = append(b.servers, server)
+	}
+	return b
+}
+
+func (b *bootstrapResolver) String() string {
+	if b == nil {
+		return ""
+	}
+	return strings.Join(b.servers, ",")
+}
+
+func (b *bootstrapResolver) lookup(host string) ([]string, error) {
+	for _, server := range b.servers {
+		cli := GetUDPClient(server, "", false, defaultQueryTimeout)
+		var addrs []string
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			ans, err := cli(context.Background(), dns.Fqdn(host), qtype)
+			if err != nil {
+				continue
+			}
+			for _, a := range ans {
+				if a.Type == qtype {
+					addrs = append(addrs, a.Data)
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, errors.New("bootstrap: no address for " + host)
+}
+
+///
+
+// pinnedHost is an upstream hostname pinned to the addresses from bootstrap resolver.
+type pinnedHost struct {
+	sync.Mutex
+	host      string
+	addrs     []string
+	bootstrap *bootstrapResolver
+}
+
+// newPinnedHost resolves the host, it returns nil for IP address or without bootstrap resolver.
+func newPinnedHost(host string, bootstrap *bootstrapResolver) *pinnedHost {
+	if bootstrap == nil || net.ParseIP(host) != nil {
+		return nil
+	}
+	p := &pinnedHost{host: host, bootstrap: bootstrap}
+	p.resolve()
+	return p
+}
+
+func (p *pinnedHost) resolve() []string {
+	addrs, err := p.bootstrap.lookup(p.host)
+	if err != nil {
+		logger.Module("client.bootstrap").Error().Str("host", p.host).Err(err).Send()
+	} else {
+		logger.Module("client.bootstrap").Debug().Str("host", p.host).Strs("addrs", addrs).Msg("pinned")
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if len(addrs) > 0 {
+		p.addrs = addrs
+	}
+	return p.addrs
+}
+
+// each calls fn with pinned addresses until success.
+// The host is resolved again if all addresses failed, as when reconnecting.
+func (p *pinnedHost) each(fn func(ip string) error) error {
+	p.Lock()
+	addrs := p.addrs
+	p.Unlock()
+
+	err := errors.New("bootstrap: no address for " + p.host)
+	for round := 0; round < 2; round++ {
+		if round > 0 {
+			addrs = p.resolve()
+		}
+		for _, ip := range addrs {
+			if err = fn(ip); err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHBootstrap(t *testing.T) {
+	var mu sync.Mutex
+	var hosts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		mu.Unlock()
+		w.Header().Set("content-type", "application/dns-json")
+		w.Write([]byte(`{"Status":0,"Answer":[{"name":"example.com.","type":1,"TTL":60,"data":"1.1.1.1"}]}`))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+
+	tests := []struct {
+		name string
+		// the address of doh.example.com by bootstrap, none if empty
+		addr   string
+		failed bool
+	}{
+		{name: "resolved", addr: "127.0.0.1"},
+		{name: "not resolved", failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var questions []string
+			bootstrap := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+				mu.Lock()
+				questions = append(questions, r.Question[0].Name+" "+dns.TypeToString[r.Question[0].Qtype])
+				mu.Unlock()
+				if len(tt.addr) > 0 {
+					answerA(tt.addr)(w, r)
+					return
+				}
+				m := new(dns.Msg)
+				m.SetRcode(r, dns.RcodeNameError)
+				w.WriteMsg(m)
+			})
+			hosts = nil
+
+			// not resolvable by the system resolver
+			server := (&url.URL{Scheme: "http", Host: net.JoinHostPort("doh.example.com", port), Path: "/dns-query"}).String()
+			cli := GetDoHClient(server, "", "", newBootstrapResolver([]string{bootstrap}), dohFormatJSON, 0, dohRetry{})
+			ans, err := cli(context.Background(), "example.com.", dns.TypeA)
+			if (err != nil) != tt.failed {
+				t.Fatalf("got %v %v", ans, err)
+			}
+			if !tt.failed && (len(ans) != 1 || ans[0].Data != "1.1.1.1") {
+				t.Errorf("got %v", ans)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			// resolved once by GetDoHClient, and again if no address is pinned
+			sort.Strings(questions)
+			want := []string{"doh.example.com. A", "doh.example.com. AAAA"}
+			if tt.failed {
+				want = []string{"doh.example.com. A", "doh.example.com. A", "doh.example.com. AAAA", "doh.example.com. AAAA"}
+			}
+			if strings.Join(questions, ",") != strings.Join(want, ",") {
+				t.Errorf("bootstrap got %v, want %v", questions, want)
+			}
+			// the request is still for the hostname
+			if !tt.failed && (len(hosts) != 1 || hosts[0] != net.JoinHostPort("doh.example.com", port)) {
+				t.Errorf("host %v", hosts)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+const (
+	breakerClosed = iota
+	// queries fail at once, until cooldown
+	breakerOpen
+	// one query is sent to test recovery, the others still fail at once
+	breakerHalfOpen
+)
+
+var breakerStateString = [...]string{"closed", "open", "half-open"}
+
+type circuitBreaker struct {
+	sync.Mutex
+	after    int64
+	cooldown time.Duration
+	state    int
+	opened   time.Time
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(b.opened) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	default:
+		return false
+	}
+}
+
+// record updates the state by the result of an allowed query, and returns the new state if changed.
+func (b *circuitBreaker) record(failed bool, failures int64) (int, bool) {
+	b.Lock()
+	defer b.Unlock()
+	prev := b.state
+	if !failed {
+		b.state = breakerClosed
+	} else if b.state == breakerHalfOpen || failures >= b.after {
+		b.state = breakerOpen
+		b.opened = time.Now()
+	}
+	return b.state, b.state != prev
+}
+
+func (b *circuitBreaker) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return breakerStateString[b.state]
+}
+
+// withBreaker wraps cli to fail at once after the consecutive failures counted by stats reach after,
+// so a group fails over without waiting for timeout. The upstream is tried again after cooldown.
+func (c *DNSClient) withBreaker(upstream string, stats *rttStats, after int, cooldown time.Duration, cli dnsClient) dnsClient {
+	if after <= 0 {
+		return cli
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	stats.Lock()
+	if stats.breaker == nil {
+		stats.breaker = &circuitBreaker{after: int64(after), cooldown: cooldown}
+	}
+	b := stats.breaker
+	stats.Unlock()
+
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		if !b.allow() {
+			return nil, errBreakerOpen
+		}
+		ans, err := cli(ctx, name, qtype)
+		if state, changed := b.record(isUpstreamFailure(err), atomic.LoadInt64(&stats.failures)); changed {
+			logger.Module("client.breaker").Warn().Str("upstream", upstream).Str("state", breakerStateString[state]).Send()
+		}
+		return ans, err
+	}
+}
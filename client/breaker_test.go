@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	const cooldown = 50 * time.Millisecond
+
+	c := new(DNSClient)
+	var (
+		calls int
+		fail  error
+	)
+	cli := c.measure("udp://upstream", func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		calls++
+		return nil, fail
+	})
+	val, _ := c.rtt.Load("udp://upstream")
+	query := c.withBreaker("udp://upstream", val.(*rttStats), 2, cooldown, cli)
+
+	steps := []struct {
+		name string
+		fail error
+		// waits before the query
+		wait  time.Duration
+		err   error
+		sent  bool
+		state string
+	}{
+		{name: "answered", sent: true, state: "closed"},
+		{name: "first failure", fail: errTimeout, err: errTimeout, sent: true, state: "closed"},
+		{name: "rcode is not failure", fail: rcodeError(dns.RcodeNameError), err: rcodeError(dns.RcodeNameError), sent: true, state: "closed"},
+		{name: "failure after rcode", fail: errTimeout, err: errTimeout, sent: true, state: "closed"},
+		{name: "opened", fail: errTimeout, err: errTimeout, sent: true, state: "open"},
+		{name: "fail at once", err: errBreakerOpen, state: "open"},
+		{name: "failed probe", fail: errTimeout, wait: cooldown, err: errTimeout, sent: true, state: "open"},
+		{name: "reopened", err: errBreakerOpen, state: "open"},
+		{name: "recovered", wait: cooldown, sent: true, state: "closed"},
+		{name: "closed", sent: true, state: "closed"},
+	}
+	for _, step := range steps {
+		time.Sleep(step.wait)
+		fail = step.fail
+		before := calls
+		_, err := query(context.Background(), "example.com.", dns.TypeA)
+		if err != step.err {
+			t.Errorf("%s: got %v, want %v", step.name, err, step.err)
+		}
+		if sent := calls > before; sent != step.sent {
+			t.Errorf("%s: sent = %v, want %v", step.name, sent, step.sent)
+		}
+		if state := val.(*rttStats).breaker.String(); state != step.state {
+			t.Errorf("%s: state %v, want %v", step.name, state, step.state)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const (
+	// TTL of stale answers. RFC 8767
+	staleTTL           = 30
+	defaultStaleMaxAge = 24 * time.Hour
+	defaultNegativeTTL = 60 * time.Second
+	// TTL 0 isn't served, e.g. of answers scaled down by ttlMultiplier
+	defaultMinServedTTL = 1
+	// consecutive failures of all transports
+	defaultDegradedAfter = 3
+)
+
+// SetCacheKeyFunc replaces the default "domain|type" part of cache key, e.g. to segment cache by a context value.
+// The key is still prefixed by view and tenant. The name is FQDN.
+// It should be called before any query.
+func (c *DNSClient) SetCacheKeyFunc(fn func(ctx context.Context, name string, qtype uint16) string) {
+	c.cacheKeyFunc = fn
+}
+
+type dnsCached struct {
+	// only the answer records, the OPT record and padding of upstream responses aren't kept
+	answer []Answer
+	// NXDOMAIN is cached for negativeTTL with its CNAME chain, SERVFAIL for servfailTTL without answers.
+	// A referral is cached as NOERROR without answers.
+	rcode   int
+	expired time.Time
+	// the TTL of each answer is from stored, for perRecordTTL
+	stored time.Time
+	// for rotation of addresses
+	hits uint32
+	// the upstream answered, nil for rcode entries
+	upstream *upstream
+	// kept after expired, for serveStale
+	keepStale bool
+}
+
+func (c *DNSClient) cacheSet(key string, name string, up *upstream, answer []Answer) {
+	if len(answer) == 0 {
+		return
+	}
+
+	multiplier := c.multiplier(name)
+	for idx := range answer {
+		ttl := answer[idx].TTL
+		if multiplier != 1 && ttl > 0 {
+			ttl = int(float64(ttl) * multiplier)
+			if ttl < defaultMinServedTTL {
+				// not scaled down to 0, which is never cached
+				ttl = defaultMinServedTTL
+			}
+		}
+		answer[idx].TTL = c.clampTTL(answer[idx].Type, ttl)
+	}
+	minTTL := answer[0].TTL
+	for _, ans := range answer {
+		if ans.TTL < minTTL {
+			minTTL = ans.TTL
+		}
+	}
+
+	now := time.Now()
+	val := dnsCached{
+		answer:    answer,
+		expired:   now.Add(time.Duration(minTTL) * time.Second),
+		stored:    now,
+		upstream:  up,
+		keepStale: c.alwaysServeStale(name),
+	}
+	c.cache.Store(key, &val)
+}
+
+// multiplier scales the TTL of answers by ttlMultiplier of the query name, or the closest parent domain, 1 if none.
+func (c *DNSClient) multiplier(name string) float64 {
+	if len(c.ttlMultiplier) == 0 {
+		return 1
+	}
+	domain := dns.Fqdn(strings.ToLower(name))
+	for {
+		if m, found := c.ttlMultiplier[domain]; found {
+			return m
+		}
+		if domain == "." {
+			return 1
+		}
+		domain = domain[strings.IndexByte(domain, '.')+1:]
+		if len(domain) == 0 {
+			domain = "."
+		}
+	}
+}
+
+// clampTTL applies minTTL/maxTTL, or the range of typeTTL for the type.
+func (c *DNSClient) clampTTL(qtype uint16, ttl int) int {
+	r, found := c.typeTTL[qtype]
+	if !found {
+		r = c.ttlRange
+	}
+	if r.Max > 0 && ttl > r.Max {
+		ttl = r.Max
+	}
+	if r.Min > 0 && ttl < r.Min {
+		ttl = r.Min
+	}
+	return ttl
+}
+
+// cacheSetServfail caches SERVFAIL for servfailTTL, to avoid hammering a broken zone.
+func (c *DNSClient) cacheSetServfail(key string) {
+	if c.servfailTTL > 0 {
+		c.cacheSetRcode(key, dns.RcodeServerFailure, nil, c.servfailTTL)
+	}
+}
+
+// cacheSetNegative caches NXDOMAIN for negativeTTL, or the TTL of its CNAME chain if shorter, at most negativeMaxTTL. RFC 2308
+func (c *DNSClient) cacheSetNegative(key string, answer []Answer) {
+	if c.negativeTTL <= 0 {
+		return
+	}
+	ttl := c.negativeTTL
+	for _, ans := range answer {
+		if t := time.Duration(ans.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	if c.negativeMaxTTL > 0 && ttl > c.negativeMaxTTL {
+		ttl = c.negativeMaxTTL
+	}
+	c.cacheSetRcode(key, dns.RcodeNameError, answer, ttl)
+}
+
+// cacheSetReferral caches the empty answers of a referral, so the delegated name isn't queried again at once.
+func (c *DNSClient) cacheSetReferral(key string, ttl int) {
+	if c.cacheReferral {
+		c.cacheSetRcode(key, dns.RcodeSuccess, nil, time.Duration(c.clampTTL(dns.TypeNS, ttl))*time.Second)
+	}
+}
+
+func (c *DNSClient) cacheSetRcode(key string, rcode int, answer []Answer, ttl time.Duration) {
+	now := time.Now()
+	val := dnsCached{
+		answer:  answer,
+		rcode:   rcode,
+		expired: now.Add(ttl),
+		stored:  now,
+	}
+	c.cache.Store(key, &val)
+}
+
+// cacheGet returns the cached answers and rcode, stale is true if they are expired but kept for serve-stale.
+func (c *DNSClient) cacheGet(key string) (answer []Answer, rcode int, stale bool, found bool) {
+	val, found := c.cache.Load(key)
+	if !found {
+		return nil, 0, false, false
+	}
+
+	cached, ok := val.(*dnsCached)
+	if !ok {
+		c.cache.Delete(key)
+		return nil, 0, false, false
+	}
+
+	now := time.Now()
+	ttl, stale, ok := c.cacheTTL(cached, now)
+	if !ok {
+		logger.Module("client.cache").Debug().Str("key", key).Msg("expired")
+		c.cache.Delete(key)
+		return nil, 0, false, false
+	}
+	if stale {
+		logger.Module("client.cache").Debug().Str("key", key).Msg("stale")
+	}
+	// a copy, the cached answers are shared by concurrent queries
+	answer = make([]Answer, len(cached.answer))
+	for idx, ans := range cached.answer {
+		if c.perRecordTTL && !stale {
+			// not less than ttl, which is of the record expiring first
+			remaining := cached.stored.Add(time.Duration(ans.TTL) * time.Second).Sub(now)
+			ans.TTL = c.servedTTL(int(math.Ceil(remaining.Seconds())))
+		} else {
+			ans.TTL = c.servedTTL(ttl)
+		}
+		answer[idx] = ans
+	}
+
+	return answer, cached.rcode, stale, true
+}
+
+// servedTTL applies maxServedTTL/minServedTTL to the remaining TTL.
+func (c *DNSClient) servedTTL(ttl int) int {
+	if c.maxServedTTL > 0 && ttl > c.maxServedTTL {
+		ttl = c.maxServedTTL
+	}
+	if ttl < c.minServedTTL {
+		// near expiry, clients shouldn't query again at once
+		ttl = c.minServedTTL
+	}
+	return ttl
+}
+
+// Range calls fn for each cached entry not expired, with a copy of the answers, until fn returns false.
+// It is safe to query concurrently, but the entries changed meanwhile may be skipped or visited.
+func (c *DNSClient) Range(fn func(key string, answers []Answer, remainingTTL int) bool) {
+	now := time.Now()
+	c.cache.Range(func(key, val interface{}) bool {
+		cached, ok := val.(*dnsCached)
+		if !ok || cached.rcode != dns.RcodeSuccess {
+			return true
+		}
+		ttl := int(math.Ceil(cached.expired.Sub(now).Seconds()))
+		if ttl <= 0 {
+			return true
+		}
+		answers := make([]Answer, len(cached.answer))
+		for idx, ans := range cached.answer {
+			ans.TTL = ttl
+			answers[idx] = ans
+		}
+		return fn(key.(string), answers, ttl)
+	})
+}
+
+// cacheTTL is the TTL of a cached entry served at now, or staleTTL if stale,
+// i.e. expired but kept by extendTTL while its upstream is degraded, or by serve-stale. It is not ok if expired.
+func (c *DNSClient) cacheTTL(cached *dnsCached, now time.Time) (ttl int, stale bool, ok bool) {
+	elapsed := cached.expired.Sub(now)
+	ttl = int(math.Ceil(elapsed.Seconds()))
+	switch {
+	case ttl > 0:
+		return ttl, false, true
+	case cached.rcode != dns.RcodeSuccess:
+		return 0, false, false
+	case cached.upstream != nil && -elapsed < c.extendTTL && cached.upstream.degraded(c.degradedAfter):
+		return staleTTL, true, true
+	case cached.keepStale || (c.staleIfError || c.staleWhileRevalidate) && -elapsed < c.staleMaxAge:
+		return staleTTL, true, true
+	default:
+		return 0, false, false
+	}
+}
+
+// revalidate refreshes a stale entry in background, at most once at a time.
+func (c *DNSClient) revalidate(ctx context.Context, key string, up *upstream, name string, qtype uint16) {
+	if _, loaded := c.revalidating.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	defer c.revalidating.Delete(key)
+
+	if _, _, err := c.fetch(ctx, key, up, name, qtype); err != nil {
+		logger.Module("client.cache").Debug().Str("key", key).Err(err).Msg("revalidate")
+	}
+}
+
+// prune removes the expired entries periodically, since they are only removed lazily on access.
+// Stale entries are kept until staleMaxAge with serve-stale, or extendTTL, and forever for serveStale.
+func (c *DNSClient) prune(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var pruned uint64
+		c.cache.Range(func(key, val interface{}) bool {
+			cached, ok := val.(*dnsCached)
+			if ok && cached.expired.After(now) {
+				return true
+			}
+			// an expired rcode is never served, as by cacheTTL
+			if ok && cached.rcode == dns.RcodeSuccess && (c.staleIfError || c.staleWhileRevalidate) && now.Sub(cached.expired) < c.staleMaxAge {
+				return true
+			}
+			if ok && cached.rcode == dns.RcodeSuccess && now.Sub(cached.expired) < c.extendTTL {
+				return true
+			}
+			if ok && cached.keepStale {
+				return true
+			}
+			c.cache.Delete(key)
+			pruned++
+			return true
+		})
+		atomic.AddUint64(&c.stats.pruned, pruned)
+		logger.Module("client.cache").Debug().Uint64("pruned", pruned).Msg("prune")
+	}
+}
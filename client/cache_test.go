@@ -0,0 +1,821 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestServedTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		ttl  int
+		want int
+	}{
+		{name: "unchanged", ttl: 60, want: 60},
+		{name: "zero floored by default", ttl: 0, want: 1},
+		{name: "max", cfg: config.Config{MaxServedTTL: 30}, ttl: 60, want: 30},
+		{name: "min", cfg: config.Config{MinServedTTL: 5}, ttl: 2, want: 5},
+		{name: "min and max", cfg: config.Config{MinServedTTL: 5, MaxServedTTL: 30}, ttl: 3, want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&tt.cfg)
+			if got := c.servedTTL(tt.ttl); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTTLMultiplier(t *testing.T) {
+	tests := []struct {
+		name       string
+		multiplier map[string]float64
+		domain     string
+		ttl        int
+		want       int
+	}{
+		{name: "none", domain: "example.com.", ttl: 60, want: 60},
+		{name: "scaled up", multiplier: map[string]float64{"example.com": 2}, domain: "www.example.com.", ttl: 60, want: 120},
+		{name: "scaled down", multiplier: map[string]float64{"example.com": 0.5}, domain: "example.com.", ttl: 60, want: 30},
+		{name: "other domain", multiplier: map[string]float64{"example.com": 2}, domain: "example.net.", ttl: 60, want: 60},
+		{name: "not served as zero", multiplier: map[string]float64{"example.com": 0.5}, domain: "example.com.", ttl: 1, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{TTLMultiplier: tt.multiplier})
+			c.cacheSet("key", tt.domain, nil, []Answer{{Name: tt.domain, Type: dns.TypeA, TTL: tt.ttl, Data: "1.1.1.1"}})
+			ans, _, _, found := c.cacheGet("key")
+			if !found || len(ans) != 1 {
+				t.Fatalf("got %v %v", ans, found)
+			}
+			if ans[0].TTL != tt.want {
+				t.Errorf("got TTL %d, want %d", ans[0].TTL, tt.want)
+			}
+		})
+	}
+}
+
+func TestTypeTTL(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   config.Config
+		qtype uint16
+		ttl   int
+		want  int
+	}{
+		{name: "unclamped", qtype: dns.TypeA, ttl: 3600, want: 3600},
+		{name: "maxTTL", cfg: config.Config{MaxTTL: 300}, qtype: dns.TypeA, ttl: 3600, want: 300},
+		{name: "minTTL", cfg: config.Config{MinTTL: 60}, qtype: dns.TypeA, ttl: 5, want: 60},
+		{name: "type max", cfg: config.Config{TypeTTL: map[string]config.TTLRange{"A": {Max: 30}}}, qtype: dns.TypeA, ttl: 3600, want: 30},
+		{name: "type min", cfg: config.Config{TypeTTL: map[string]config.TTLRange{"mx": {Min: 600}}}, qtype: dns.TypeMX, ttl: 60, want: 600},
+		{name: "other type", cfg: config.Config{TypeTTL: map[string]config.TTLRange{"A": {Max: 30}}}, qtype: dns.TypeAAAA, ttl: 3600, want: 3600},
+		// replaces minTTL/maxTTL, not merged with them
+		{name: "type replaces range", cfg: config.Config{MinTTL: 60, MaxTTL: 300, TypeTTL: map[string]config.TTLRange{"A": {Max: 30}}}, qtype: dns.TypeA, ttl: 5, want: 5},
+		{name: "range for other types", cfg: config.Config{MinTTL: 60, MaxTTL: 300, TypeTTL: map[string]config.TTLRange{"A": {Max: 30}}}, qtype: dns.TypeTXT, ttl: 5, want: 60},
+		{name: "type unlimited", cfg: config.Config{MaxTTL: 300, TypeTTL: map[string]config.TTLRange{"NS": {}}}, qtype: dns.TypeNS, ttl: 86400, want: 86400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&tt.cfg)
+			c.cacheSet("key", "example.com.", nil, []Answer{{Name: "example.com.", Type: tt.qtype, TTL: tt.ttl, Data: "data"}})
+			ans, _, _, found := c.cacheGet("key")
+			if !found || len(ans) != 1 {
+				t.Fatalf("got %v %v", ans, found)
+			}
+			if ans[0].TTL != tt.want {
+				t.Errorf("got TTL %d, want %d", ans[0].TTL, tt.want)
+			}
+		})
+	}
+
+	t.Run("mixed types", func(t *testing.T) {
+		c := new(DNSClient)
+		c.Init(&config.Config{TypeTTL: map[string]config.TTLRange{"CNAME": {Min: 3600}, "A": {Max: 30}}})
+		c.cacheSet("key", "www.example.com.", nil, []Answer{
+			{Name: "www.example.com.", Type: dns.TypeCNAME, TTL: 60, Data: "cdn.example.net."},
+			{Name: "cdn.example.net.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"},
+		})
+		// each record is clamped by its type, and the answers expire with the first
+		if got := cachedTTL(c); got != 30*time.Second {
+			t.Errorf("cached for %v, want 30s", got)
+		}
+	})
+
+	t.Run("invalid type", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("no panic")
+			}
+		}()
+		new(DNSClient).Init(&config.Config{TypeTTL: map[string]config.TTLRange{"NOPE": {Max: 30}}})
+	})
+}
+
+func TestMaxServedTTL(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          config.Config
+		ttls         []int
+		want         []int
+		wantRemained int
+	}{
+		{name: "capped", cfg: config.Config{MaxServedTTL: 60}, ttls: []int{300}, want: []int{60}, wantRemained: 300},
+		{name: "under cap", cfg: config.Config{MaxServedTTL: 60}, ttls: []int{30}, want: []int{30}, wantRemained: 30},
+		{name: "unlimited", ttls: []int{300}, want: []int{300}, wantRemained: 300},
+		{name: "per record", cfg: config.Config{MaxServedTTL: 60, PerRecordTTL: true}, ttls: []int{300, 30}, want: []int{60, 30}, wantRemained: 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&tt.cfg)
+			var answer []Answer
+			for idx, ttl := range tt.ttls {
+				answer = append(answer, Answer{Name: "example.com.", Type: dns.TypeA, TTL: ttl, Data: "1.1.1." + strconv.Itoa(idx)})
+			}
+			c.cacheSet("key", "example.com.", nil, answer)
+
+			ans, _, _, found := c.cacheGet("key")
+			if !found || len(ans) != len(tt.want) {
+				t.Fatalf("got %v %v", ans, found)
+			}
+			for idx := range ans {
+				if ans[idx].TTL != tt.want[idx] {
+					t.Errorf("%s: got TTL %d, want %d", ans[idx].Data, ans[idx].TTL, tt.want[idx])
+				}
+			}
+			// the stored expiry isn't shortened
+			remained := 0
+			c.Range(func(key string, answers []Answer, remainingTTL int) bool {
+				remained = remainingTTL
+				return true
+			})
+			if remained != tt.wantRemained {
+				t.Errorf("remaining TTL %d, want %d", remained, tt.wantRemained)
+			}
+		})
+	}
+}
+
+func TestPerRecordTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		// stored ago, past the expiry of the first record is stale
+		ago  time.Duration
+		want []int
+	}{
+		{name: "off", want: []int{30, 30, 30}},
+		{name: "off elapsed", ago: 10 * time.Second, want: []int{20, 20, 20}},
+		{name: "on", cfg: config.Config{PerRecordTTL: true}, want: []int{300, 30, 3600}},
+		{name: "on elapsed", cfg: config.Config{PerRecordTTL: true}, ago: 10 * time.Second, want: []int{290, 20, 3590}},
+		{name: "on served max", cfg: config.Config{PerRecordTTL: true, MaxServedTTL: 100}, ago: 10 * time.Second, want: []int{100, 20, 100}},
+		{name: "on stale", cfg: config.Config{PerRecordTTL: true, StaleIfError: true, StaleMaxAge: 60}, ago: 40 * time.Second, want: []int{staleTTL, staleTTL, staleTTL}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&tt.cfg)
+			c.cacheSet("key", "example.com.", nil, []Answer{
+				{Name: "example.com.", Type: dns.TypeA, TTL: 300, Data: "1.1.1.1"},
+				{Name: "example.com.", Type: dns.TypeA, TTL: 30, Data: "2.2.2.2"},
+				{Name: "example.com.", Type: dns.TypeA, TTL: 3600, Data: "3.3.3.3"},
+			})
+			c.cache.Range(func(_, val interface{}) bool {
+				cached := val.(*dnsCached)
+				cached.stored = cached.stored.Add(-tt.ago)
+				cached.expired = cached.expired.Add(-tt.ago)
+				return true
+			})
+
+			ans, _, _, found := c.cacheGet("key")
+			if !found || len(ans) != len(tt.want) {
+				t.Fatalf("got %v %v", ans, found)
+			}
+			for idx := range ans {
+				if ans[idx].TTL != tt.want[idx] {
+					t.Errorf("%s: got TTL %d, want %d", ans[idx].Data, ans[idx].TTL, tt.want[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	c := new(DNSClient)
+	c.Init(&config.Config{})
+	now := time.Now()
+	for key, cached := range map[string]*dnsCached{
+		"fresh":    {expired: now.Add(time.Minute)},
+		"expired":  {expired: now.Add(-time.Second)},
+		"nxdomain": {rcode: dns.RcodeNameError, expired: now.Add(time.Minute)},
+	} {
+		cached.answer = []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 600, Data: key}}
+		c.cache.Store(key, cached)
+	}
+
+	var keys []string
+	c.Range(func(key string, answers []Answer, remainingTTL int) bool {
+		keys = append(keys, key)
+		if remainingTTL != 60 || len(answers) != 1 || answers[0].TTL != 60 {
+			t.Errorf("%s: got %v %d", key, answers, remainingTTL)
+		}
+		// a copy
+		answers[0].Data = "changed"
+		return true
+	})
+	if !reflect.DeepEqual(keys, []string{"fresh"}) {
+		t.Errorf("got %v, want only the fresh", keys)
+	}
+	if ans, _, _, _ := c.cacheGet("fresh"); len(ans) != 1 || ans[0].Data != "fresh" {
+		t.Errorf("cache changed by Range: %v", ans)
+	}
+}
+
+func TestRangeConcurrent(t *testing.T) {
+	c := new(DNSClient)
+	// each hit is refreshed in background
+	c.Init(&config.Config{Revalidate: []string{"example.com"}, PerRecordTTL: true})
+	var calls, failing int32
+	c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: countingClient(&calls, &failing)})
+	defer c.Close()
+
+	// queries storing, refreshing and reading the cache, while it is ranged over
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.Query("www"+strconv.Itoa((i+n)%8)+".example.com.", dns.TypeA)
+			}
+		}(i)
+	}
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		c.Range(func(key string, answers []Answer, remainingTTL int) bool {
+			for _, ans := range answers {
+				if ans.TTL != remainingTTL || !strings.HasPrefix(ans.Data, "1.1.1.") {
+					t.Errorf("%s: got %v, remaining %d", key, ans, remainingTTL)
+				}
+			}
+			if len(answers) > 0 {
+				answers[0].Data = "changed"
+			}
+			return true
+		})
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func BenchmarkCacheGetSet(b *testing.B) {
+	c := new(DNSClient)
+	c.Init(&config.Config{})
+	defer c.Close()
+	answer := []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 300, Data: "192.0.2.1"}}
+	keys := make([]string, 1024)
+	for idx := range keys {
+		keys[idx] = strconv.Itoa(idx) + ".example.com.|1"
+		c.cacheSet(keys[idx], "example.com.", nil, answer)
+	}
+
+	b.Run("get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c.cacheGet(keys[i%len(keys)])
+		}
+	})
+	b.Run("set", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c.cacheSet(keys[i%len(keys)], "example.com.", nil, answer)
+		}
+	})
+	// one write in ten, by GOMAXPROCS goroutines
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				key := keys[i%len(keys)]
+				if i%10 == 0 {
+					c.cacheSet(key, "example.com.", nil, answer)
+				} else {
+					c.cacheGet(key)
+				}
+				i++
+			}
+		})
+	})
+}
+
+// expire moves the expiry of all cache entries to ago.
+func expire(c *DNSClient, ago time.Duration) {
+	c.cache.Range(func(_, val interface{}) bool {
+		if cached, ok := val.(*dnsCached); ok {
+			cached.expired = time.Now().Add(-ago)
+		}
+		return true
+	})
+}
+
+// cachedData returns the data of the first cached answer.
+func cachedData(c *DNSClient) string {
+	data := ""
+	c.cache.Range(func(_, val interface{}) bool {
+		if cached, ok := val.(*dnsCached); ok && len(cached.answer) > 0 {
+			data = cached.answer[0].Data
+		}
+		return true
+	})
+	return data
+}
+
+// countingClient answers "1.1.1.N" for the Nth query, or fails while failing is set.
+// It takes a while, and fails if ctx is done meanwhile.
+func countingClient(calls *int32, failing *int32) dnsClient {
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		n := atomic.AddInt32(calls, 1)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+		if atomic.LoadInt32(failing) == 1 {
+			return nil, errors.New("timeout")
+		}
+		return []Answer{{Name: name, Type: qtype, TTL: 60, Data: "1.1.1." + strconv.Itoa(int(n))}}, nil
+	}
+}
+
+func TestStaleModes(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		fail bool
+		// the answer of the query after expired, and the cached answer after that
+		want   string
+		cached string
+	}{
+		{name: "off", want: "1.1.1.2", cached: "1.1.1.2"},
+		{name: "off failed", fail: true, want: "", cached: ""},
+		{name: "serve-stale", cfg: config.Config{StaleIfError: true}, want: "1.1.1.2", cached: "1.1.1.2"},
+		{name: "serve-stale failed", cfg: config.Config{StaleIfError: true}, fail: true, want: "1.1.1.1", cached: "1.1.1.1"},
+		{name: "revalidate", cfg: config.Config{StaleWhileRevalidate: true}, want: "1.1.1.1", cached: "1.1.1.2"},
+		{name: "revalidate failed", cfg: config.Config{StaleWhileRevalidate: true}, fail: true, want: "1.1.1.1", cached: "1.1.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&tt.cfg)
+			var calls, failing int32
+			c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: countingClient(&calls, &failing)})
+
+			if ans := c.Query("example.com.", dns.TypeA); len(ans) != 1 {
+				t.Fatalf("got %v", ans)
+			}
+			expire(c, time.Second)
+			if tt.fail {
+				atomic.StoreInt32(&failing, 1)
+			}
+
+			// the background refresh outlives the query
+			ctx, cancel := context.WithCancel(context.Background())
+			ans := c.QueryContext(ctx, "example.com.", dns.TypeA)
+			cancel()
+			got := ""
+			if len(ans) > 0 {
+				got = ans[0].Data
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", ans, tt.want)
+			}
+
+			// waits for the background refresh
+			c.Close()
+			if data := cachedData(c); data != tt.cached {
+				t.Errorf("cached %v, want %v", data, tt.cached)
+			}
+		})
+	}
+}
+
+// rcodeClient answers "1.1.1.1", or fails with the rcode stored in rcode if not 0.
+func rcodeClient(calls *int32, rcode *int32, answer ...Answer) dnsClient {
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		atomic.AddInt32(calls, 1)
+		if r := atomic.LoadInt32(rcode); r != 0 {
+			return append([]Answer(nil), answer...), rcodeError(r)
+		}
+		return []Answer{{Name: name, Type: qtype, TTL: 60, Data: "1.1.1.1"}}, nil
+	}
+}
+
+func TestServfailCache(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		// answered before SERVFAIL, then expired
+		answered bool
+		// the rcode and source of the second SERVFAIL query, and the upstream calls in total
+		rcode     int
+		fromCache bool
+		calls     int32
+	}{
+		{name: "not cached", rcode: dns.RcodeServerFailure, calls: 2},
+		{name: "cached", cfg: config.Config{ServfailTTL: 5}, rcode: dns.RcodeServerFailure, fromCache: true, calls: 1},
+		{name: "stale preferred", cfg: config.Config{ServfailTTL: 5, StaleIfError: true, StaleMaxAge: 60}, answered: true, fromCache: true, calls: 3},
+		{name: "stale replaced", cfg: config.Config{ServfailTTL: 5}, answered: true, rcode: dns.RcodeServerFailure, fromCache: true, calls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&tt.cfg)
+			var calls, rcode int32
+			c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: rcodeClient(&calls, &rcode)})
+
+			if tt.answered {
+				c.Query("example.com.", dns.TypeA)
+				expire(c, time.Second)
+			}
+			atomic.StoreInt32(&rcode, dns.RcodeServerFailure)
+			if r := c.ResolveWithMeta(context.Background(), "example.com.", dns.TypeA); r.Rcode != dns.RcodeServerFailure && !tt.answered {
+				t.Fatalf("got %v", dns.RcodeToString[r.Rcode])
+			}
+			r := c.ResolveWithMeta(context.Background(), "example.com.", dns.TypeA)
+			if r.Rcode != tt.rcode || r.FromCache != tt.fromCache {
+				t.Errorf("got %s %v, want %s %v", dns.RcodeToString[r.Rcode], r.FromCache, dns.RcodeToString[tt.rcode], tt.fromCache)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.calls {
+				t.Errorf("%d upstream calls, want %d", got, tt.calls)
+			}
+
+			// queried again once expired
+			expire(c, time.Second)
+			atomic.StoreInt32(&rcode, 0)
+			if r := c.ResolveWithMeta(context.Background(), "example.com.", dns.TypeA); r.Rcode != dns.RcodeSuccess || r.FromCache || len(r.Answer) != 1 {
+				t.Errorf("after expired: got %s %v %v", dns.RcodeToString[r.Rcode], r.FromCache, r.Answer)
+			}
+		})
+	}
+}
+
+// cachedTTL is the TTL of the only cached entry.
+func cachedTTL(c *DNSClient) time.Duration {
+	var ttl time.Duration
+	c.cache.Range(func(_, val interface{}) bool {
+		if cached, ok := val.(*dnsCached); ok {
+			ttl = cached.expired.Sub(cached.stored)
+		}
+		return true
+	})
+	return ttl
+}
+
+func TestNegativeCache(t *testing.T) {
+	chain := func(ttl int) []Answer {
+		return []Answer{
+			{Name: "example.com.", Type: dns.TypeCNAME, TTL: ttl, Data: "www.example.net."},
+			{Name: "www.example.net.", Type: dns.TypeCNAME, TTL: 300, Data: "gone.example.org."},
+		}
+	}
+	tests := []struct {
+		name  string
+		cfg   config.Config
+		chain []Answer
+		// cached for ttl, 0 if not cached
+		ttl time.Duration
+	}{
+		{name: "nxdomain", ttl: defaultNegativeTTL},
+		{name: "chain shorter", chain: chain(30), ttl: 30 * time.Second},
+		{name: "chain longer", chain: chain(600), ttl: defaultNegativeTTL},
+		{name: "negativeTTL", cfg: config.Config{NegativeTTL: 10}, chain: chain(30), ttl: 10 * time.Second},
+		{name: "disabled", cfg: config.Config{NegativeTTL: -1}, chain: chain(30)},
+		{name: "negativeMaxTTL", cfg: config.Config{NegativeMaxTTL: 10}, ttl: 10 * time.Second},
+		{name: "negativeMaxTTL chain", cfg: config.Config{NegativeMaxTTL: 10}, chain: chain(30), ttl: 10 * time.Second},
+		{name: "negativeMaxTTL longer", cfg: config.Config{NegativeMaxTTL: 120}, chain: chain(30), ttl: 30 * time.Second},
+		{name: "negativeMaxTTL over negativeTTL", cfg: config.Config{NegativeTTL: 300, NegativeMaxTTL: 120}, ttl: 120 * time.Second},
+		{name: "negativeMaxTTL not minTTL", cfg: config.Config{NegativeMaxTTL: 10, MinTTL: 60}, ttl: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&tt.cfg)
+			var calls int32
+			rcode := int32(dns.RcodeNameError)
+			c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: rcodeClient(&calls, &rcode, tt.chain...)})
+
+			for i, cached := range []bool{false, tt.ttl > 0} {
+				r := c.ResolveWithMeta(context.Background(), "example.com.", dns.TypeA)
+				if r.Rcode != dns.RcodeNameError || r.FromCache != cached || len(r.Answer) != len(tt.chain) {
+					t.Fatalf("query %d: got %s %v %v", i, dns.RcodeToString[r.Rcode], r.FromCache, r.Answer)
+				}
+				// the chain in order, served with the TTL left
+				for idx, ans := range r.Answer {
+					if ans.Data != tt.chain[idx].Data || (cached && ans.TTL > int(tt.ttl.Seconds())) {
+						t.Errorf("query %d: got %v, want %v within %v", i, ans, tt.chain[idx], tt.ttl)
+					}
+				}
+			}
+			if got := cachedTTL(c); got != tt.ttl {
+				t.Errorf("cached for %v, want %v", got, tt.ttl)
+			}
+			if want := map[bool]int32{true: 1, false: 2}[tt.ttl > 0]; atomic.LoadInt32(&calls) != want {
+				t.Errorf("%d upstream calls, want %d", calls, want)
+			}
+		})
+	}
+}
+
+func TestExtendTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.Config
+		expired  time.Duration
+		degraded bool
+		// the upstream fails after the first answer
+		fail bool
+		// the answer of the query after expired, whether it is stale, and the cached answer after the probe
+		want   string
+		stale  bool
+		cached string
+	}{
+		{name: "not degraded", cfg: config.Config{ExtendTTL: 600}, expired: time.Second, want: "1.1.1.2", cached: "1.1.1.2"},
+		{name: "degraded", cfg: config.Config{ExtendTTL: 600}, expired: time.Second, degraded: true, want: "1.1.1.1", stale: true, cached: "1.1.1.2"},
+		{name: "degraded failing", cfg: config.Config{ExtendTTL: 600}, expired: time.Second, degraded: true, fail: true, want: "1.1.1.1", stale: true, cached: "1.1.1.1"},
+		{name: "degraded after", cfg: config.Config{ExtendTTL: 600, DegradedAfter: 5}, expired: time.Second, degraded: true, want: "1.1.1.2", cached: "1.1.1.2"},
+		{name: "past extendTTL", cfg: config.Config{ExtendTTL: 600}, expired: 700 * time.Second, degraded: true, fail: true},
+		{name: "disabled", expired: time.Second, degraded: true, fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&tt.cfg)
+			var calls, failing int32
+			health := new(rttStats)
+			c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: countingClient(&calls, &failing), health: []*rttStats{health}})
+
+			if ans := c.Query("example.com.", dns.TypeA); len(ans) != 1 {
+				t.Fatalf("got %v", ans)
+			}
+			expire(c, tt.expired)
+			if tt.degraded {
+				// failed for defaultDegradedAfter queries
+				atomic.StoreInt64(&health.failures, defaultDegradedAfter)
+			}
+			if tt.fail {
+				atomic.StoreInt32(&failing, 1)
+			}
+
+			r := c.ResolveWithMeta(context.Background(), "example.com.", dns.TypeA)
+			got := ""
+			if len(r.Answer) > 0 {
+				got = r.Answer[0].Data
+			}
+			if got != tt.want || (r.ExtendedError == edeStale) != tt.stale {
+				t.Errorf("got %v %v, want %v stale %v", r.Answer, r.ExtendedError, tt.want, tt.stale)
+			}
+			if tt.stale && r.Answer[0].TTL != staleTTL {
+				t.Errorf("served with TTL %d, want %d", r.Answer[0].TTL, staleTTL)
+			}
+
+			// waits for the probe
+			c.Close()
+			if data := cachedData(c); data != tt.cached {
+				t.Errorf("cached %v, want %v", data, tt.cached)
+			}
+		})
+	}
+}
+
+func TestServeStaleDomain(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		fail  bool
+		// the answer of the query long after expired, whether it is stale, and the cached answer after the refresh
+		want   string
+		stale  bool
+		cached string
+	}{
+		{name: "domain", query: "app.example.com.", want: "1.1.1.1", stale: true, cached: "1.1.1.2"},
+		{name: "subdomain", query: "www.app.example.com.", want: "1.1.1.1", stale: true, cached: "1.1.1.2"},
+		{name: "domain failing", query: "app.example.com.", fail: true, want: "1.1.1.1", stale: true, cached: "1.1.1.1"},
+		{name: "other domain", query: "www.example.com.", want: "1.1.1.2", cached: "1.1.1.2"},
+		{name: "other domain failing", query: "www.example.com.", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{ServeStale: []string{"app.example.com"}, StaleIfError: true, StaleMaxAge: 60})
+			var calls, failing int32
+			c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: countingClient(&calls, &failing)})
+
+			if ans := c.Query(tt.query, dns.TypeA); len(ans) != 1 {
+				t.Fatalf("got %v", ans)
+			}
+			// beyond staleMaxAge
+			expire(c, 24*time.Hour)
+			if tt.fail {
+				atomic.StoreInt32(&failing, 1)
+			}
+
+			r := c.ResolveWithMeta(context.Background(), tt.query, dns.TypeA)
+			got := ""
+			if len(r.Answer) > 0 {
+				got = r.Answer[0].Data
+			}
+			if got != tt.want || (r.ExtendedError == edeStale) != tt.stale {
+				t.Errorf("got %v %v, want %v stale %v", r.Answer, r.ExtendedError, tt.want, tt.stale)
+			}
+			if tt.stale && r.Answer[0].TTL != staleTTL {
+				t.Errorf("served with TTL %d, want %d", r.Answer[0].TTL, staleTTL)
+			}
+
+			// waits for the refresh
+			c.Close()
+			if data := cachedData(c); data != tt.cached {
+				t.Errorf("cached %v, want %v", data, tt.cached)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		// the entries left after prune
+		want []string
+	}{
+		{name: "expired", want: []string{"fresh", "serveStale"}},
+		{name: "serve-stale", cfg: config.Config{StaleIfError: true, StaleMaxAge: 60}, want: []string{"fresh", "serveStale", "stale"}},
+		{name: "revalidate", cfg: config.Config{StaleWhileRevalidate: true, StaleMaxAge: 7200}, want: []string{"fresh", "serveStale", "stale", "stale long"}},
+		{name: "extendTTL", cfg: config.Config{ExtendTTL: 600}, want: []string{"fresh", "serveStale", "stale"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&tt.cfg)
+			now := time.Now()
+			for key, cached := range map[string]*dnsCached{
+				"fresh":      {expired: now.Add(time.Minute)},
+				"stale":      {expired: now.Add(-time.Second)},
+				"stale long": {expired: now.Add(-time.Hour)},
+				"nxdomain":   {rcode: dns.RcodeNameError, expired: now.Add(-time.Second)},
+				"servfail":   {rcode: dns.RcodeServerFailure, expired: now.Add(-time.Second)},
+				"serveStale": {keepStale: true, expired: now.Add(-24 * time.Hour)},
+			} {
+				cached.answer = []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: key}}
+				c.cache.Store(key, cached)
+			}
+
+			stop, done := make(chan struct{}), make(chan struct{})
+			go func() {
+				c.prune(time.Millisecond, stop)
+				close(done)
+			}()
+			time.Sleep(20 * time.Millisecond)
+			close(stop)
+			<-done
+
+			var left []string
+			c.cache.Range(func(key, _ interface{}) bool {
+				left = append(left, key.(string))
+				return true
+			})
+			sort.Strings(left)
+			if !reflect.DeepEqual(left, tt.want) {
+				t.Errorf("got %v, want %v", left, tt.want)
+			}
+			if got, want := c.Stats().Pruned, uint64(6-len(tt.want)); got != want {
+				t.Errorf("pruned %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestCachePrefix(t *testing.T) {
+	// two instances with their own prefix, sharing the cache of c
+	c := new(DNSClient)
+	c.Init(&config.Config{})
+	var calls, failing int32
+	c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: countingClient(&calls, &failing)})
+	tenant := WithTenant(context.Background(), "t")
+	keys := func() []string {
+		var keys []string
+		c.cache.Range(func(key, _ interface{}) bool {
+			keys = append(keys, key.(string))
+			return true
+		})
+		sort.Strings(keys)
+		return keys
+	}
+
+	for _, prefix := range []string{"a:", "b:"} {
+		c.cachePrefix = prefix
+		// not answered by the other prefix
+		for _, ctx := range []context.Context{context.Background(), tenant} {
+			r := c.ResolveWithMeta(ctx, "www.example.com.", dns.TypeA)
+			if r.FromCache {
+				t.Errorf("%s: answered from cache %v", prefix, r.Answer)
+			}
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 4 {
+		t.Errorf("%d upstream calls, want 4", got)
+	}
+	want := []string{"a:t#www.example.com.|1", "a:www.example.com.|1", "b:t#www.example.com.|1", "b:www.example.com.|1"}
+	if got := keys(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	c.cachePrefix = "a:"
+	c.FlushTenant("t")
+	want = []string{"a:www.example.com.|1", "b:t#www.example.com.|1", "b:www.example.com.|1"}
+	if got := keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("flushed tenant: got %v, want %v", got, want)
+	}
+
+	c.cachePrefix = "b:"
+	c.invalidate("example.com.")
+	want = []string{"a:www.example.com.|1"}
+	if got := keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("invalidated: got %v, want %v", got, want)
+	}
+}
+
+type regionKey struct{}
+
+func TestCacheKeyFunc(t *testing.T) {
+	c := new(DNSClient)
+	c.Init(&config.Config{CachePrefix: "p:"})
+	var calls, failing int32
+	c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: countingClient(&calls, &failing)})
+	c.SetCacheKeyFunc(func(ctx context.Context, name string, qtype uint16) string {
+		region, _ := ctx.Value(regionKey{}).(string)
+		return region + "/" + name + "/" + strconv.Itoa(int(qtype))
+	})
+	region := func(ctx context.Context, r string) context.Context { return context.WithValue(ctx, regionKey{}, r) }
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		// answered from cache, and the cache key
+		cached bool
+		key    string
+	}{
+		{name: "first region", ctx: region(context.Background(), "eu"), key: "p:eu/www.example.com./1"},
+		{name: "first region again", ctx: region(context.Background(), "eu"), cached: true, key: "p:eu/www.example.com./1"},
+		{name: "other region", ctx: region(context.Background(), "us"), key: "p:us/www.example.com./1"},
+		{name: "no region", ctx: context.Background(), key: "p:/www.example.com./1"},
+		{name: "tenant", ctx: WithTenant(region(context.Background(), "eu"), "t"), key: "p:t#eu/www.example.com./1"},
+	}
+	for _, tt := range tests {
+		r := c.ResolveWithMeta(tt.ctx, "www.example.com.", dns.TypeA)
+		if r.FromCache != tt.cached {
+			t.Errorf("%s: cached = %v, want %v", tt.name, r.FromCache, tt.cached)
+		}
+		if _, found := c.cache.Load(tt.key); !found {
+			t.Errorf("%s: no key %s", tt.name, tt.key)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 4 {
+		t.Errorf("%d upstream calls, want 4", got)
+	}
+
+	// the key format is unknown, so all keys of the prefix are invalidated
+	c.cache.Store("other:www.example.com.|1", &dnsCached{expired: time.Now().Add(time.Minute)})
+	c.invalidate("www.example.com.")
+	var left []string
+	c.cache.Range(func(key, _ interface{}) bool {
+		left = append(left, key.(string))
+		return true
+	})
+	if !reflect.DeepEqual(left, []string{"other:www.example.com.|1"}) {
+		t.Errorf("left %v after invalidated", left)
+	}
+}
@@ -0,0 +1,49 @@
+// Package clienttest provides test doubles of client.Resolver.
+package clienttest
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/client"
+)
+
+// StaticResolver answers queries with the answers of the same name and type.
+// If there is none, Rcode is returned, NOERROR by default.
+type StaticResolver struct {
+	Answers []client.Answer
+	Rcode   int
+}
+
+var _ client.Resolver = (*StaticResolver)(nil)
+
+func (r *StaticResolver) Query(name string, qtype uint16) []client.Answer {
+	ans, _ := r.ResolveContext(context.Background(), name, qtype)
+	return ans
+}
+
+func (r *StaticResolver) QueryContext(ctx context.Context, name string, qtype uint16) []client.Answer {
+	ans, _ := r.ResolveContext(ctx, name, qtype)
+	return ans
+}
+
+func (r *StaticResolver) ResolveContext(ctx context.Context, name string, qtype uint16) ([]client.Answer, int) {
+	name = dns.Fqdn(strings.ToLower(name))
+	var ans []client.Answer
+	for _, a := range r.Answers {
+		if a.Type == qtype && dns.Fqdn(strings.ToLower(a.Name)) == name {
+			ans = append(ans, a)
+		}
+	}
+	if len(ans) == 0 {
+		return nil, r.Rcode
+	}
+	return ans, dns.RcodeSuccess
+}
+
+func (r *StaticResolver) ResolveWithMeta(ctx context.Context, name string, qtype uint16) client.Result {
+	ans, rcode := r.ResolveContext(ctx, name, qtype)
+	return client.Result{Answer: ans, Rcode: rcode, FromStatic: true}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// Close is CloseContext without deadline, in-flight queries are still bounded by the upstream timeout.
+func (c *DNSClient) Close() {
+	c.CloseContext(context.Background())
+}
+
+// CloseContext stops accepting queries, then waits for in-flight queries until ctx is done.
+// TCP/DoT connections not used by other clients and the query log are closed after that, the queries still waiting on them fail.
+// New queries are answered with SERVFAIL.
+func (c *DNSClient) CloseContext(ctx context.Context) error {
+	c.closing.Lock()
+	closed := c.closed
+	c.closed = true
+	c.closing.Unlock()
+	if c.stop != nil && !closed {
+		close(c.stop)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		logger.Module("client").Warn().Err(err).Msg("close with in-flight queries")
+	}
+
+	if !closed {
+		c.tcpSessions.Range(func(key, _ interface{}) bool {
+			key.(*tcpSession).release()
+			return true
+		})
+	}
+	if c.queryLog != nil {
+		c.queryLog.close()
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestCloseInflight(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		deadline time.Duration
+		err      error
+		// the in-flight query is answered
+		answered bool
+		within   time.Duration
+	}{
+		{name: "drained", delay: 50 * ms, deadline: time.Second, answered: true, within: 200 * ms},
+		{name: "deadline", delay: 500 * ms, deadline: 50 * ms, err: context.DeadlineExceeded, within: 200 * ms},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{})
+			started := make(chan struct{})
+			c.view.router.add("example.com.", &upstream{dns: "fake://slow", query: func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+				close(started)
+				time.Sleep(tt.delay)
+				return []Answer{{Name: name, Type: qtype, TTL: 60, Data: "1.1.1.1"}}, nil
+			}})
+
+			result := make(chan []Answer, 1)
+			go func() { result <- c.Query("example.com.", dns.TypeA) }()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.deadline)
+			defer cancel()
+			start := time.Now()
+			if err := c.CloseContext(ctx); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if elapsed := time.Since(start); elapsed >= tt.within {
+				t.Errorf("returned after %v, want within %v", elapsed, tt.within)
+			}
+			if _, rcode := c.Resolve("example.com.", dns.TypeA); rcode != dns.RcodeServerFailure {
+				t.Errorf("got %v after closed, want SERVFAIL", dns.RcodeToString[rcode])
+			}
+
+			// the in-flight query is answered either way, before or after CloseContext returned
+			answered := false
+			select {
+			case ans := <-result:
+				answered = len(ans) == 1
+			case <-time.After(tt.delay / 2):
+				if ans := <-result; len(ans) != 1 {
+					t.Errorf("got %v", ans)
+				}
+			}
+			if answered != tt.answered {
+				t.Errorf("answered before closed = %v, want %v", answered, tt.answered)
+			}
+		})
+	}
+}
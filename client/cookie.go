@@ -0,0 +1,60 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// dnsCookie is the DNS Cookie of an upstream. RFC 7873
+type dnsCookie struct {
+	sync.Mutex
+	client string // hex encoded, 8 bytes
+	server string // hex encoded, 8 to 32 bytes, learned from response
+}
+
+func newDNSCookie() *dnsCookie {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return &dnsCookie{client: hex.EncodeToString(b)}
+}
+
+// attach adds the cookie option to query.
+func (c *dnsCookie) attach(msg *dns.Msg) {
+	c.Lock()
+	cookie := c.client + c.server
+	c.Unlock()
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		opt = msg.SetEdns0(dns.DefaultMsgSize, false).IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+}
+
+// verify learns the server cookie from response.
+// It returns false if the client cookie in response is not ours.
+func (c *dnsCookie) verify(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return true
+	}
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		if len(cookie.Cookie) < 16 || !strings.EqualFold(cookie.Cookie[:16], c.client) {
+			return false
+		}
+		c.Lock()
+		c.server = cookie.Cookie[16:]
+		c.Unlock()
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testServerCookie = "0123456789abcdef"
+
+// cookieServer answers A queries with the client cookie of query and a server cookie, recording the query cookies.
+// With badCookie, a query without the server cookie is answered BADCOOKIE.
+type cookieServer struct {
+	sync.Mutex
+	cookies []string
+	// the client cookie is replaced in response
+	mismatch  bool
+	badCookie bool
+	// ignores the cookie option
+	unsupported bool
+}
+
+func (s *cookieServer) handle(w dns.ResponseWriter, r *dns.Msg) {
+	cookie := ""
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				cookie = c.Cookie
+			}
+		}
+	}
+	s.Lock()
+	s.cookies = append(s.cookies, cookie)
+	s.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if s.unsupported || len(cookie) < 16 {
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 1.1.1.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+		return
+	}
+	clientCookie := cookie[:16]
+	if s.mismatch {
+		clientCookie = "ffffffffffffffff"
+	}
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: clientCookie + testServerCookie})
+	if s.badCookie && cookie[16:] != testServerCookie {
+		m.Rcode = dns.RcodeBadCookie
+	} else {
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 1.1.1.1")
+		m.Answer = append(m.Answer, rr)
+	}
+	w.WriteMsg(m)
+}
+
+func TestUDPCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *cookieServer
+		failed bool
+		// the server cookie sent in each query, of two queries
+		sent []bool
+	}{
+		{name: "learned", server: new(cookieServer), sent: []bool{false, true}},
+		{name: "bad cookie retried", server: &cookieServer{badCookie: true}, sent: []bool{false, true, true}},
+		{name: "mismatch", server: &cookieServer{mismatch: true}, failed: true, sent: []bool{false, false}},
+		{name: "unsupported", server: &cookieServer{unsupported: true}, sent: []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := GetUDPClient(startServer(t, "udp", tt.server.handle), "", true, defaultQueryTimeout)
+			for i := 0; i < 2; i++ {
+				ans, err := cli(context.Background(), "example.com.", dns.TypeA)
+				if failed := err != nil; failed != tt.failed {
+					t.Fatalf("got %v %v, want failed = %v", ans, err, tt.failed)
+				}
+			}
+
+			tt.server.Lock()
+			defer tt.server.Unlock()
+			if len(tt.server.cookies) != len(tt.sent) {
+				t.Fatalf("got %d queries, want %d", len(tt.server.cookies), len(tt.sent))
+			}
+			clientCookie := tt.server.cookies[0][:16]
+			for idx, cookie := range tt.server.cookies {
+				if cookie[:16] != clientCookie {
+					t.Errorf("query %d: client cookie %s, want %s", idx, cookie[:16], clientCookie)
+				}
+				if sent := cookie[16:] == testServerCookie; sent != tt.sent[idx] {
+					t.Errorf("query %d: server cookie sent = %v, want %v", idx, sent, tt.sent[idx])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+type doKey struct{}
+
+// WithDO returns a context whose queries keep DNSSEC records in answers.
+func WithDO(ctx context.Context, do bool) context.Context {
+	return context.WithValue(ctx, doKey{}, do)
+}
+
+func doFromContext(ctx context.Context) bool {
+	do, _ := ctx.Value(doKey{}).(bool)
+	return do
+}
+
+func isDNSSECType(t uint16) bool {
+	switch t {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	default:
+		return false
+	}
+}
+
+// stripDNSSEC removes DNSSEC records, which upstreams always return, for clients without DO bit.
+func stripDNSSEC(answer []Answer, qtype uint16) []Answer {
+	if isDNSSECType(qtype) {
+		return answer
+	}
+	var stripped []Answer
+	for _, ans := range answer {
+		if !isDNSSECType(ans.Type) {
+			stripped = append(stripped, ans)
+		}
+	}
+	return stripped
+}
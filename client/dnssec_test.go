@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestDOCached(t *testing.T) {
+	a := Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}
+	rrsig := Answer{Name: "example.com.", Type: dns.TypeRRSIG, TTL: 60, Data: "A 13 2 60 20300101000000 20200101000000 12345 example.com. c2ln"}
+
+	tests := []struct {
+		name string
+		// the DO bit of queries in order
+		do []bool
+	}{
+		{name: "DO first", do: []bool{true, false, true}},
+		{name: "non-DO first", do: []bool{false, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{})
+			var calls int32
+			c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+				atomic.AddInt32(&calls, 1)
+				return []Answer{a, rrsig}, nil
+			}})
+
+			for idx, do := range tt.do {
+				ans := c.QueryContext(WithDO(context.Background(), do), "example.com.", dns.TypeA)
+				want := 1
+				if do {
+					want = 2
+				}
+				if len(ans) != want {
+					t.Errorf("query %d with DO %v: got %v", idx, do, ans)
+				}
+			}
+			if got := atomic.LoadInt32(&calls); got != 1 {
+				t.Errorf("sent %d upstream queries, want 1", got)
+			}
+
+			// DNSSEC records are kept for a query of the type
+			if ans := c.Query("example.com.", dns.TypeRRSIG); len(ans) != 2 {
+				t.Errorf("got %v for RRSIG query", ans)
+			}
+		})
+	}
+}
@@ -1,87 +1,301 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
-	"github.com/rs/zerolog/log"
+
+	"github.com/dhcmrlchtdj/dns/logger"
 )
 
 var dohClientCache = new(sync.Map)
 
-func GetDoHClient(dohServer string, proxy string) dnsClient {
-	serverKey := dohServer + "-" + proxy
+const (
+	dohFormatJSON    = "json"    // application/dns-json
+	dohFormatMessage = "message" // application/dns-message, RFC 8484
+)
+
+// dohStatusError is a non-200 response from DoH server.
+type dohStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *dohStatusError) Error() string {
+	return "doh: " + http.StatusText(e.StatusCode) + ": " + e.Body
+}
+
+func GetDoHClient(dohServer string, proxy string, bind string, bootstrap *bootstrapResolver, format string, padding int, retry dohRetry) dnsClient {
+	if len(format) == 0 {
+		format = dohFormatJSON
+	}
+	serverKey := dohServer + "-" + proxy + "-" + bind + "-" + bootstrap.String() + "-" + format + "-" + strconv.Itoa(padding) + "-" + retry.String()
 	c, found := dohClientCache.Load(serverKey)
 	if found {
 		return c.(dnsClient)
 	}
 
+	serverUrl, err := url.Parse(dohServer)
+	if err != nil {
+		panic(err)
+	}
+	pinned := newPinnedHost(serverUrl.Hostname(), bootstrap)
+
 	dohHttpClient := new(http.Client)
-	if len(proxy) > 0 {
-		proxyUrl, err := url.Parse(proxy)
-		if err != nil {
-			panic(err)
+	if len(proxy) > 0 || len(bind) > 0 || pinned != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if len(proxy) > 0 {
+			proxyUrl, err := url.Parse(proxy)
+			if err != nil {
+				panic(err)
+			}
+			transport.Proxy = http.ProxyURL(proxyUrl)
 		}
-		dohHttpClient.Transport = &http.Transport{
-			Proxy: http.ProxyURL(proxyUrl),
+		dialer := new(net.Dialer)
+		if len(bind) > 0 {
+			dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(bind)}
 		}
+		transport.DialContext = dialer.DialContext
+		if pinned != nil {
+			transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(address)
+				if err != nil || host != pinned.host {
+					return dialer.DialContext(ctx, network, address)
+				}
+				var conn net.Conn
+				err = pinned.each(func(ip string) (err error) {
+					conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+					return err
+				})
+				return conn, err
+			}
+		}
+		dohHttpClient.Transport = transport
 	}
 
-	cc := func(name string, qtype uint16) []Answer {
-		sublogger := log.With().
-			Str("module", "client.doh").
+	cc := func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		sublogger := logger.Module("client.doh").With().
 			Str("server", dohServer).
 			Str("proxy", proxy).
+			Str("bind", bind).
 			Str("domain", name).
 			Uint16("type", qtype).
 			Logger()
 
 		sublogger.Debug().Msg("query")
 
-		req, err := http.NewRequest("GET", dohServer, nil)
-		if err != nil {
-			sublogger.Error().Err(err).Send()
-			return nil
-		}
-		req.Header.Set("accept", "application/dns-json")
-		q := req.URL.Query()
-		q.Set("name", name)                     // Query Name
-		q.Set("type", dns.Type(qtype).String()) // Query Type
-		// q.Set("do", "true")                     // DO bit - set if client wants DNSSEC data
-		// q.Set("cd", "true")                     // CD bit - set to disable validation
-		req.URL.RawQuery = q.Encode()
+		newRequest := func() (*http.Request, error) {
+			return newDoHJSONRequest(dohServer, name, qtype, padding)
+		}
+		if format == dohFormatMessage {
+			newRequest = func() (*http.Request, error) {
+				return newDoHMessageRequest(dohServer, name, qtype, padding)
+			}
+		}
 
-		resp, err := dohHttpClient.Do(req)
+		body, err := dohExchange(ctx, dohHttpClient, newRequest, retry)
 		if err != nil {
 			sublogger.Error().Err(err).Send()
-			return nil
+			return nil, err
+		}
+
+		if format == dohFormatMessage {
+			in := new(dns.Msg)
+			if err := in.Unpack(body); err != nil {
+				err = &malformedError{err: err}
+				sublogger.Error().Err(err).Send()
+				return nil, err
+			}
+			var ans []Answer
+			for _, rr := range in.Answer {
+				a, err := rr2ans(rr)
+				if err != nil {
+					sublogger.Error().Err(err).Send()
+					continue
+				}
+				ans = append(ans, a)
+			}
+			if in.Rcode != dns.RcodeSuccess {
+				sublogger.Debug().Int("rcode", in.Rcode).Send()
+				return ans, rcodeError(in.Rcode)
+			}
+			if err := msgReferral(in); err != nil {
+				sublogger.Debug().Msg("referral")
+				return nil, err
+			}
+			return ans, nil
 		}
-		defer resp.Body.Close()
 
 		var r dohResponse
-		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		if err := json.Unmarshal(body, &r); err != nil {
 			sublogger.Error().Err(err).Send()
-			return nil
+			return nil, err
 		}
 
 		if r.Status != 0 {
 			sublogger.Error().Int("status", r.Status).Send()
-			return nil
+			return r.Answer, rcodeError(r.Status)
+		}
+		if len(r.Answer) == 0 {
+			if err := referral(r.Authority); err != nil {
+				sublogger.Debug().Msg("referral")
+				return nil, err
+			}
 		}
 
-		return r.Answer
+		return r.Answer, nil
 	}
 
-	log.Debug().Str("module", "client.doh").Str("server", dohServer).Msg("create DOH server")
-	dohClientCache.Store(serverKey, cc)
+	logger.Module("client.doh").Debug().Str("server", dohServer).Msg("create DOH server")
+	dohClientCache.Store(serverKey, dnsClient(cc))
 	return cc
 }
 
 ///
 
+// newDoHJSONRequest pads the URL to a multiple of padding bytes by the random_padding parameter, which is ignored by server.
+func newDoHJSONRequest(dohServer string, name string, qtype uint16, padding int) (*http.Request, error) {
+	req, err := http.NewRequest("GET", dohServer, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("accept", "application/dns-json")
+	q := req.URL.Query()
+	q.Set("name", name)                     // Query Name
+	q.Set("type", dns.Type(qtype).String()) // Query Type
+	q.Set("do", "true")                     // DO bit - set if client wants DNSSEC data
+	// q.Set("cd", "true")                     // CD bit - set to disable validation
+	if padding > 0 {
+		q.Set("random_padding", "")
+		req.URL.RawQuery = q.Encode()
+		if rem := len(req.URL.String()) % padding; rem != 0 {
+			q.Set("random_padding", strings.Repeat("x", padding-rem))
+		}
+	}
+	req.URL.RawQuery = q.Encode()
+	return req, nil
+}
+
+func newDoHMessageRequest(dohServer string, name string, qtype uint16, padding int) (*http.Request, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.Id = 0 // RFC 8484, for HTTP cache
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+	pad(msg, padding)
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", dohServer, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/dns-message")
+	req.Header.Set("accept", "application/dns-message")
+	return req, nil
+}
+
+// dohRetry is the retry policy of DoH requests failed without response, or with 5xx.
+type dohRetry struct {
+	count   int
+	backoff time.Duration // doubled for each retry
+	jitter  time.Duration // the maximum random delay added to backoff
+	budget  time.Duration // no more retry after, 0 is unlimited, or the deadline of query if earlier
+	retried *uint64       // counts the retries, in the stats of the DNSClient, nil to not count
+}
+
+var defaultDoHRetry = dohRetry{count: 1}
+
+func (r dohRetry) String() string {
+	return strconv.Itoa(r.count) + "/" + r.backoff.String() + "/" + r.jitter.String() + "/" + r.budget.String()
+}
+
+// dohExchange sends the request, and retries by policy on a connection error or 5xx, not 4xx.
+// The budget is the earlier of the ctx deadline and policy.budget, shared by the attempts left,
+// so a hanging attempt doesn't use up the time of its retries.
+func dohExchange(ctx context.Context, cli *http.Client, newRequest func() (*http.Request, error), policy dohRetry) ([]byte, error) {
+	if policy.budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.budget)
+		defer cancel()
+	}
+	for retry := 0; ; retry++ {
+		attemptCtx, cancel := shareDeadline(ctx, policy.count-retry+1)
+		body, retryable, err := dohAttempt(attemptCtx, cli, newRequest)
+		cancel()
+		if err == nil || !retryable || retry >= policy.count || ctx.Err() != nil {
+			return body, err
+		}
+		delay := policy.backoff << retry
+		if policy.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(policy.jitter)))
+		}
+		if deadline, bounded := ctx.Deadline(); bounded && time.Until(deadline) <= delay {
+			return nil, err
+		}
+		if policy.retried != nil {
+			atomic.AddUint64(policy.retried, 1)
+		}
+		logger.Module("client.doh").Debug().Err(err).Dur("delay", delay).Msg("retry")
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// dohAttempt sends the request once. The response should be 200, with the content type accepted.
+func dohAttempt(ctx context.Context, cli *http.Client, newRequest func() (*http.Request, error)) (body []byte, retryable bool, err error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, true, err
+	}
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize+1))
+	resp.Body.Close()
+	if err != nil {
+		return nil, true, err
+	}
+	if len(body) > dns.MaxMsgSize {
+		return nil, false, &malformedError{err: errors.New("larger than " + strconv.Itoa(dns.MaxMsgSize) + " bytes")}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if len(body) > 256 {
+			body = body[:256]
+		}
+		return nil, resp.StatusCode >= 500, &dohStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	accepted := req.Header.Get("accept")
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("content-type"))
+	if contentType != accepted && !(accepted == "application/dns-json" && contentType == "application/json") {
+		return nil, false, errors.New("doh: unexpected content type: " + contentType)
+	}
+	return body, false, nil
+}
+
 type dohResponse struct {
 	Status   int  `json:"Status"` // The Response Code of the DNS Query.
 	TC       bool `json:"TC"`     // If true, it means the truncated bit was set.
@@ -93,5 +307,6 @@ type dohResponse struct {
 		Name string `json:"name"` // The record name requested.
 		Type uint16 `json:"type"` // The type of DNS record requested.
 	} `json:"Question"`
-	Answer []Answer `json:"Answer"`
+	Answer    []Answer `json:"Answer"`
+	Authority []Answer `json:"Authority"`
 }
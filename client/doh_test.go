@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestDoHPadding(t *testing.T) {
+	tests := []struct {
+		name    string
+		padding int
+	}{
+		{name: "default", padding: defaultPaddingBlock},
+		{name: "block", padding: 468},
+		{name: "disabled", padding: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := newDoHMessageRequest("https://dns.example/dns-query", "example.com.", dns.TypeA, tt.padding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := new(dns.Msg)
+			if err := msg.Unpack(body); err != nil {
+				t.Fatal(err)
+			}
+			if padded := HasPadding(msg); padded != (tt.padding > 0) {
+				t.Errorf("message padded = %v", padded)
+			}
+			if tt.padding > 0 && len(body)%tt.padding != 0 {
+				t.Errorf("message length %d, want a multiple of %d", len(body), tt.padding)
+			}
+
+			req, err = newDoHJSONRequest("https://dns.example/resolve", "example.com.", dns.TypeA, tt.padding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := req.URL.String()
+			if padded := req.URL.Query().Get("random_padding") != ""; padded != (tt.padding > 0) {
+				t.Errorf("json padded = %v: %s", padded, url)
+			}
+			if tt.padding > 0 && len(url)%tt.padding != 0 {
+				t.Errorf("url length %d, want a multiple of %d", len(url), tt.padding)
+			}
+		})
+	}
+}
+
+func TestDoHExchangeBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   dohRetry
+		deadline time.Duration
+		// cancels the query after
+		cancel time.Duration
+		// the responses of attempts in order, "hang" until the attempt is canceled
+		responses []string
+		retries   uint64
+		failed    bool
+		// the exchange returns before
+		within time.Duration
+	}{
+		{name: "retried once", policy: dohRetry{count: 1}, responses: []string{"503", "200"}, retries: 1, within: time.Second},
+		{name: "not retried on 4xx", policy: dohRetry{count: 1}, responses: []string{"400", "200"}, failed: true, within: time.Second},
+		{name: "not retried on content type", policy: dohRetry{count: 1}, responses: []string{"html", "200"}, failed: true, within: time.Second},
+		{name: "retried on 5xx until count", policy: dohRetry{count: 2}, responses: []string{"503", "500", "503", "200"}, retries: 2, failed: true, within: time.Second},
+		{name: "cancelled in backoff", policy: dohRetry{count: 1, backoff: time.Second}, cancel: 100 * time.Millisecond, responses: []string{"503", "200"}, retries: 1, failed: true, within: 200 * time.Millisecond},
+		{name: "hang within ctx deadline", policy: dohRetry{count: 1}, deadline: 400 * time.Millisecond, responses: []string{"hang", "200"}, retries: 1, within: 400 * time.Millisecond},
+		{name: "hang within total_timeout", policy: dohRetry{count: 1, budget: 400 * time.Millisecond}, deadline: time.Minute, responses: []string{"hang", "200"}, retries: 1, within: 400 * time.Millisecond},
+		{name: "split across retries", policy: dohRetry{count: 2}, deadline: 600 * time.Millisecond, responses: []string{"hang", "hang", "200"}, retries: 2, within: 600 * time.Millisecond},
+		{name: "no retry after deadline", policy: dohRetry{count: 1, backoff: time.Second}, deadline: 200 * time.Millisecond, responses: []string{"503", "200"}, failed: true, within: 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempt int32
+			done := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch resp := tt.responses[atomic.AddInt32(&attempt, 1)-1]; resp {
+				case "hang":
+					select {
+					case <-r.Context().Done():
+					case <-done:
+					}
+				case "200":
+					w.Header().Set("content-type", "application/dns-message")
+					w.Write([]byte("answer"))
+				case "html":
+					w.Header().Set("content-type", "text/html")
+					w.Write([]byte("<html></html>"))
+				case "400":
+					w.WriteHeader(http.StatusBadRequest)
+				case "500":
+					w.WriteHeader(http.StatusInternalServerError)
+				case "503":
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer srv.Close()
+			defer close(done)
+
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			if tt.cancel > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				defer cancel()
+				time.AfterFunc(tt.cancel, cancel)
+			}
+			newRequest := func() (*http.Request, error) {
+				return newDoHMessageRequest(srv.URL, "example.com.", dns.TypeA, -1)
+			}
+			var retries uint64
+			tt.policy.retried = &retries
+			start := time.Now()
+			body, err := dohExchange(ctx, srv.Client(), newRequest, tt.policy)
+			if elapsed := time.Since(start); elapsed >= tt.within {
+				t.Errorf("returned after %v, want within %v", elapsed, tt.within)
+			}
+			if failed := err != nil; failed != tt.failed {
+				t.Errorf("got %q %v, want failed = %v", body, err, tt.failed)
+			}
+			if got := atomic.LoadUint64(&retries); got != tt.retries {
+				t.Errorf("retried %d times, want %d", got, tt.retries)
+			}
+		})
+	}
+}
+
+func TestDoHRetriesPerClient(t *testing.T) {
+	var attempt int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempt, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("content-type", "application/dns-message")
+		w.Write([]byte("answer"))
+	}))
+	defer srv.Close()
+	newRequest := func() (*http.Request, error) {
+		return newDoHMessageRequest(srv.URL, "example.com.", dns.TypeA, -1)
+	}
+
+	retried, other := new(DNSClient), new(DNSClient)
+	retried.Init(&config.Config{})
+	other.Init(&config.Config{})
+	if _, err := dohExchange(context.Background(), srv.Client(), newRequest, retried.dohRetryPolicy(config.Server{DoHRetry: 1})); err != nil {
+		t.Fatal(err)
+	}
+	if got := retried.Stats().DoHRetries; got != 1 {
+		t.Errorf("retried %d times, want 1", got)
+	}
+	if got := other.Stats().DoHRetries; got != 0 {
+		t.Errorf("retries counted by another client: %d", got)
+	}
+}
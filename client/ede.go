@@ -0,0 +1,45 @@
+package client
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// Extended DNS Error codes, RFC 8914
+const (
+	EDEStaleAnswer          uint16 = 3
+	EDEBlocked              uint16 = 15
+	EDEFiltered             uint16 = 17
+	EDEProhibited           uint16 = 18
+	EDENotAuthoritative     uint16 = 20
+	EDENoReachableAuthority uint16 = 22
+	EDENetworkError         uint16 = 23
+)
+
+// dns.EDNS0EDE is not available in this version of miekg/dns
+const ednsCodeEDE = 15
+
+// ExtendedError tells clients why the response is an error or filtered, as Extended DNS Error.
+type ExtendedError struct {
+	Code uint16
+	Text string
+}
+
+var (
+	edeStale        = &ExtendedError{Code: EDEStaleAnswer, Text: "serve stale"}
+	edeBlocked      = &ExtendedError{Code: EDEBlocked, Text: "answers dropped by rule"}
+	edeRebind       = &ExtendedError{Code: EDEFiltered, Text: "private addresses dropped"}
+	edePrivate      = &ExtendedError{Code: EDEProhibited, Text: "private domain"}
+	edeNoRoute      = &ExtendedError{Code: EDENotAuthoritative, Text: "no forward for domain"}
+	edeNetworkError = &ExtendedError{Code: EDENetworkError, Text: "upstream failed"}
+	edeOffline      = &ExtendedError{Code: EDENoReachableAuthority, Text: "all upstreams are down"}
+)
+
+// Option is the EDNS0 option to add to OPT record of the response.
+func (e *ExtendedError) Option() dns.EDNS0 {
+	data := make([]byte, 2, 2+len(e.Text))
+	binary.BigEndian.PutUint16(data, e.Code)
+	data = append(data, e.Text...)
+	return &dns.EDNS0_LOCAL{Code: ednsCodeEDE, Data: data}
+}
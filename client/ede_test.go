@@ -0,0 +1,98 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestExtendedErrorOption(t *testing.T) {
+	tests := []struct {
+		name string
+		ede  *ExtendedError
+		data []byte
+	}{
+		{name: "with text", ede: edeBlocked, data: append([]byte{0, 15}, "answers dropped by rule"...)},
+		{name: "without text", ede: &ExtendedError{Code: EDENetworkError}, data: []byte{0, 23}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt, ok := tt.ede.Option().(*dns.EDNS0_LOCAL)
+			if !ok || opt.Code != ednsCodeEDE || !bytes.Equal(opt.Data, tt.data) {
+				t.Errorf("got %v, want code %d data %v", tt.ede.Option(), ednsCodeEDE, tt.data)
+			}
+		})
+	}
+}
+
+func TestExtendedError(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		switch r.Question[0].Name {
+		case "rebind.example.com.":
+			answerA("10.0.0.1")(w, r)
+		case "drop.example.com.":
+			answerA("3.3.3.3")(w, r)
+		default:
+			answerA("1.1.1.1")(w, r)
+		}
+	})
+	tests := []struct {
+		name  string
+		query string
+		// queried and expired before
+		stale bool
+		// all upstreams failing before
+		offline bool
+		rcode   int
+		ede     *ExtendedError
+	}{
+		{name: "answered", query: "www.example.com."},
+		{name: "stale", query: "www.example.com.", stale: true, ede: edeStale},
+		{name: "blocked", query: "drop.example.com.", ede: edeBlocked},
+		{name: "filtered", query: "rebind.example.com.", ede: edeRebind},
+		{name: "prohibited", query: "corp.example.net.via.8.8.8.8.", rcode: dns.RcodeRefused, ede: edePrivate},
+		{name: "not authoritative", query: "www.example.edu.", rcode: dns.RcodeRefused, ede: edeNoRoute},
+		{name: "network error", query: "www.example.org.", ede: edeNetworkError},
+		{name: "no reachable authority", query: "www.example.com.", offline: true, rcode: dns.RcodeRefused, ede: edeOffline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{
+				Strict:               true,
+				OfflineAfter:         3,
+				Via:                  "via",
+				Private:              []string{"corp.example.net"},
+				RebindProtection:     true,
+				StaleWhileRevalidate: true,
+				Rewrite:              []config.Rewrite{{Data: "3.3.3.3", Action: "drop"}},
+				Forward: []config.Server{
+					{DNS: "udp://" + addr, Domain: []string{"example.com"}},
+					{DNS: "udp://127.0.0.1:1", Domain: []string{"example.org"}, AttemptTimeout: 100},
+				},
+			})
+			defer c.Close()
+			if tt.stale {
+				c.Query(tt.query, dns.TypeA)
+				expire(c, time.Second)
+			}
+			if tt.offline {
+				c.rtt.Range(func(_, val interface{}) bool {
+					atomic.StoreInt64(&val.(*rttStats).failures, 3)
+					return true
+				})
+			}
+
+			r := c.ResolveWithMeta(context.Background(), tt.query, dns.TypeA)
+			if r.Rcode != tt.rcode || r.ExtendedError != tt.ede {
+				t.Errorf("got %s %v, want %s %v", dns.RcodeToString[r.Rcode], r.ExtendedError, dns.RcodeToString[tt.rcode], tt.ede)
+			}
+		})
+	}
+}
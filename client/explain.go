@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Explanation is how a query would be answered, without querying.
+type Explanation struct {
+	Name string
+	Type uint16
+	View string
+	// The upstream selected by the via suffix, routing is skipped.
+	Via string
+	// The local source answering, e.g. "static", "zone", "privatePTR" or "specialNames", routing is skipped.
+	Local       string
+	LocalAnswer []Answer
+	LocalRcode  int
+	// The answers are cached, stale if expired but kept for serve-stale or extendTTL.
+	Cached bool
+	Stale  bool
+	TTL    int
+	// The routing rule selected, and why it wins over other candidates.
+	Rule       string
+	Reason     string
+	Candidates []string
+	// The upstream of the rule.
+	Upstream string
+	Scheme   string
+	Host     string
+	// Refused for private domain via suffix, or unmatched domain in strict mode.
+	Refused bool
+	// The name is rejected with FORMERR, e.g. *InvalidNameError.
+	Err error
+}
+
+func (c *DNSClient) Explain(name string, qtype uint16) Explanation {
+	return c.ExplainContext(context.Background(), name, qtype)
+}
+
+func (c *DNSClient) ExplainContext(ctx context.Context, name string, qtype uint16) Explanation {
+	e := Explanation{Name: dns.Fqdn(name), Type: qtype}
+	ascii, err := queryName(name)
+	if err != nil {
+		e.Err = err
+		return e
+	}
+	name = dns.Fqdn(ascii)
+	e.Name = name
+
+	if len(c.via) > 0 {
+		target, up, found := c.parseVia(name)
+		if found {
+			e.Name = target
+			e.Refused = c.isPrivate(target)
+			e.Via = up.dns
+			e.setUpstream(up)
+			return e
+		}
+	}
+
+	view := c.selectView(ctx)
+	e.View = view.name
+
+	if r, source, found := c.localAnswer(view, name, qtype, QueryOptions{}); found {
+		e.Local, e.LocalAnswer, e.LocalRcode = source, r.Answer, r.Rcode
+		return e
+	}
+
+	if val, found := c.cache.Load(c.cacheKey(ctx, view, name, qtype)); found {
+		if cached, ok := val.(*dnsCached); ok {
+			// as served by cacheGet
+			e.TTL, e.Stale, e.Cached = c.cacheTTL(cached, time.Now())
+		}
+	}
+
+	c.rules.RLock()
+	defer c.rules.RUnlock()
+
+	parts := []string{}
+	if name != "." {
+		parts = revDomain(name)
+	}
+	up, _, rule := view.router.match(parts, 0)
+	candidates := view.router.candidates(parts, nil)
+	for _, r := range candidates {
+		e.Candidates = append(e.Candidates, joinRevDomain(r))
+	}
+	if up == nil {
+		e.Refused = c.strict
+		e.Reason = "no rule matched"
+		return e
+	}
+	e.Rule = joinRevDomain(rule)
+	e.setUpstream(up)
+
+	switch {
+	case view.router.node(e.Rule).override != nil:
+		e.Reason = "added by AddRule"
+	case len(e.Candidates) == 1:
+		e.Reason = "the only rule matched"
+	default:
+		e.Reason = "the longest rule wins"
+		for _, r := range candidates {
+			if len(r) == len(rule) && joinRevDomain(r) != e.Rule {
+				e.Reason = "a literal label wins over \"*\""
+			}
+		}
+	}
+
+	return e
+}
+
+func (e *Explanation) setUpstream(up *upstream) {
+	e.Upstream = up.dns
+	if parsed, err := url.Parse(up.dns); err == nil {
+		e.Scheme = parsed.Scheme
+		e.Host = parsed.Host
+	}
+}
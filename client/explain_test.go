@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestExplain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zone := writeZone(t, dir, "example.zone", "2.2.2.2")
+
+	c := new(DNSClient)
+	c.Init(&config.Config{
+		PrivatePTR: privatePTRNXDOMAIN,
+		Forward: []config.Server{
+			{DNS: "ipv4://1.1.1.1", Domain: []string{"static.example.org"}},
+			{DNS: "zone://" + zone, Domain: []string{"example.com"}},
+			{DNS: "udp://127.0.0.1:10053", Domain: []string{"example.net", "café.example.net"}},
+		},
+	})
+
+	tests := []struct {
+		name   string
+		query  string
+		qtype  uint16
+		local  string
+		rcode  int
+		answer int
+		rule   string
+		reason string
+		err    bool
+	}{
+		{name: "static", query: "static.example.org", qtype: dns.TypeA, local: localStatic, answer: 1},
+		{name: "zone", query: "www.example.com.", qtype: dns.TypeA, local: localZone, answer: 1},
+		{name: "zone nxdomain", query: "none.example.com.", qtype: dns.TypeA, local: localZone, rcode: dns.RcodeNameError},
+		{name: "private PTR", query: "1.1.168.192.in-addr.arpa.", qtype: dns.TypePTR, local: localPTR, rcode: dns.RcodeNameError},
+		{name: "special name", query: "localhost.", qtype: dns.TypeA, local: localSpecial, answer: 1},
+		{name: "upstream", query: "www.example.net.", qtype: dns.TypeA, rule: "example.net."},
+		{name: "IDN normalized", query: "www.CAFÉ.example.net", qtype: dns.TypeA, rule: "xn--caf-dma.example.net."},
+		{name: "no route", query: "www.example.edu.", qtype: dns.TypeA, reason: "no rule matched"},
+		{name: "invalid name", query: "bad..example.net.", qtype: dns.TypeA, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := c.Explain(tt.query, tt.qtype)
+			if (e.Err != nil) != tt.err {
+				t.Fatalf("got error %v", e.Err)
+			}
+			if e.Local != tt.local || e.LocalRcode != tt.rcode || len(e.LocalAnswer) != tt.answer {
+				t.Errorf("got local %q rcode %d with %v", e.Local, e.LocalRcode, e.LocalAnswer)
+			}
+			if e.Rule != tt.rule {
+				t.Errorf("got rule %q, want %q", e.Rule, tt.rule)
+			}
+			if len(tt.reason) > 0 && e.Reason != tt.reason {
+				t.Errorf("got reason %q, want %q", e.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestExplainCache(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		miss bool
+		// the entry expired since, negative if not expired
+		expired  time.Duration
+		degraded bool
+		cached   bool
+		stale    bool
+	}{
+		{name: "miss", miss: true},
+		{name: "hit", expired: -time.Minute, cached: true},
+		{name: "expired", expired: time.Second},
+		{name: "serve-stale", cfg: config.Config{StaleIfError: true}, expired: time.Second, cached: true, stale: true},
+		{name: "serveStale domain", cfg: config.Config{ServeStale: []string{"example.net"}}, expired: time.Hour, cached: true, stale: true},
+		{name: "extendTTL degraded", cfg: config.Config{ExtendTTL: 600}, expired: time.Second, degraded: true, cached: true, stale: true},
+		{name: "extendTTL not degraded", cfg: config.Config{ExtendTTL: 600}, expired: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Forward = []config.Server{{DNS: "udp://127.0.0.1:10053", Domain: []string{"example.net"}}}
+			c := new(DNSClient)
+			c.Init(&cfg)
+			defer c.Close()
+			up := c.view.router.route("www.example.net.")
+			if tt.degraded {
+				atomic.StoreInt64(&up.health[0].failures, c.degradedAfter)
+			}
+			if !tt.miss {
+				key := c.cacheKey(context.Background(), &c.view, "www.example.net.", dns.TypeA)
+				c.cacheSet(key, "www.example.net.", up, []Answer{{Name: "www.example.net.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}})
+				expire(c, tt.expired)
+			}
+
+			e := c.Explain("www.example.net.", dns.TypeA)
+			if e.Cached != tt.cached || e.Stale != tt.stale {
+				t.Errorf("got cached %v stale %v, want %v %v", e.Cached, e.Stale, tt.cached, tt.stale)
+			}
+			// the same as served
+			_, _, stale, found := c.cacheGet(c.cacheKey(context.Background(), &c.view, "www.example.net.", dns.TypeA))
+			if found != e.Cached || stale != e.Stale {
+				t.Errorf("served cached %v stale %v, explained %v %v", found, stale, e.Cached, e.Stale)
+			}
+		})
+	}
+}
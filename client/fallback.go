@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const defaultFallbackAfter = 3
+
+// withFallback sends queries to fallback after the primary fails for consecutive times.
+// Meanwhile, the primary is probed in background with the queries, and used again once it answers.
+func (c *DNSClient) withFallback(primaryDNS string, primary dnsClient, fallback *upstream, after int) dnsClient {
+	var failures int64
+	var probing int32
+
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		if n := atomic.LoadInt64(&failures); n < int64(after) {
+			// the fallback is queried at once if it fails again, within the rest of deadline
+			shares := 1
+			if n == int64(after)-1 {
+				shares = 2
+			}
+			primaryCtx, cancel := shareDeadline(ctx, shares)
+			ans, err := primary(primaryCtx, name, qtype)
+			cancel()
+			if !isUpstreamFailure(err) {
+				atomic.StoreInt64(&failures, 0)
+				return ans, err
+			}
+			if atomic.AddInt64(&failures, 1) != int64(after) {
+				return ans, err
+			}
+			logger.Module("client.fallback").Warn().Str("upstream", primaryDNS).Str("fallback", fallback.dns).Int("failures", after).Msg("fallback activated")
+		} else if atomic.CompareAndSwapInt32(&probing, 0, 1) {
+			// bounded, a hanging primary would block all later probes
+			started := c.background(ctx, func(ctx context.Context) {
+				defer atomic.StoreInt32(&probing, 0)
+				if _, err := primary(ctx, name, qtype); !isUpstreamFailure(err) {
+					atomic.StoreInt64(&failures, 0)
+					logger.Module("client.fallback").Warn().Str("upstream", primaryDNS).Msg("fallback deactivated")
+				}
+			})
+			if !started {
+				atomic.StoreInt32(&probing, 0)
+			}
+		}
+
+		logger.Module("client.fallback").Debug().Str("upstream", primaryDNS).Str("fallback", fallback.dns).Str("domain", name).Uint16("type", qtype).Msg("query fallback")
+		atomic.AddUint64(&c.stats.fallback, 1)
+		return fallback.query(ctx, name, qtype)
+	}
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFallbackRecovery(t *testing.T) {
+	const (
+		primaryUp = iota
+		primaryFailing
+		primaryHanging
+	)
+	defer func(timeout time.Duration) { backgroundTimeout = timeout }(backgroundTimeout)
+	backgroundTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// the primary while probed first
+		probed int32
+	}{
+		{name: "recovered"},
+		{name: "probe hung", probed: primaryHanging},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			var state int32 = primaryFailing
+			hung := make(chan struct{}, 1)
+			primary := func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+				switch atomic.LoadInt32(&state) {
+				case primaryFailing:
+					return nil, errors.New("timeout")
+				case primaryHanging:
+					hung <- struct{}{}
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return []Answer{{Name: name, Type: qtype, TTL: 60, Data: "1.1.1.1"}}, nil
+			}
+			fallback := &upstream{dns: "udp://fallback", query: staticClient([]Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "2.2.2.2"}}, nil)}
+			query := c.withFallback("https://primary", primary, fallback, 2)
+			data := func() string {
+				ans, err := query(context.Background(), "example.com.", dns.TypeA)
+				if err != nil || len(ans) != 1 {
+					return ""
+				}
+				return ans[0].Data
+			}
+
+			if got := data(); got != "" {
+				t.Errorf("first failure: got %v, want the primary failure", got)
+			}
+			if got := data(); got != "2.2.2.2" {
+				t.Errorf("activated: got %v, want the fallback", got)
+			}
+			atomic.StoreInt32(&state, tt.probed)
+			if got := data(); got != "2.2.2.2" {
+				t.Errorf("probing: got %v, want the fallback", got)
+			}
+			if tt.probed == primaryHanging {
+				<-hung
+			}
+			atomic.StoreInt32(&state, primaryUp)
+
+			deadline := time.Now().Add(time.Second)
+			for data() != "1.1.1.1" {
+				if time.Now().After(deadline) {
+					t.Fatal("fallback not deactivated after the primary recovered")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if got := atomic.LoadUint64(&c.stats.fallback); got < 2 {
+				t.Errorf("fallback queried %v times", got)
+			}
+		})
+	}
+}
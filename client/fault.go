@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/dhcmrlchtdj/dns/config"
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const faultInjectionEnv = "SHUNT_FAULT_INJECTION"
+
+// faultError is an injected failure, which looks like a timeout.
+type faultError struct{}
+
+func (faultError) Error() string   { return "injected fault" }
+func (faultError) Timeout() bool   { return true }
+func (faultError) Temporary() bool { return true }
+
+// faultInjection returns the config only if enabled by environment, so it never runs by accident.
+func faultInjection(cfg *config.FaultInjection) *config.FaultInjection {
+	if cfg == nil {
+		return nil
+	}
+	if os.Getenv(faultInjectionEnv) != "1" {
+		logger.Module("client").Warn().Msg("faultInjection is ignored without " + faultInjectionEnv + "=1")
+		return nil
+	}
+	if cfg.Failure < 0 || cfg.Failure > 1 || cfg.Delay < 0 {
+		logger.Module("client").Error().Float64("failure", cfg.Failure).Int("delay", cfg.Delay).Msg("invalid config")
+		panic("invalid faultInjection")
+	}
+	logger.Module("client").Warn().Float64("failure", cfg.Failure).Int("delay", cfg.Delay).Msg("fault injection enabled")
+	return cfg
+}
+
+// inject delays queries, and fails a fraction of them.
+func (c *DNSClient) inject(upstream string, cli dnsClient) dnsClient {
+	if c.fault == nil {
+		return cli
+	}
+	delay := time.Duration(c.fault.Delay) * time.Millisecond
+	failure := c.fault.Failure
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		time.Sleep(delay)
+		if rand.Float64() < failure {
+			logger.Module("client.fault").Debug().Str("upstream", upstream).Str("domain", name).Uint16("type", qtype).Msg("inject failure")
+			return nil, faultError{}
+		}
+		return cli(ctx, name, qtype)
+	}
+}
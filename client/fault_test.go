@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestFaultInjectionConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		cfg     *config.FaultInjection
+		enabled bool
+		panics  bool
+	}{
+		{name: "no config", env: "1"},
+		{name: "without environment", cfg: &config.FaultInjection{Failure: 0.5}},
+		{name: "other environment", env: "true", cfg: &config.FaultInjection{Failure: 0.5}},
+		{name: "enabled", env: "1", cfg: &config.FaultInjection{Failure: 0.5, Delay: 10}, enabled: true},
+		{name: "invalid failure", env: "1", cfg: &config.FaultInjection{Failure: 1.5}, panics: true},
+		{name: "invalid delay", env: "1", cfg: &config.FaultInjection{Delay: -1}, panics: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(faultInjectionEnv, tt.env)
+			defer os.Unsetenv(faultInjectionEnv)
+			defer func() {
+				if r := recover(); (r != nil) != tt.panics {
+					t.Errorf("panic = %v, want %v", r, tt.panics)
+				}
+			}()
+			if got := faultInjection(tt.cfg); (got != nil) != tt.enabled {
+				t.Errorf("got %v, want enabled %v", got, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestInject(t *testing.T) {
+	answer := []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}}
+	tests := []struct {
+		name   string
+		fault  *config.FaultInjection
+		failed bool
+		delay  time.Duration
+	}{
+		{name: "disabled"},
+		{name: "no failure", fault: &config.FaultInjection{}},
+		{name: "failure", fault: &config.FaultInjection{Failure: 1}, failed: true},
+		{name: "delay", fault: &config.FaultInjection{Delay: 50}, delay: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &DNSClient{fault: tt.fault}
+			query := c.inject("udp://primary", staticClient(answer, nil))
+
+			start := time.Now()
+			ans, err := query(context.Background(), "example.com.", dns.TypeA)
+			if elapsed := time.Since(start); elapsed < tt.delay {
+				t.Errorf("answered in %v, want delay %v", elapsed, tt.delay)
+			}
+			if !tt.failed {
+				if err != nil || len(ans) != 1 {
+					t.Errorf("got %v %v", ans, err)
+				}
+				return
+			}
+			// looks like a timeout, so it is failed over as a real one
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() || !isUpstreamFailure(err) {
+				t.Errorf("got %v, want a timeout", err)
+			}
+		})
+	}
+}
+
+func TestInjectFailover(t *testing.T) {
+	primary := []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}}
+	secondary := []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "2.2.2.2"}}
+	tests := []struct {
+		name    string
+		failure float64
+		want    string
+	}{
+		{name: "no failure", failure: 0, want: "1.1.1.1"},
+		{name: "failed over", failure: 1, want: "2.2.2.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &DNSClient{fault: &config.FaultInjection{Failure: tt.failure}}
+			members := []*upstream{
+				{dns: "udp://primary", query: c.inject("udp://primary", staticClient(primary, nil))},
+				{dns: "udp://secondary", query: staticClient(secondary, nil)},
+			}
+			ans, _, err := failover(context.Background(), members, "example.com.", dns.TypeA)
+			if err != nil || len(ans) != 1 || ans[0].Data != tt.want {
+				t.Errorf("got %v %v, want %s", ans, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// splitHosts splits "udp://1.1.1.1,8.8.8.8" into "udp://1.1.1.1" and "udp://8.8.8.8".
+func splitHosts(dnsURL string) []string {
+	idx := strings.Index(dnsURL, "://")
+	if idx < 0 {
+		return []string{dnsURL}
+	}
+	scheme, rest := dnsURL[:idx+3], dnsURL[idx+3:]
+	path := ""
+	if idx := strings.IndexByte(rest, '/'); idx >= 0 {
+		rest, path = rest[:idx], rest[idx:]
+	}
+	var urls []string
+	for _, host := range strings.Split(rest, ",") {
+		urls = append(urls, scheme+host+path)
+	}
+	return urls
+}
+
+// transportURLs expands "doh://dns.example.net" with transports ["doh", "dot", "udp"] into one URL per transport, in order.
+// The path is only for DoH, "/dns-query" by default. A UDP/TCP host without port uses 53.
+func transportURLs(dnsURL string, transports []string) ([]string, error) {
+	parsed, err := url.Parse(dnsURL)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(parsed.Host, ",") {
+		return nil, errors.New("transport with multiple hosts: " + dnsURL)
+	}
+	var urls []string
+	for _, transport := range transports {
+		u := url.URL{Scheme: transport, Host: parsed.Host}
+		switch transport {
+		case "doh":
+			u.Path = parsed.Path
+			if len(u.Path) == 0 || parsed.Scheme != "doh" {
+				u.Path = "/dns-query"
+			}
+		case "dot":
+		case "udp", "tcp":
+			if len(u.Port()) == 0 {
+				u.Host = net.JoinHostPort(u.Hostname(), "53")
+			}
+		default:
+			return nil, errors.New("unsupported transport: " + transport)
+		}
+		urls = append(urls, u.String())
+	}
+	return urls, nil
+}
+
+// newGroup creates an upstream querying the hosts by strategy.
+// "failover" (default) queries them in order until one answers,
+// "round-robin" starts from the next host for each query, or the host of the client within forward.StickyTTL,
+// "race" queries them concurrently, at most forward.RaceFanout at once, and merges the answers by forward.Merge.
+func (c *DNSClient) newGroup(forward config.Server, hosts []string) (*upstream, error) {
+	group := &upstream{dns: forward.DNS, encrypted: true}
+	var members []*upstream
+	for _, host := range hosts {
+		if len(host) == 0 || strings.HasSuffix(host, "://") {
+			return nil, errors.New("empty host: " + forward.DNS)
+		}
+		member := forward
+		member.DNS = host
+		up, err := c.newTransport(member)
+		if err != nil {
+			return nil, err
+		}
+		if up.alias {
+			return nil, errors.New("alias can't have multiple hosts: " + forward.DNS)
+		}
+		group.encrypted = group.encrypted && up.encrypted
+		group.local = group.local || up.local
+		group.health = append(group.health, up.health...)
+		members = append(members, up)
+	}
+
+	switch forward.Strategy {
+	case "race":
+		group.query = race(members, forward.Merge == mergeUnion, forward.RaceFanout)
+	case "round-robin":
+		group.query = roundRobin(members, time.Duration(forward.StickyTTL)*time.Second)
+	default:
+		group.query = func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+			ans, _, err := failover(ctx, members, name, qtype)
+			return ans, err
+		}
+	}
+	return group, nil
+}
+
+// failover queries the members in order until one answers, and returns the member answered.
+// Each member has its share of the time left before the ctx deadline.
+func failover(ctx context.Context, members []*upstream, name string, qtype uint16) ([]Answer, *upstream, error) {
+	var ans []Answer
+	var err error
+	for idx, up := range members {
+		memberCtx, cancel := shareDeadline(ctx, len(members)-idx)
+		ans, err = up.query(memberCtx, name, qtype)
+		cancel()
+		if !isUpstreamFailure(err) {
+			return ans, up, err
+		}
+		logger.Module("client.group").Debug().Str("upstream", up.dns).Str("domain", name).Uint16("type", qtype).Err(err).Msg("failover")
+	}
+	return ans, nil, err
+}
+
+///
+
+const (
+	// A member slower than this times the fastest is skipped by round-robin, unless the faster ones fail.
+	roundRobinRTTRatio = 2
+	roundRobinProbe    = 16
+)
+
+// rankByRTT sorts the members by the RTT EWMA of their transports, with the failing ones last.
+// The members not measured yet come first, so they are explored.
+func rankByRTT(members []*upstream) []*upstream {
+	type rank struct {
+		up      *upstream
+		failing bool
+		rtt     time.Duration
+	}
+	ranks := make([]rank, len(members))
+	for idx, up := range members {
+		ranks[idx] = rank{up: up, failing: up.degraded(1), rtt: up.latency()}
+	}
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if ranks[i].failing != ranks[j].failing {
+			return ranks[j].failing
+		}
+		return ranks[i].rtt < ranks[j].rtt
+	})
+	ranked := make([]*upstream, len(ranks))
+	for idx, r := range ranks {
+		ranked[idx] = r.up
+	}
+	return ranked
+}
+
+// preferred is the number of the leading ranked members rotated by round-robin,
+// i.e. not failing and not much slower than the fastest.
+func preferred(ranked []*upstream) int {
+	var fastest time.Duration
+	for idx, up := range ranked {
+		if up.degraded(1) {
+			if idx == 0 {
+				return len(ranked)
+			}
+			return idx
+		}
+		rtt := up.latency()
+		if fastest == 0 {
+			fastest = rtt
+		} else if rtt > fastest*roundRobinRTTRatio {
+			return idx
+		}
+	}
+	return len(ranked)
+}
+
+// roundRobin starts each query from the next preferred member, then fails over to the others from the lowest RTT.
+// A member not measured yet is queried first, and the others are probed once in roundRobinProbe queries.
+// With sticky, a client starts from the member answered its last query within sticky, unless the member is failing.
+func roundRobin(members []*upstream, sticky time.Duration) dnsClient {
+	var next uint32
+	clients := newStickyClients(sticky)
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		ranked := rankByRTT(members)
+		n := preferred(ranked)
+		seq := atomic.AddUint32(&next, 1) - 1
+		start := 0
+		switch {
+		case ranked[0].latency() == 0:
+		case n < len(ranked) && seq%roundRobinProbe == roundRobinProbe-1:
+			// they may have recovered
+			start, n = n, len(ranked)
+		default:
+			start = int(seq) % n
+		}
+		order := make([]*upstream, 0, len(ranked))
+		order = append(order, ranked[start:n]...)
+		order = append(order, ranked[:start]...)
+		order = append(order, ranked[n:]...)
+
+		ip := clientIPFromContext(ctx)
+		if sticky <= 0 || ip == nil {
+			ans, _, err := failover(ctx, order, name, qtype)
+			return ans, err
+		}
+		key := ip.String()
+		if up := clients.get(key); up != nil && !up.degraded(1) {
+			for idx := range order {
+				if order[idx] == up {
+					copy(order[1:idx+1], order[:idx])
+					order[0] = up
+					break
+				}
+			}
+		}
+		ans, answered, err := failover(ctx, order, name, qtype)
+		if answered != nil {
+			clients.set(key, answered)
+		}
+		return ans, err
+	}
+}
+
+// stickyClients maps the client IPs to the member answered their last query.
+type stickyClients struct {
+	sync.Mutex
+	ttl     time.Duration
+	clients map[string]stickyClient
+	// the expired clients are removed once in ttl
+	swept time.Time
+}
+
+type stickyClient struct {
+	up      *upstream
+	expires time.Time
+}
+
+func newStickyClients(ttl time.Duration) *stickyClients {
+	return &stickyClients{ttl: ttl, clients: make(map[string]stickyClient), swept: time.Now()}
+}
+
+func (s *stickyClients) get(ip string) *upstream {
+	s.Lock()
+	defer s.Unlock()
+	client, found := s.clients[ip]
+	if !found || time.Now().After(client.expires) {
+		return nil
+	}
+	return client.up
+}
+
+func (s *stickyClients) set(ip string, up *upstream) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.clients[ip] = stickyClient{up: up, expires: now.Add(s.ttl)}
+	if now.Sub(s.swept) < s.ttl {
+		return
+	}
+	for key, client := range s.clients {
+		if now.After(client.expires) {
+			delete(s.clients, key)
+		}
+	}
+	s.swept = now
+}
+
+const (
+	// the first non-empty answers win, or the first response if all are empty
+	mergeFirst = "first"
+	// the union of the answers of all NOERROR responses
+	mergeUnion = "union"
+)
+
+type raceResult struct {
+	upstream string
+	answer   []Answer
+	err      error
+}
+
+// race queries all members concurrently, from the lowest RTT.
+// A member failing without response is ignored, unless all of them fail.
+// With fanout, only the fanout members of the lowest RTT are queried at once, and the next one for each failed.
+func race(members []*upstream, union bool, fanout int) dnsClient {
+	if fanout <= 0 || fanout > len(members) {
+		fanout = len(members)
+	}
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		results := make(chan raceResult, len(members))
+		ranked := rankByRTT(members)
+		launched := 0
+		launch := func() {
+			up := ranked[launched]
+			launched++
+			go func() {
+				ans, err := up.query(ctx, name, qtype)
+				results <- raceResult{upstream: up.dns, answer: ans, err: err}
+			}()
+		}
+		for launched < fanout {
+			launch()
+		}
+
+		var first *raceResult
+		var merged []Answer
+		var lastErr error
+		responded := false
+		seen := make(map[string]bool)
+		for pending := launched; pending > 0; pending-- {
+			r := <-results
+			if isUpstreamFailure(r.err) {
+				logger.Module("client.group").Debug().Str("upstream", r.upstream).Str("domain", name).Uint16("type", qtype).Err(r.err).Msg("race")
+				lastErr = r.err
+				if launched < len(ranked) {
+					launch()
+					pending++
+				}
+				continue
+			}
+			if first == nil {
+				first = &r
+			}
+			if r.err != nil {
+				continue
+			}
+			responded = true
+			if !union {
+				if len(r.answer) > 0 {
+					return r.answer, nil
+				}
+				continue
+			}
+			for _, ans := range r.answer {
+				key := dns.Fqdn(strings.ToLower(ans.Name)) + "|" + dns.Type(ans.Type).String() + "|" + ans.Data
+				if !seen[key] {
+					seen[key] = true
+					merged = append(merged, ans)
+				}
+			}
+		}
+		if responded && union {
+			return merged, nil
+		}
+		if first != nil {
+			return first.answer, first.err
+		}
+		return nil, lastErr
+	}
+}
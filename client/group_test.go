@@ -0,0 +1,516 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+// fakeMember answers its name after delay, measured as a transport of c.
+func fakeMember(c *DNSClient, name string, delay time.Duration, err error) *upstream {
+	cli := c.measure(name, func(context.Context, string, uint16) ([]Answer, error) {
+		time.Sleep(delay)
+		if err != nil {
+			return nil, err
+		}
+		return []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: name}}, nil
+	})
+	val, _ := c.rtt.Load(name)
+	return &upstream{dns: name, query: cli, health: []*rttStats{val.(*rttStats)}}
+}
+
+func TestRttObserve(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		alpha   float64
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{name: "first sample", alpha: 0.3, samples: []time.Duration{10 * ms}, want: 10 * ms},
+		{name: "half", alpha: 0.5, samples: []time.Duration{10 * ms, 20 * ms, 40 * ms}, want: 27500 * time.Microsecond},
+		{name: "default alpha", alpha: defaultRttAlpha, samples: []time.Duration{100 * ms, 0}, want: 70 * ms},
+		{name: "last only", alpha: 1, samples: []time.Duration{10 * ms, 50 * ms}, want: 50 * ms},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := new(rttStats)
+			for _, rtt := range tt.samples {
+				stats.observe(rtt, tt.alpha)
+			}
+			if got := stats.get(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundRobinRTT(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	tests := []struct {
+		name   string
+		delays map[string]time.Duration
+		failed map[string]bool
+		// the members answering after all are measured
+		want map[string]bool
+	}{
+		{
+			name:   "slow skipped",
+			delays: map[string]time.Duration{"fast1": time.Millisecond, "fast2": time.Millisecond, "slow": 30 * time.Millisecond},
+			want:   map[string]bool{"fast1": true, "fast2": true},
+		},
+		{
+			name:   "similar rotated",
+			delays: map[string]time.Duration{"a": 2 * time.Millisecond, "b": 3 * time.Millisecond, "c": 2 * time.Millisecond},
+			want:   map[string]bool{"a": true, "b": true, "c": true},
+		},
+		{
+			name:   "failing skipped",
+			delays: map[string]time.Duration{"fast": time.Millisecond, "broken": time.Millisecond, "slow": 30 * time.Millisecond},
+			failed: map[string]bool{"broken": true},
+			want:   map[string]bool{"fast": true},
+		},
+		{
+			name:   "slow used if the fast fail",
+			delays: map[string]time.Duration{"broken": time.Millisecond, "slow": 30 * time.Millisecond},
+			failed: map[string]bool{"broken": true},
+			want:   map[string]bool{"slow": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &DNSClient{rttAlpha: defaultRttAlpha}
+			var members []*upstream
+			for name, delay := range tt.delays {
+				var err error
+				if tt.failed[name] {
+					err = errTimeout
+				}
+				members = append(members, fakeMember(c, name, delay, err))
+			}
+			query := roundRobin(members, 0)
+
+			// every member is explored first
+			for range members {
+				query(context.Background(), "example.com.", dns.TypeA)
+			}
+			for _, up := range members {
+				if tt.failed[up.dns] {
+					continue
+				}
+				if got := up.latency(); got < tt.delays[up.dns] || got > tt.delays[up.dns]+10*time.Millisecond {
+					t.Errorf("%s: got RTT %v, want about %v", up.dns, got, tt.delays[up.dns])
+				}
+			}
+
+			answered := make(map[string]bool)
+			for i := 0; i < 3*len(members); i++ {
+				ans, err := query(context.Background(), "example.com.", dns.TypeA)
+				if err != nil || len(ans) != 1 {
+					t.Fatalf("got %v %v", ans, err)
+				}
+				answered[ans[0].Data] = true
+			}
+			if len(answered) != len(tt.want) {
+				t.Errorf("answered by %v, want %v", answered, tt.want)
+			}
+			for name := range answered {
+				if !tt.want[name] {
+					t.Errorf("answered by %v, want %v", answered, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinProbe(t *testing.T) {
+	c := &DNSClient{rttAlpha: defaultRttAlpha}
+	members := []*upstream{
+		fakeMember(c, "fast", time.Millisecond, nil),
+		fakeMember(c, "slow", 30*time.Millisecond, nil),
+	}
+	query := roundRobin(members, 0)
+	for range members {
+		query(context.Background(), "example.com.", dns.TypeA)
+	}
+
+	probed := 0
+	for i := 0; i < 2*roundRobinProbe; i++ {
+		if ans, _ := query(context.Background(), "example.com.", dns.TypeA); len(ans) == 1 && ans[0].Data == "slow" {
+			probed++
+		}
+	}
+	if probed != 2 {
+		t.Errorf("slow probed %d times, want 2", probed)
+	}
+}
+
+func TestRaceFanout(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	tests := []struct {
+		name   string
+		fanout int
+		union  bool
+		// the members failing, by index
+		failed map[int]bool
+		// queried before any answers, and in total
+		initial int
+		total   int
+	}{
+		{name: "all", fanout: 0, initial: 4, total: 4},
+		{name: "capped", fanout: 2, initial: 2, total: 2},
+		{name: "capped union", fanout: 2, union: true, initial: 2, total: 2},
+		{name: "escalated", fanout: 2, union: true, failed: map[int]bool{0: true, 1: true}, initial: 2, total: 4},
+		{name: "escalated once", fanout: 2, union: true, failed: map[int]bool{0: true}, initial: 2, total: 3},
+		{name: "larger than group", fanout: 8, initial: 4, total: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queried int32
+			gate := make(chan struct{})
+			var members []*upstream
+			for i := 0; i < 4; i++ {
+				var err error
+				if tt.failed[i] {
+					err = errTimeout
+				}
+				data := string(rune('a' + i))
+				members = append(members, &upstream{dns: data, query: func(context.Context, string, uint16) ([]Answer, error) {
+					atomic.AddInt32(&queried, 1)
+					<-gate
+					if err != nil {
+						return nil, err
+					}
+					return []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: data}}, nil
+				}})
+			}
+			query := race(members, tt.union, tt.fanout)
+
+			done := make(chan []Answer)
+			go func() {
+				ans, _ := query(context.Background(), "example.com.", dns.TypeA)
+				done <- ans
+			}()
+			time.Sleep(20 * time.Millisecond)
+			if got := atomic.LoadInt32(&queried); int(got) != tt.initial {
+				t.Errorf("queried %d initially, want %d", got, tt.initial)
+			}
+			close(gate)
+			if ans := <-done; len(ans) == 0 {
+				t.Errorf("got no answers")
+			}
+			if got := atomic.LoadInt32(&queried); int(got) != tt.total {
+				t.Errorf("queried %d in total, want %d", got, tt.total)
+			}
+		})
+	}
+}
+
+func TestRoundRobinSticky(t *testing.T) {
+	tests := []struct {
+		name   string
+		sticky time.Duration
+		// the member of the first client fails after its first query
+		failing bool
+		// the first client is always answered by the same member
+		stuck bool
+	}{
+		{name: "sticky", sticky: time.Minute, stuck: true},
+		{name: "not sticky", sticky: 0, stuck: false},
+		{name: "expired", sticky: time.Nanosecond, stuck: false},
+		{name: "failing", sticky: time.Minute, failing: true, stuck: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a fixed RTT, not measured by queries, so both are preferred and ranked in order even on a loaded machine
+			member := func(name string, rtt time.Duration) *upstream {
+				return &upstream{dns: name, health: []*rttStats{{avg: rtt}}, query: func(context.Context, string, uint16) ([]Answer, error) {
+					return []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: name}}, nil
+				}}
+			}
+			members := []*upstream{member("a", 2*time.Millisecond), member("b", 3*time.Millisecond)}
+			query := roundRobin(members, tt.sticky)
+
+			answered := func(ip string) string {
+				ctx := WithClientIP(context.Background(), net.ParseIP(ip))
+				ans, err := query(ctx, "example.com.", dns.TypeA)
+				if err != nil || len(ans) != 1 {
+					t.Fatalf("got %v %v", ans, err)
+				}
+				return ans[0].Data
+			}
+
+			first := answered("192.0.2.1")
+			if tt.failing {
+				for _, up := range members {
+					if up.dns == first {
+						atomic.StoreInt64(&up.health[0].failures, 1)
+					}
+				}
+			}
+			stuck := true
+			others := make(map[string]bool)
+			for i := 0; i < 2*len(members); i++ {
+				if answered("192.0.2.1") != first {
+					stuck = false
+				}
+				others[answered("192.0.2.2")] = true
+			}
+			if stuck != tt.stuck {
+				t.Errorf("stuck = %v, want %v", stuck, tt.stuck)
+			}
+			if tt.stuck && len(others) != 1 {
+				t.Errorf("another client answered by %v, want one member", others)
+			}
+		})
+	}
+}
+
+func TestFailoverDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		hanging int
+		members int
+	}{
+		{name: "first hangs", hanging: 1, members: 2},
+		{name: "two hang", hanging: 2, members: 3},
+		{name: "none hangs", hanging: 0, members: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var members []*upstream
+			for i := 0; i < tt.members; i++ {
+				hang := i < tt.hanging
+				data := string(rune('a' + i))
+				members = append(members, &upstream{dns: data, query: func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+					if hang {
+						<-ctx.Done()
+						return nil, ctx.Err()
+					}
+					return []Answer{{Name: name, Type: qtype, TTL: 60, Data: data}}, nil
+				}})
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			ans, answered, err := failover(ctx, members, "example.com.", dns.TypeA)
+			if err != nil || answered != members[tt.hanging] || len(ans) != 1 {
+				t.Errorf("got %v %v, want answered by member %d", ans, err, tt.hanging)
+			}
+		})
+	}
+}
+
+func TestRaceMerge(t *testing.T) {
+	a := Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}
+	aaaa := Answer{Name: "example.com.", Type: dns.TypeAAAA, TTL: 60, Data: "::1"}
+	txt := Answer{Name: "example.com.", Type: dns.TypeTXT, TTL: 60, Data: `"txt"`}
+	upperA := Answer{Name: "EXAMPLE.com", Type: dns.TypeA, TTL: 30, Data: "1.1.1.1"}
+	nxdomain := rcodeError(dns.RcodeNameError)
+	errTimeout := errors.New("timeout")
+
+	type response struct {
+		answer []Answer
+		err    error
+	}
+	tests := []struct {
+		name  string
+		union bool
+		// the fast member first
+		fast, slow response
+		want       []Answer
+		wantErr    error
+	}{
+		{name: "disjoint first", fast: response{answer: []Answer{a}}, slow: response{answer: []Answer{aaaa, txt}}, want: []Answer{a}},
+		{name: "disjoint union", union: true, fast: response{answer: []Answer{a}}, slow: response{answer: []Answer{aaaa, txt}}, want: []Answer{a, aaaa, txt}},
+		{name: "empty first skipped", fast: response{}, slow: response{answer: []Answer{aaaa}}, want: []Answer{aaaa}},
+		{name: "all empty", fast: response{}, slow: response{}},
+		{name: "union deduplicated", union: true, fast: response{answer: []Answer{a}}, slow: response{answer: []Answer{upperA, aaaa}}, want: []Answer{a, aaaa}},
+		{name: "union without nxdomain", union: true, fast: response{err: nxdomain}, slow: response{answer: []Answer{a}}, want: []Answer{a}},
+		{name: "all nxdomain", union: true, fast: response{err: nxdomain}, slow: response{err: nxdomain}, wantErr: nxdomain},
+		{name: "failure ignored", fast: response{err: errTimeout}, slow: response{answer: []Answer{a}}, want: []Answer{a}},
+		{name: "all failed", union: true, fast: response{err: errTimeout}, slow: response{err: errTimeout}, wantErr: errTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			member := func(name string, delay time.Duration, r response) *upstream {
+				return &upstream{dns: name, query: func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+					time.Sleep(delay)
+					return append([]Answer(nil), r.answer...), r.err
+				}}
+			}
+			members := []*upstream{
+				member("slow", 20*time.Millisecond, tt.slow),
+				member("fast", time.Millisecond, tt.fast),
+			}
+			ans, err := race(members, tt.union, 0)(context.Background(), "example.com.", dns.TypeA)
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(ans) != len(tt.want) {
+				t.Fatalf("got %v, want %v", ans, tt.want)
+			}
+			for idx := range ans {
+				if ans[idx] != tt.want[idx] {
+					t.Errorf("got %v, want %v", ans, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTransportURLs(t *testing.T) {
+	tests := []struct {
+		dns        string
+		transports []string
+		want       []string
+		err        bool
+	}{
+		{dns: "doh://dns.example.com/dns-query", transports: []string{"doh", "dot"}, want: []string{"doh://dns.example.com/dns-query", "dot://dns.example.com"}},
+		{dns: "doh://dns.example.com/resolve", transports: []string{"dot", "doh"}, want: []string{"dot://dns.example.com", "doh://dns.example.com/resolve"}},
+		{dns: "dot://1.1.1.1", transports: []string{"doh", "udp", "tcp"}, want: []string{"doh://1.1.1.1/dns-query", "udp://1.1.1.1:53", "tcp://1.1.1.1:53"}},
+		{dns: "udp://1.1.1.1:5353", transports: []string{"udp", "tcp"}, want: []string{"udp://1.1.1.1:5353", "tcp://1.1.1.1:5353"}},
+		{dns: "udp://1.1.1.1,8.8.8.8", transports: []string{"udp", "tcp"}, err: true},
+		{dns: "udp://1.1.1.1", transports: []string{"mdns"}, err: true},
+	}
+	for _, tt := range tests {
+		got, err := transportURLs(tt.dns, tt.transports)
+		if (err != nil) != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %v: got %v %v, want %v", tt.dns, tt.transports, got, err, tt.want)
+		}
+	}
+}
+
+func TestTransportFailover(t *testing.T) {
+	tests := []struct {
+		name string
+		// the DoH member fails by
+		dohErr  error
+		dohHang bool
+		// answered by DoT, or the DoH error returned
+		dot bool
+	}{
+		{name: "connection refused", dohErr: errors.New("connection refused"), dot: true},
+		{name: "malformed", dohErr: &malformedError{err: errors.New("bad")}, dot: true},
+		{name: "http status", dohErr: &dohStatusError{StatusCode: 502}, dot: true},
+		{name: "timeout", dohHang: true, dot: true},
+		{name: "nxdomain", dohErr: rcodeError(dns.RcodeNameError)},
+		{name: "answered"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &DNSClient{rttAlpha: defaultRttAlpha}
+			urls, _ := transportURLs("doh://dns.example.com/dns-query", []string{"doh", "dot"})
+			transport := func(url string, hang bool, err error) *upstream {
+				cli := c.measure(url, func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+					if hang {
+						<-ctx.Done()
+						return nil, ctx.Err()
+					}
+					if err != nil {
+						return nil, err
+					}
+					return []Answer{{Name: name, Type: qtype, TTL: 60, Data: url}}, nil
+				})
+				val, _ := c.rtt.Load(url)
+				return &upstream{dns: url, query: cli, health: []*rttStats{val.(*rttStats)}}
+			}
+			doh, dot := transport(urls[0], tt.dohHang, tt.dohErr), transport(urls[1], false, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			ans, answered, err := failover(ctx, []*upstream{doh, dot}, "example.com.", dns.TypeA)
+			want := doh
+			if tt.dot {
+				want = dot
+			}
+			if answered != want {
+				t.Fatalf("answered by %v, want %s", answered, want.dns)
+			}
+			if tt.dohErr != nil && !tt.dot {
+				if err != tt.dohErr {
+					t.Errorf("got %v, want %v", err, tt.dohErr)
+				}
+			} else if err != nil || len(ans) != 1 || ans[0].Data != want.dns {
+				t.Errorf("got %v %v", ans, err)
+			}
+			// the failed DoH is measured as failing, the DoT isn't
+			if got := doh.degraded(1); got != tt.dot {
+				t.Errorf("doh degraded = %v, want %v", got, tt.dot)
+			}
+			if dot.degraded(1) {
+				t.Error("dot degraded")
+			}
+		})
+	}
+}
+
+func TestSplitHosts(t *testing.T) {
+	tests := []struct {
+		dns  string
+		want []string
+	}{
+		{dns: "udp://1.1.1.1:53", want: []string{"udp://1.1.1.1:53"}},
+		{dns: "udp://1.1.1.1:53,8.8.8.8:53", want: []string{"udp://1.1.1.1:53", "udp://8.8.8.8:53"}},
+		{dns: "udp://[2606:4700::1111]:53,1.1.1.1", want: []string{"udp://[2606:4700::1111]:53", "udp://1.1.1.1"}},
+		{dns: "doh://a.example.com,b.example.com/dns-query", want: []string{"doh://a.example.com/dns-query", "doh://b.example.com/dns-query"}},
+		{dns: "udp://1.1.1.1,", want: []string{"udp://1.1.1.1", "udp://"}},
+		{dns: "1.1.1.1", want: []string{"1.1.1.1"}},
+	}
+	for _, tt := range tests {
+		if got := splitHosts(tt.dns); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.dns, got, tt.want)
+		}
+	}
+}
+
+func TestMultipleHosts(t *testing.T) {
+	live := func(data string, queried *int32) string {
+		return startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddInt32(queried, 1)
+			answerA(data)(w, r)
+		})
+	}
+	var first, second int32
+	firstAddr, secondAddr := live("1.1.1.1", &first), live("2.2.2.2", &second)
+	// nothing listens on it
+	dead := "127.0.0.1:1"
+	tests := []struct {
+		name  string
+		hosts []string
+		want  string
+		// the queries to the first and second live servers
+		first, second int32
+	}{
+		{name: "first answers", hosts: []string{firstAddr, secondAddr}, want: "1.1.1.1", first: 1},
+		{name: "in order", hosts: []string{secondAddr, firstAddr}, want: "2.2.2.2", second: 1},
+		{name: "first failed", hosts: []string{dead, secondAddr, firstAddr}, want: "2.2.2.2", second: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&first, 0)
+			atomic.StoreInt32(&second, 0)
+			c := new(DNSClient)
+			c.Init(&config.Config{Forward: []config.Server{
+				{DNS: "udp://" + strings.Join(tt.hosts, ","), Domain: []string{"example.com"}, AttemptTimeout: 100},
+			}})
+			defer c.Close()
+
+			ans := c.Query("www.example.com.", dns.TypeA)
+			if len(ans) != 1 || ans[0].Data != tt.want {
+				t.Errorf("got %v, want %s", ans, tt.want)
+			}
+			if got1, got2 := atomic.LoadInt32(&first), atomic.LoadInt32(&second); got1 != tt.first || got2 != tt.second {
+				t.Errorf("queried %d %d, want %d %d", got1, got2, tt.first, tt.second)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// Source is where answers come from.
+type Source string
+
+const (
+	SourceStatic   Source = "static"
+	SourceCache    Source = "cache"
+	SourceUpstream Source = "upstream"
+)
+
+// Event is passed to hooks. The answers are a copy, changing them has no effect.
+type Event struct {
+	Name   string
+	Type   uint16
+	Answer []Answer
+	Rcode  int
+	Source Source
+	// The stale answers from cache, with serve-stale.
+	Stale bool
+	// The upstream as configured, for SourceUpstream.
+	Upstream string
+	// The duration of the upstream query for OnUpstreamResult, or the whole query for OnResponse.
+	Latency time.Duration
+}
+
+type hook func(ctx context.Context, e Event)
+
+type policy func(ctx context.Context, answer *[]Answer) bool
+
+type hooks struct {
+	onQuery          []hook
+	onCacheHit       []hook
+	onUpstreamResult []hook
+	onResponse       []hook
+	policies         []policy
+}
+
+// OnQuery registers a hook called before a query is resolved.
+// Hooks are called synchronously in the order registered, and should be registered before any query.
+func (c *DNSClient) OnQuery(fn func(ctx context.Context, e Event)) {
+	c.hooks.onQuery = append(c.hooks.onQuery, fn)
+}
+
+// OnCacheHit registers a hook called when answers are found in cache, including stale ones.
+func (c *DNSClient) OnCacheHit(fn func(ctx context.Context, e Event)) {
+	c.hooks.onCacheHit = append(c.hooks.onCacheHit, fn)
+}
+
+// OnUpstreamResult registers a hook called after an upstream query, successful or not.
+func (c *DNSClient) OnUpstreamResult(fn func(ctx context.Context, e Event)) {
+	c.hooks.onUpstreamResult = append(c.hooks.onUpstreamResult, fn)
+}
+
+// OnResponse registers a hook called after a query is resolved, with the answers returned.
+func (c *DNSClient) OnResponse(fn func(ctx context.Context, e Event)) {
+	c.hooks.onResponse = append(c.hooks.onResponse, fn)
+}
+
+// OnResponsePolicy registers a hook which can change the upstream answers, before they are cached and returned.
+// Returning false drops all answers, the following policies are skipped.
+func (c *DNSClient) OnResponsePolicy(fn func(ctx context.Context, answer *[]Answer) bool) {
+	c.hooks.policies = append(c.hooks.policies, fn)
+}
+
+func (c *DNSClient) applyPolicy(ctx context.Context, name string, qtype uint16, answer []Answer) []Answer {
+	for _, fn := range c.hooks.policies {
+		if !fn(ctx, &answer) {
+			logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("dropped by policy")
+			return nil
+		}
+	}
+	return answer
+}
+
+// emit calls the hooks, the event is only built if there are hooks.
+func (c *DNSClient) emit(ctx context.Context, hooks []hook, event func() Event) {
+	if len(hooks) == 0 {
+		return
+	}
+	e := event()
+	for _, fn := range hooks {
+		ev := e
+		ev.Answer = append([]Answer(nil), e.Answer...)
+		fn(ctx, ev)
+	}
+}
+
+func (r Result) source() Source {
+	switch {
+	case r.FromStatic:
+		return SourceStatic
+	case r.FromCache:
+		return SourceCache
+	case len(r.Upstream) > 0:
+		return SourceUpstream
+	}
+	return ""
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestHookOrder(t *testing.T) {
+	addr := startServer(t, "udp", answerA("1.1.1.1"))
+	tests := []struct {
+		name  string
+		query string
+		// the hooks called by the first and second query
+		first  []string
+		second []string
+	}{
+		{
+			name:   "upstream",
+			query:  "www.example.com.",
+			first:  []string{"query 1", "query 2", "upstream 1 upstream", "upstream 2 upstream", "response 1 upstream", "response 2 upstream"},
+			second: []string{"query 1", "query 2", "cache 1 cache", "cache 2 cache", "response 1 cache", "response 2 cache"},
+		},
+		{
+			name:   "static",
+			query:  "static.example.com.",
+			first:  []string{"query 1", "query 2", "response 1 static", "response 2 static"},
+			second: []string{"query 1", "query 2", "response 1 static", "response 2 static"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{Forward: []config.Server{
+				{DNS: "ipv4://2.2.2.2", Domain: []string{"static.example.com"}},
+				{DNS: "udp://" + addr, Domain: []string{"example.com"}},
+			}})
+			defer c.Close()
+
+			var called []string
+			record := func(kind string) func(ctx context.Context, e Event) {
+				return func(ctx context.Context, e Event) {
+					s := kind
+					if len(e.Source) > 0 {
+						s += " " + string(e.Source)
+					}
+					called = append(called, s)
+				}
+			}
+			for _, n := range []string{"1", "2"} {
+				c.OnQuery(record("query " + n))
+				c.OnCacheHit(record("cache " + n))
+				c.OnUpstreamResult(record("upstream " + n))
+				c.OnResponse(record("response " + n))
+			}
+
+			c.Query(tt.query, dns.TypeA)
+			if !reflect.DeepEqual(called, tt.first) {
+				t.Errorf("first query: got %v, want %v", called, tt.first)
+			}
+			called = nil
+			c.Query(tt.query, dns.TypeA)
+			if !reflect.DeepEqual(called, tt.second) {
+				t.Errorf("second query: got %v, want %v", called, tt.second)
+			}
+		})
+	}
+}
+
+func TestHookObserveOnly(t *testing.T) {
+	addr := startServer(t, "udp", answerA("1.1.1.1"))
+	c := new(DNSClient)
+	c.Init(&config.Config{Forward: []config.Server{{DNS: "udp://" + addr, Domain: []string{"example.com"}}}})
+	defer c.Close()
+
+	// each hook changes the answers, the following hooks, the cache and the result don't see it
+	var seen []string
+	change := func(ctx context.Context, e Event) {
+		for _, ans := range e.Answer {
+			seen = append(seen, ans.Data)
+		}
+		for idx := range e.Answer {
+			e.Answer[idx].Data = "9.9.9.9"
+		}
+		e.Answer = append(e.Answer, Answer{Name: e.Name, Type: dns.TypeA, TTL: 60, Data: "8.8.8.8"})
+	}
+	c.OnUpstreamResult(change)
+	c.OnUpstreamResult(change)
+	c.OnCacheHit(change)
+	c.OnResponse(change)
+	c.OnResponse(change)
+
+	for _, query := range []struct {
+		name  string
+		hooks int
+	}{{"upstream", 4}, {"cache", 3}} {
+		seen = nil
+		ans := c.Query("www.example.com.", dns.TypeA)
+		if len(ans) != 1 || ans[0].Data != "1.1.1.1" {
+			t.Errorf("%s: got %v", query.name, ans)
+		}
+		if got, want := strings.Join(seen, ","), strings.TrimSuffix(strings.Repeat("1.1.1.1,", query.hooks), ","); got != want {
+			t.Errorf("%s: hooks saw %s, want %s", query.name, got, want)
+		}
+	}
+}
+
+func TestResponsePolicy(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + ip)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	rewrite := func(from, to string) func(ctx context.Context, answer *[]Answer) bool {
+		return func(ctx context.Context, answer *[]Answer) bool {
+			for idx := range *answer {
+				if (*answer)[idx].Data == from {
+					(*answer)[idx].Data = to
+				}
+			}
+			return true
+		}
+	}
+	drop := func(ctx context.Context, answer *[]Answer) bool { return false }
+	filter := func(ctx context.Context, answer *[]Answer) bool {
+		*answer = (*answer)[:1]
+		return true
+	}
+	tests := []struct {
+		name     string
+		policies []func(ctx context.Context, answer *[]Answer) bool
+		want     []string
+		blocked  bool
+	}{
+		{name: "none", want: []string{"1.1.1.1", "2.2.2.2"}},
+		{name: "rewrite", policies: []func(ctx context.Context, answer *[]Answer) bool{rewrite("1.1.1.1", "3.3.3.3")}, want: []string{"3.3.3.3", "2.2.2.2"}},
+		{name: "in order", policies: []func(ctx context.Context, answer *[]Answer) bool{rewrite("1.1.1.1", "3.3.3.3"), rewrite("3.3.3.3", "4.4.4.4")}, want: []string{"4.4.4.4", "2.2.2.2"}},
+		{name: "filter", policies: []func(ctx context.Context, answer *[]Answer) bool{filter}, want: []string{"1.1.1.1"}, blocked: true},
+		{name: "drop", policies: []func(ctx context.Context, answer *[]Answer) bool{drop}, blocked: true},
+		{name: "drop skips the following", policies: []func(ctx context.Context, answer *[]Answer) bool{drop, func(ctx context.Context, answer *[]Answer) bool {
+			t.Error("called after drop")
+			return true
+		}}, blocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{Forward: []config.Server{{DNS: "udp://" + addr, Domain: []string{"example.com"}}}})
+			defer c.Close()
+			for _, fn := range tt.policies {
+				c.OnResponsePolicy(fn)
+			}
+
+			// the upstream answers, then the cached ones, are changed by the policies once.
+			// Dropped answers aren't cached, like any empty answers.
+			for _, second := range []bool{false, true} {
+				cached := second && len(tt.want) > 0
+				r := c.ResolveWithMeta(context.Background(), "www.example.com.", dns.TypeA)
+				var got []string
+				for _, ans := range r.Answer {
+					got = append(got, ans.Data)
+				}
+				if !reflect.DeepEqual(got, tt.want) || r.FromCache != cached {
+					t.Errorf("cached %v: got %v %v, want %v", cached, r.FromCache, got, tt.want)
+				}
+				if blocked := r.ExtendedError == edeBlocked; !cached && blocked != tt.blocked {
+					t.Errorf("blocked = %v, want %v", blocked, tt.blocked)
+				}
+			}
+		})
+	}
+}
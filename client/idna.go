@@ -0,0 +1,53 @@
+package client
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile is idna.Lookup without the STD3 rules, since names like "_dmarc" are valid in DNS.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(true),
+	idna.BidiRule(),
+	idna.StrictDomainName(false),
+)
+
+// ToASCII converts a name with Unicode labels to A-labels, e.g. "café.com" to "xn--caf-dma.com",
+// so all forms of a name match the same rules and cache. ASCII names are unchanged.
+// The name is mapped and normalized to NFC by UTS #46 first, e.g. fullwidth "Ｅxample.com" is "example.com".
+func ToASCII(name string) (string, error) {
+	if isASCII(name) {
+		return name, nil
+	}
+	if !utf8.ValidString(name) {
+		return "", &InvalidNameError{Name: name, Reason: "invalid UTF-8"}
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return "", &InvalidNameError{Name: name, Reason: "invalid IDN"}
+		}
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !isASCII(label) && strings.HasPrefix(strings.ToLower(label), "xn--") {
+			return "", &InvalidNameError{Name: name, Reason: "invalid IDN"}
+		}
+	}
+	ascii, err := idnaProfile.ToASCII(name)
+	if err != nil {
+		return "", &InvalidNameError{Name: name, Reason: err.Error()}
+	}
+	return ascii, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
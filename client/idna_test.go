@@ -0,0 +1,42 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		err   bool
+	}{
+		{name: "ascii unchanged", input: "WWW.Example.com.", want: "WWW.Example.com."},
+		{name: "unicode label", input: "café.com", want: "xn--caf-dma.com"},
+		{name: "lowercased", input: "BÜCHER.example.", want: "xn--bcher-kva.example."},
+		{name: "all labels mapped", input: "www.München.DE", want: "www.xn--mnchen-3ya.de"},
+		{name: "all labels", input: "例え.テスト", want: "xn--r8jz45g.xn--zckzah"},
+		{name: "A-label unchanged", input: "xn--caf-dma.com.", want: "xn--caf-dma.com."},
+		{name: "trailing dot", input: "café.com.", want: "xn--caf-dma.com."},
+		{name: "NFD", input: "cafe\u0301.com", want: "xn--caf-dma.com"},
+		{name: "fullwidth", input: "\uff25xample.com", want: "example.com"},
+		{name: "fullwidth dot", input: "café\uff0ecom", want: "xn--caf-dma.com"},
+		{name: "underscore", input: "_dmarc.café.com", want: "_dmarc.xn--caf-dma.com"},
+		{name: "bidi", input: "\u05d0\u05d1.\u05d2a.com", err: true},
+		{name: "invalid UTF-8", input: "caf\xe9.com", err: true},
+		{name: "unicode with ACE prefix", input: "xn--café.com", err: true},
+		{name: "space", input: "caf é.com", err: true},
+		{name: "control", input: "café\u0007.com", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToASCII(tt.input)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// LookupReport is how a query is answered by the live config, e.g. for a `lookup` command.
+type LookupReport struct {
+	// The view, cache status, rule and upstream.
+	Explanation
+	Source Source
+	Answer []Answer
+	Rcode  int
+	// Answered from a local zone file.
+	Authoritative bool
+	// The latency of the upstream query, or the whole lookup otherwise.
+	Latency time.Duration
+	// Why the upstream failed, or the answers were dropped.
+	Err           error
+	ExtendedError *ExtendedError
+}
+
+// Lookup queries the name as a client would, and reports how it is answered.
+// The answers from upstream are not cached.
+func (c *DNSClient) Lookup(name string, qtype uint16) (*LookupReport, error) {
+	return c.LookupContext(context.Background(), name, qtype, false)
+}
+
+// LookupContext is Lookup with the view and tenant of ctx, and caches the answers from upstream if store is true.
+// An error is returned for an invalid name, or an upstream failed without response, the report is still filled.
+func (c *DNSClient) LookupContext(ctx context.Context, name string, qtype uint16, store bool) (*LookupReport, error) {
+	ascii, err := queryName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	name = dns.Fqdn(ascii)
+	r := &LookupReport{Explanation: c.ExplainContext(ctx, name, qtype)}
+	defer func() {
+		if r.Latency == 0 {
+			r.Latency = time.Since(start)
+		}
+		if !doFromContext(ctx) {
+			r.Answer = stripDNSSEC(r.Answer, qtype)
+		}
+	}()
+
+	if len(r.Via) > 0 {
+		if r.Refused {
+			r.Rcode = dns.RcodeRefused
+			return r, nil
+		}
+		target, up, _ := c.parseVia(name)
+		r.Source = SourceUpstream
+		return r, r.query(ctx, up, target, qtype)
+	}
+
+	view := c.selectView(ctx)
+	if lr, _, found := c.localAnswer(view, name, qtype, QueryOptions{}); found {
+		r.Source = SourceStatic
+		r.Answer, r.Rcode, r.Authoritative = lr.Answer, lr.Rcode, lr.Authoritative
+		return r, nil
+	}
+
+	if r.Cached && !r.Stale {
+		if ans, rcode, _, found := c.cacheGet(c.cacheKey(ctx, view, name, qtype)); found {
+			r.Source = SourceCache
+			r.Answer, r.Rcode = ans, rcode
+			return r, nil
+		}
+		r.Cached = false
+	}
+
+	if len(r.Upstream) == 0 {
+		if r.Refused {
+			r.Rcode = dns.RcodeRefused
+		}
+		return r, nil
+	}
+
+	c.rules.RLock()
+	up := view.router.route(name)
+	c.rules.RUnlock()
+	r.Source = SourceUpstream
+	if store {
+		upstart := time.Now()
+		ans, ede, err := c.fetch(ctx, c.cacheKey(ctx, view, name, qtype), up, name, qtype)
+		r.Latency = time.Since(upstart)
+		r.Answer, r.ExtendedError = ans, ede
+		return r, r.setErr(err)
+	}
+	err = r.query(ctx, up, name, qtype)
+	if err == nil {
+		r.Answer, r.ExtendedError = c.process(ctx, up, name, qtype, r.Answer)
+	}
+	return r, err
+}
+
+// query sends the query to upstream, without cache.
+func (r *LookupReport) query(ctx context.Context, up *upstream, name string, qtype uint16) error {
+	start := time.Now()
+	ans, err := up.query(ctx, name, qtype)
+	r.Latency = time.Since(start)
+	r.Answer = ans
+	return r.setErr(err)
+}
+
+// setErr sets the rcode of upstream, and returns the error of a failed upstream.
+func (r *LookupReport) setErr(err error) error {
+	if isUpstreamFailure(err) {
+		r.Rcode = dns.RcodeServerFailure
+		r.Err = err
+		return err
+	}
+	var rcodeErr rcodeError
+	if errors.As(err, &rcodeErr) {
+		r.Rcode = int(rcodeErr)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestLookup(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "nx.example.com." {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(m)
+			return
+		}
+		answerA("1.1.1.1")(w, r)
+	})
+	tests := []struct {
+		name  string
+		query string
+		// queried by Query before Lookup, so is cached
+		queried bool
+		store   bool
+		// the report
+		source   Source
+		upstream string
+		cached   bool
+		rcode    int
+		data     string
+		err      bool
+		// cached after Lookup
+		stored bool
+	}{
+		{name: "static", query: "static.example.com.", source: SourceStatic, data: "2.2.2.2"},
+		{name: "special", query: "localhost.", source: SourceStatic, data: "127.0.0.1"},
+		{name: "upstream", query: "www.example.com.", source: SourceUpstream, upstream: "udp://" + addr, data: "1.1.1.1"},
+		{name: "upstream stored", query: "www.example.com.", store: true, source: SourceUpstream, upstream: "udp://" + addr, data: "1.1.1.1", stored: true},
+		{name: "cached", query: "www.example.com.", queried: true, source: SourceCache, upstream: "udp://" + addr, cached: true, data: "1.1.1.1", stored: true},
+		{name: "nxdomain", query: "nx.example.com.", source: SourceUpstream, upstream: "udp://" + addr, rcode: dns.RcodeNameError},
+		{name: "upstream failed", query: "www.example.org.", source: SourceUpstream, upstream: "udp://127.0.0.1:1", rcode: dns.RcodeServerFailure, err: true},
+		{name: "no route", query: "www.example.edu."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{Forward: []config.Server{
+				{DNS: "ipv4://2.2.2.2", Domain: []string{"static.example.com"}},
+				{DNS: "udp://" + addr, Domain: []string{"example.com"}},
+				{DNS: "udp://127.0.0.1:1", Domain: []string{"example.org"}, AttemptTimeout: 100},
+			}})
+			defer c.Close()
+			if tt.queried {
+				c.Query(tt.query, dns.TypeA)
+			}
+
+			r, err := c.LookupContext(context.Background(), tt.query, dns.TypeA, tt.store)
+			if (err != nil) != tt.err || (r.Err != nil) != tt.err {
+				t.Fatalf("got %v %v", err, r.Err)
+			}
+			if r.Source != tt.source || r.Upstream != tt.upstream || r.Cached != tt.cached || r.Rcode != tt.rcode {
+				t.Errorf("got %q %q %v %s, want %q %q %v %s", r.Source, r.Upstream, r.Cached, dns.RcodeToString[r.Rcode],
+					tt.source, tt.upstream, tt.cached, dns.RcodeToString[tt.rcode])
+			}
+			if (tt.data == "" && len(r.Answer) != 0) || (tt.data != "" && (len(r.Answer) != 1 || r.Answer[0].Data != tt.data)) {
+				t.Errorf("got %v, want %s", r.Answer, tt.data)
+			}
+			if r.Latency <= 0 {
+				t.Errorf("latency %v", r.Latency)
+			}
+			if stored := c.Explain(tt.query, dns.TypeA).Cached; stored != tt.stored {
+				t.Errorf("stored = %v, want %v", stored, tt.stored)
+			}
+		})
+	}
+
+	t.Run("invalid name", func(t *testing.T) {
+		c := new(DNSClient)
+		c.Init(&config.Config{})
+		if _, err := c.Lookup("www..example.com.", dns.TypeA); err == nil {
+			t.Error("no error")
+		}
+	})
+}
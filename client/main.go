@@ -1,168 +1,540 @@
 package client
 
 import (
-	"math"
-	"net/url"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
-	"github.com/rs/zerolog/log"
 
 	"github.com/dhcmrlchtdj/dns/config"
+	"github.com/dhcmrlchtdj/dns/logger"
 )
 
 ///
 
-type dnsClient func(string, uint16) []Answer
+type dnsClient func(context.Context, string, uint16) ([]Answer, error)
 
 type DNSClient struct {
-	cache      sync.Map // MAP("domain|type") => dnsCached
-	router     dnsRouter
-	staticIpV4 map[string]string
-	staticIpV6 map[string]string
+	stats         dnsStats
+	cache         sync.Map    // MAP("prefix tenant#view@domain|type") => dnsCached
+	rtt           sync.Map    // MAP(upstream) => rttStats
+	routed        []*rttStats // the rttStats of routed upstreams, guarded by rules
+	tcpSessions   sync.Map    // MAP(*tcpSession) => struct{}, used by the TCP/DoT upstreams
+	rttAlpha      float64
+	view          dnsView
+	rules         sync.RWMutex // guards routers against AddRule/RemoveRule
+	views         []*dnsView
+	private       dnsRouter
+	revalidated   dnsRouter // domains always revalidated on cache hit
+	rotated       dnsRouter // domains with cached addresses rotated on cache hit
+	staleAlways   dnsRouter // domains served stale at any age while refreshing
+	bootstrap     *bootstrapResolver
+	via           string
+	strict        bool
+	rewriteRules  []rewriteRule
+	maxServedTTL  int  // cap the TTL served from cache, the stored expiry is unchanged
+	minServedTTL  int  // floor of the TTL served from cache, the stored expiry is unchanged
+	perRecordTTL  bool // serve the remaining TTL of each record, instead of the minimum of all
+	cacheReferral bool // cache the empty answers of referral responses, for the TTL of NS records
+
+	staleIfError         bool
+	staleWhileRevalidate bool
+	staleMaxAge          time.Duration
+	extendTTL            time.Duration // how long expired answers are kept fresh while their upstream is degraded
+	degradedAfter        int64
+	revalidating         sync.Map // MAP("tenant#view@domain|type") => struct{}
+	cacheKeyFunc         func(ctx context.Context, name string, qtype uint16) string
+	maxAnswers           int
+	maxDataLength        int
+	normalizeName        bool
+	typeMismatch         string // how answers without the query type are handled, empty to keep them
+	cachePrefix          string
+	ttlRange             config.TTLRange
+	typeTTL              map[uint16]config.TTLRange
+	ttlMultiplier        map[string]float64 // by FQDN in lowercase, for the domain and subdomains
+	hooks                hooks
+	servfailTTL          time.Duration
+	negativeTTL          time.Duration
+	negativeMaxTTL       time.Duration
+	rebindProtection     bool
+	privatePTRName       string            // "nxdomain", or the PTR of private addresses
+	specialNames         map[string]string // MAP(domain) => "loopback" | "nxdomain"
+	sources              []string          // the order of local sources
+	fault                *config.FaultInjection
+	queryLog             *queryLog
+	warmups              []warmupTarget // DoH/DoT upstreams to connect at Init
+	offlineAfter         int64
+	stop                 chan struct{} // closed by CloseContext, stops the background goroutines
+	probing              int32
+
+	closing  sync.RWMutex // guards closed against inflight.Add
+	closed   bool
+	inflight sync.WaitGroup
 }
 
 ///
 
-func (c *DNSClient) Init(forwards []config.Server) {
-	for _, forward := range forwards {
-		parsed, err := url.Parse(forward.DNS)
-		if err != nil {
-			log.Error().Str("module", "client").Str("dns", forward.DNS).Msg("invalid config")
-			panic(err)
+func (c *DNSClient) Init(cfg *config.Config) {
+	if len(cfg.Via) > 0 {
+		c.via = strings.ToLower(strings.Trim(cfg.Via, "."))
+	}
+	c.strict = cfg.Strict
+	c.maxServedTTL = cfg.MaxServedTTL
+	c.minServedTTL = defaultMinServedTTL
+	if cfg.MinServedTTL > 0 {
+		c.minServedTTL = cfg.MinServedTTL
+	}
+	c.perRecordTTL = cfg.PerRecordTTL
+	c.cacheReferral = cfg.CacheReferral
+	if c.maxServedTTL > 0 && c.minServedTTL > c.maxServedTTL {
+		logger.Module("client").Error().Int("minServedTTL", c.minServedTTL).Int("maxServedTTL", c.maxServedTTL).Msg("invalid config")
+		panic("minServedTTL should not be greater than maxServedTTL")
+	}
+	c.rewriteRules = compileRewrite(cfg.Rewrite)
+	c.maxAnswers = cfg.MaxAnswers
+	c.maxDataLength = cfg.MaxDataLength
+	c.normalizeName = cfg.NormalizeName
+	switch cfg.TypeMismatch {
+	case "", typeMismatchEmpty, typeMismatchReject:
+		c.typeMismatch = cfg.TypeMismatch
+	default:
+		logger.Module("client").Error().Str("typeMismatch", cfg.TypeMismatch).Msg("invalid config")
+		panic("invalid typeMismatch: " + cfg.TypeMismatch)
+	}
+	c.cachePrefix = cfg.CachePrefix
+	c.ttlRange = config.TTLRange{Min: cfg.MinTTL, Max: cfg.MaxTTL}
+	c.typeTTL = make(map[uint16]config.TTLRange)
+	for typ, r := range cfg.TypeTTL {
+		qtype, found := dns.StringToType[strings.ToUpper(typ)]
+		if !found {
+			logger.Module("client").Error().Str("type", typ).Msg("invalid config")
+			panic("invalid typeTTL: " + typ)
 		}
-		var cli dnsClient
-		switch parsed.Scheme {
-		case "ipv4":
-			if c.staticIpV4 == nil {
-				c.staticIpV4 = make(map[string]string)
-			}
-			for _, domain := range forward.Domain {
-				c.staticIpV4[dns.Fqdn(domain)] = parsed.Host
-			}
-			continue
-		case "ipv6":
-			if c.staticIpV6 == nil {
-				c.staticIpV6 = make(map[string]string)
-			}
-			for _, domain := range forward.Domain {
-				c.staticIpV6[dns.Fqdn(domain)] = parsed.Host
-			}
-			continue
-		case "udp":
-			cli = GetUDPClient(parsed.Host)
-		case "doh":
-			parsed.Scheme = "https"
-			cli = GetDoHClient(parsed.String(), forward.HttpsProxy)
-		case "tcp", "dot":
-			log.Error().Str("module", "client").Str("dns", forward.DNS).Msg("WIP")
-			continue
-		default:
-			log.Error().Str("module", "client").Str("dns", forward.DNS).Msg("unsupported scheme")
-			continue
+		c.typeTTL[qtype] = r
+	}
+	c.ttlMultiplier = make(map[string]float64)
+	for domain, m := range cfg.TTLMultiplier {
+		if m <= 0 {
+			logger.Module("client").Error().Str("domain", domain).Float64("multiplier", m).Msg("invalid config")
+			panic("invalid ttlMultiplier: " + domain)
 		}
+		c.ttlMultiplier[dns.Fqdn(strings.ToLower(domain))] = m
+	}
+	c.servfailTTL = time.Duration(cfg.ServfailTTL) * time.Second
+	c.negativeTTL = defaultNegativeTTL
+	if cfg.NegativeTTL != 0 {
+		c.negativeTTL = time.Duration(cfg.NegativeTTL) * time.Second
+	}
+	c.negativeMaxTTL = time.Duration(cfg.NegativeMaxTTL) * time.Second
+	c.rebindProtection = cfg.RebindProtection
+	c.specialNames = compileSpecialNames(cfg.SpecialNames)
+	c.sources = compileSources(cfg.Sources)
+	c.privatePTRName = cfg.PrivatePTR
+	if len(c.privatePTRName) > 0 && c.privatePTRName != privatePTRNXDOMAIN {
+		c.privatePTRName = dns.Fqdn(c.privatePTRName)
+	}
+	c.offlineAfter = int64(cfg.OfflineAfter)
+	c.fault = faultInjection(cfg.FaultInjection)
+	c.queryLog = newQueryLog(cfg.QueryLog)
+	if c.queryLog != nil {
+		c.OnResponse(c.queryLog.record)
+	}
+	c.staleIfError = cfg.StaleIfError
+	c.staleWhileRevalidate = cfg.StaleWhileRevalidate
+	c.staleMaxAge = defaultStaleMaxAge
+	if cfg.StaleMaxAge > 0 {
+		c.staleMaxAge = time.Duration(cfg.StaleMaxAge) * time.Second
+	}
+	c.extendTTL = time.Duration(cfg.ExtendTTL) * time.Second
+	c.degradedAfter = defaultDegradedAfter
+	if cfg.DegradedAfter > 0 {
+		c.degradedAfter = int64(cfg.DegradedAfter)
+	}
+	c.stop = make(chan struct{})
+	if cfg.PruneInterval > 0 {
+		go c.prune(time.Duration(cfg.PruneInterval)*time.Second, c.stop)
+	}
+	c.rttAlpha = defaultRttAlpha
+	if cfg.RttAlpha != 0 {
+		if cfg.RttAlpha < 0 || cfg.RttAlpha > 1 {
+			logger.Module("client").Error().Float64("rttAlpha", cfg.RttAlpha).Msg("invalid config")
+			panic("rttAlpha should be in (0, 1]")
+		}
+		c.rttAlpha = cfg.RttAlpha
+	}
+	c.bootstrap = newBootstrapResolver(cfg.Bootstrap)
+	for _, domain := range cfg.Private {
+		c.private.add(dns.Fqdn(domain), privateDomain)
+	}
+	for _, domain := range cfg.Revalidate {
+		c.revalidated.add(dns.Fqdn(domain), revalidateDomain)
+	}
+	for _, domain := range cfg.Rotate {
+		c.rotated.add(dns.Fqdn(domain), rotateDomain)
+	}
+	for _, domain := range cfg.ServeStale {
+		c.staleAlways.add(dns.Fqdn(domain), serveStaleDomain)
+	}
 
-		for _, domain := range forward.Domain {
-			c.router.add(dns.Fqdn(domain), cli)
+	c.initView(&c.view, cfg.Forward, cfg.Private)
+	for _, v := range cfg.View {
+		view := &dnsView{name: v.Name}
+		for _, cidr := range v.Client {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				logger.Module("client").Error().Str("view", v.Name).Str("client", cidr).Msg("invalid config")
+				panic(err)
+			}
+			view.client = append(view.client, ipNet)
 		}
+		c.initView(view, v.Forward, cfg.Private)
+		c.views = append(c.views, view)
 	}
+	c.rules.Lock()
+	c.updateRouted()
+	c.rules.Unlock()
+	c.warmup()
 }
 
 ///
 
 func (c *DNSClient) Query(name string, qtype uint16) []Answer {
-	log.Info().Str("module", "client").Str("domain", name).Uint16("type", qtype).Msg("query")
+	ans, _ := c.Resolve(name, qtype)
+	return ans
+}
 
-	name = dns.Fqdn(name)
+func (c *DNSClient) QueryContext(ctx context.Context, name string, qtype uint16) []Answer {
+	ans, _ := c.ResolveContext(ctx, name, qtype)
+	return ans
+}
 
-	// from staticIp
-	if qtype == dns.TypeA {
-		staticIp, found := c.staticIpV4[name]
-		if found {
-			log.Debug().Str("module", "client").Str("domain", name).Uint16("type", qtype).Msg("staticIpV4 hit")
-			return []Answer{{Name: name, Type: qtype, TTL: 60, Data: staticIp}}
+// QueryDual resolves A and AAAA concurrently.
+func (c *DNSClient) QueryDual(name string) (a []Answer, aaaa []Answer) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a = c.Query(name, dns.TypeA)
+	}()
+	go func() {
+		defer wg.Done()
+		aaaa = c.Query(name, dns.TypeAAAA)
+	}()
+	wg.Wait()
+	return a, aaaa
+}
+
+// QueryJSON resolves A and AAAA, the TTL is the minimum of both.
+func (c *DNSClient) QueryJSON(name string) ([]byte, error) {
+	a, aaaa := c.QueryDual(name)
+	a, truncatedA := c.truncate(a)
+	aaaa, truncatedAAAA := c.truncate(aaaa)
+	r := dualAnswer{Name: dns.Fqdn(name), TC: truncatedA || truncatedAAAA, A: a, AAAA: aaaa}
+	for idx, ans := range append(append([]Answer{}, a...), aaaa...) {
+		if idx == 0 || ans.TTL < r.TTL {
+			r.TTL = ans.TTL
 		}
-	} else if qtype == dns.TypeAAAA {
-		staticIp, found := c.staticIpV6[name]
+	}
+	return json.Marshal(r)
+}
+
+type dualAnswer struct {
+	Name string   `json:"name"`
+	TTL  int      `json:"TTL"`
+	TC   bool     `json:"TC"` // If true, some answers are dropped by maxAnswers or maxDataLength.
+	A    []Answer `json:"A"`
+	AAAA []Answer `json:"AAAA"`
+}
+
+// Resolve is Query with the response code, RcodeRefused is returned for unmatched domain in strict mode.
+func (c *DNSClient) Resolve(name string, qtype uint16) ([]Answer, int) {
+	return c.ResolveContext(context.Background(), name, qtype)
+}
+
+func (c *DNSClient) ResolveContext(ctx context.Context, name string, qtype uint16) ([]Answer, int) {
+	r := c.query(ctx, name, qtype, QueryOptions{})
+	return r.Answer, r.Rcode
+}
+
+// ResolveWithMeta is ResolveContext with where the answers come from, the answers are not limited.
+func (c *DNSClient) ResolveWithMeta(ctx context.Context, name string, qtype uint16) Result {
+	return c.query(ctx, name, qtype, QueryOptions{})
+}
+
+// QueryWithMeta is Query with where the answers come from.
+// The answers are limited by maxAnswers and maxDataLength.
+func (c *DNSClient) QueryWithMeta(name string, qtype uint16) Result {
+	r := c.query(context.Background(), name, qtype, QueryOptions{})
+	r.Answer, r.Truncated = c.truncate(r.Answer)
+	return r
+}
+
+type Result struct {
+	Answer     []Answer
+	Rcode      int
+	FromCache  bool
+	FromStatic bool
+	// The upstream answered the query, as configured. Empty if not from upstream.
+	Upstream string
+	// Some answers are dropped by maxAnswers or maxDataLength.
+	Truncated bool
+	// Answered from a local zone file.
+	Authoritative bool
+	// Why the response is an error or has answers dropped, nil if none.
+	ExtendedError *ExtendedError
+	// The query is rejected without lookup, e.g. *InvalidNameError with FORMERR.
+	Err error
+}
+
+// QueryWithOptions is Query bypassing static answers or cache.
+func (c *DNSClient) QueryWithOptions(name string, qtype uint16, opts QueryOptions) []Answer {
+	return c.query(context.Background(), name, qtype, opts).Answer
+}
+
+type QueryOptions struct {
+	// Don't answer from cache. The upstream answers are still cached.
+	SkipCache bool
+	// Don't answer from static IP.
+	SkipStatic bool
+}
+
+func (c *DNSClient) query(ctx context.Context, name string, qtype uint16, opts QueryOptions) Result {
+	c.closing.RLock()
+	if c.closed {
+		c.closing.RUnlock()
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("closed")
+		return Result{Rcode: dns.RcodeServerFailure}
+	}
+	c.inflight.Add(1)
+	c.closing.RUnlock()
+	defer c.inflight.Done()
+
+	ascii, err := queryName(name)
+	if err != nil {
+		logger.Module("client").Warn().Str("domain", name).Uint16("type", qtype).Err(err).Msg("invalid name")
+		return Result{Rcode: dns.RcodeFormatError, Err: err}
+	}
+	name = ascii
+
+	start := time.Now()
+	c.emit(ctx, c.hooks.onQuery, func() Event {
+		return Event{Name: dns.Fqdn(name), Type: qtype}
+	})
+
+	r := c.lookup(ctx, name, qtype, opts)
+	if !doFromContext(ctx) {
+		r.Answer = stripDNSSEC(r.Answer, qtype)
+	}
+	c.observeResponse(dns.Fqdn(name), r.Answer)
+
+	c.emit(ctx, c.hooks.onResponse, func() Event {
+		return Event{Name: dns.Fqdn(name), Type: qtype, Answer: r.Answer, Rcode: r.Rcode, Source: r.source(), Upstream: r.Upstream, Latency: time.Since(start)}
+	})
+	return r
+}
+
+func (c *DNSClient) lookup(ctx context.Context, name string, qtype uint16, opts QueryOptions) Result {
+	logger.Module("client").Info().Str("domain", name).Uint16("type", qtype).Msg("query")
+
+	name = dns.Fqdn(name)
+
+	// by magic suffix
+	if len(c.via) > 0 {
+		target, up, found := c.parseVia(name)
 		if found {
-			log.Debug().Str("module", "client").Str("domain", name).Uint16("type", qtype).Msg("staticIpV6 hit")
-			return []Answer{{Name: name, Type: qtype, TTL: 60, Data: staticIp}}
+			if c.isPrivate(target) {
+				logger.Module("client").Warn().Str("domain", name).Str("target", target).Uint16("type", qtype).Msg("via refused for private domain")
+				return Result{Rcode: dns.RcodeRefused, ExtendedError: edePrivate}
+			}
+			logger.Module("client").Debug().Str("domain", name).Str("target", target).Uint16("type", qtype).Msg("via hit")
+			start := time.Now()
+			ans, _ := up.query(ctx, target, qtype)
+			c.emit(ctx, c.hooks.onUpstreamResult, func() Event {
+				return Event{Name: target, Type: qtype, Answer: ans, Source: SourceUpstream, Upstream: up.dns, Latency: time.Since(start)}
+			})
+			return Result{Answer: ans, Upstream: up.dns}
 		}
 	}
 
-	cacheKey := name + "|" + strconv.Itoa(int(qtype))
+	view := c.selectView(ctx)
+
+	// from static IP, zone files, etc.
+	if r, _, found := c.localAnswer(view, name, qtype, opts); found {
+		return r
+	}
+
+	cacheKey := c.cacheKey(ctx, view, name, qtype)
 
 	// from cache
-	cached, found := c.cacheGet(cacheKey)
+	var cached []Answer
+	var rcode int
+	var stale, found bool
+	if !opts.SkipCache {
+		cached, rcode, stale, found = c.cacheGet(cacheKey)
+	}
+	if found && c.rotates(name) {
+		cached = rotateAddresses(cached, c.rotation(cacheKey))
+	}
 	if found {
-		log.Debug().Str("module", "client").Str("domain", name).Uint16("type", qtype).Msg("cache hit")
-		return cached
+		c.emit(ctx, c.hooks.onCacheHit, func() Event {
+			return Event{Name: name, Type: qtype, Answer: cached, Rcode: rcode, Source: SourceCache, Stale: stale}
+		})
+	}
+	if found && !stale && !c.alwaysRevalidate(name) {
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("cache hit")
+		return Result{Answer: cached, Rcode: rcode, FromCache: true}
 	}
 
 	// by config
-	cli := c.router.route(name)
-	if cli == nil {
-		log.Debug().Str("module", "client").Str("domain", name).Uint16("type", qtype).Msg("not found")
-		return nil
+	c.rules.RLock()
+	up := view.router.route(name)
+	c.rules.RUnlock()
+	if found && !stale {
+		// always revalidated, served from cache while refreshing it
+		if up != nil {
+			logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("cache hit, revalidate")
+			c.background(ctx, func(ctx context.Context) { c.revalidate(ctx, cacheKey, up, name, qtype) })
+		}
+		return Result{Answer: cached, Rcode: rcode, FromCache: true}
+	}
+	if up == nil {
+		if c.strict {
+			logger.Module("client").Warn().Str("domain", name).Uint16("type", qtype).Msg("refused")
+			atomic.AddUint64(&c.stats.refused, 1)
+			return Result{Rcode: dns.RcodeRefused, ExtendedError: edeNoRoute}
+		}
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("not found")
+		return Result{}
 	}
-	ans := cli(name, qtype)
-	c.cacheSet(cacheKey, ans)
-	return ans
-}
-
-///
-
-type dnsCached struct {
-	answer  []Answer
-	expired time.Time
-}
 
-func (c *DNSClient) cacheSet(key string, answer []Answer) {
-	if len(answer) == 0 {
-		return
+	if found && stale && c.extendTTL > 0 && up.degraded(c.degradedAfter) {
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("stale hit, upstream degraded")
+		c.probe(ctx, cacheKey, up, name, qtype)
+		return Result{Answer: cached, FromCache: true, ExtendedError: edeStale}
 	}
 
-	minTTL := answer[0].TTL
-	for _, ans := range answer {
-		if ans.TTL < minTTL {
-			minTTL = ans.TTL
+	if c.isOffline() {
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("offline")
+		c.probe(ctx, cacheKey, up, name, qtype)
+		if found {
+			return Result{Answer: cached, Rcode: rcode, FromCache: true, ExtendedError: edeStale}
 		}
+		return Result{Rcode: dns.RcodeRefused, ExtendedError: edeOffline}
 	}
 
-	val := dnsCached{
-		answer:  answer,
-		expired: time.Now().Add(time.Duration(minTTL) * time.Second),
+	if found && (c.staleWhileRevalidate || c.alwaysServeStale(name)) {
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("stale hit, revalidate")
+		c.background(ctx, func(ctx context.Context) { c.revalidate(ctx, cacheKey, up, name, qtype) })
+		return Result{Answer: cached, FromCache: true, ExtendedError: edeStale}
 	}
-	c.cache.Store(key, &val)
-}
 
-func (c *DNSClient) cacheGet(key string) ([]Answer, bool) {
-	val, found := c.cache.Load(key)
-	if !found {
-		return nil, false
+	ans, ede, err := c.fetch(ctx, cacheKey, up, name, qtype)
+	if err != nil && found && c.staleIfError && err != rcodeError(dns.RcodeNameError) {
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Err(err).Msg("stale hit, upstream failed")
+		return Result{Answer: cached, FromCache: true, ExtendedError: edeStale}
 	}
-
-	cached, ok := val.(*dnsCached)
-	if !ok {
-		c.cache.Delete(key)
-		return nil, false
+	if err == rcodeError(dns.RcodeServerFailure) {
+		c.cacheSetServfail(cacheKey)
+		return Result{Rcode: dns.RcodeServerFailure, Upstream: up.dns}
+	}
+	if err == rcodeError(dns.RcodeNameError) {
+		return Result{Answer: ans, Rcode: dns.RcodeNameError, Upstream: up.dns}
 	}
+	if isUpstreamFailure(err) {
+		ede = edeNetworkError
+	}
+	return Result{Answer: ans, Upstream: up.dns, ExtendedError: ede}
+}
 
-	elapsed := cached.expired.Sub(time.Now())
-	ttl := int(math.Ceil(elapsed.Seconds()))
-	if ttl <= 0 {
-		log.Debug().Str("module", "client.cache").Str("key", key).Msg("expired")
-		c.cache.Delete(key)
-		return nil, false
+// cacheKey is "prefix tenant#view@domain|type", prefix, tenant and view are omitted if empty.
+func (c *DNSClient) cacheKey(ctx context.Context, view *dnsView, name string, qtype uint16) string {
+	var key string
+	if c.cacheKeyFunc != nil {
+		key = c.cacheKeyFunc(ctx, name, qtype)
+	} else {
+		key = name + "|" + strconv.Itoa(int(qtype))
+	}
+	if len(view.name) > 0 {
+		key = view.name + "@" + key
 	}
+	if tenant := tenantFromContext(ctx); len(tenant) > 0 {
+		key = tenant + "#" + key
+	}
+	return c.cachePrefix + key
+}
 
-	for idx := range cached.answer {
-		cached.answer[idx].TTL = ttl
+// fetch queries the upstream, and caches the answers.
+func (c *DNSClient) fetch(ctx context.Context, cacheKey string, up *upstream, name string, qtype uint16) ([]Answer, *ExtendedError, error) {
+	start := time.Now()
+	upstreamType := c.mappedType(name, qtype)
+	ans, err := up.query(ctx, name, upstreamType)
+	if upstreamType != qtype {
+		ans = c.mapAddresses(name, qtype, ans)
+	}
+	c.emit(ctx, c.hooks.onUpstreamResult, func() Event {
+		e := Event{Name: name, Type: qtype, Answer: ans, Source: SourceUpstream, Upstream: up.dns, Latency: time.Since(start)}
+		var rcodeErr rcodeError
+		if errors.As(err, &rcodeErr) {
+			e.Rcode = int(rcodeErr)
+		} else if err != nil {
+			e.Rcode = dns.RcodeServerFailure
+		}
+		return e
+	})
+	if err == rcodeError(dns.RcodeNameError) {
+		ans = c.normalize(ans)
+		ans = checkBailiwick(up, name, ans)
+		c.cacheSetNegative(cacheKey, ans)
+		return ans, nil, err
+	}
+	var ref *referralError
+	if errors.As(err, &ref) {
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, err
 	}
+	if len(c.typeMismatch) > 0 && !answersType(qtype, ans) {
+		logger.Module("client").Warn().Str("upstream", up.dns).Str("domain", name).Uint16("type", qtype).Msg("answer type mismatch")
+		if c.typeMismatch == typeMismatchReject {
+			return nil, nil, rcodeError(dns.RcodeServerFailure)
+		}
+		ans = nil
+	}
+	ans, ede := c.process(ctx, up, name, qtype, ans)
+	if ref != nil && len(ans) == 0 {
+		c.cacheSetReferral(cacheKey, ref.ttl)
+	} else {
+		c.cacheSet(cacheKey, name, up, ans)
+	}
+	return ans, ede, nil
+}
 
-	return cached.answer, true
+// process filters and rewrites the upstream answers before being cached.
+// The extended error tells why some answers are dropped.
+func (c *DNSClient) process(ctx context.Context, up *upstream, name string, qtype uint16, ans []Answer) ([]Answer, *ExtendedError) {
+	var ede *ExtendedError
+	ans = c.normalize(ans)
+	ans = checkBailiwick(up, name, ans)
+	n := len(ans)
+	ans = c.filterRebind(up, name, ans)
+	if len(ans) < n {
+		ede = edeRebind
+	}
+	n = len(ans)
+	ans = c.rewrite(ans)
+	ans = c.applyPolicy(ctx, name, qtype, ans)
+	if len(ans) < n {
+		ede = edeBlocked
+	}
+	return ans, ede
 }
 
 ///
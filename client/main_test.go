@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+// fakeExchanger answers every query with a single A record, without network.
+func fakeExchanger(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+	return []Answer{{Name: name, Type: dns.TypeA, TTL: 300, Data: "192.0.2.1"}}, nil
+}
+
+// BenchmarkQuery measures the query paths, compare them across commits with
+// "go test -run '^$' -bench . -benchmem -count 10 ./client" and benchstat.
+func BenchmarkQuery(b *testing.B) {
+	c := new(DNSClient)
+	c.Init(&config.Config{Forward: []config.Server{
+		{DNS: "ipv4://192.0.2.2", Domain: []string{"static.example"}},
+	}})
+	defer c.Close()
+	up := &upstream{dns: "fake://upstream", query: c.measure("fake://upstream", fakeExchanger)}
+	c.view.router.add("upstream.example.com.", up)
+
+	benchmarks := []struct {
+		name  string
+		query string
+		opts  QueryOptions
+	}{
+		{name: "static-hit", query: "static.example."},
+		{name: "cache-hit", query: "upstream.example.com."},
+		{name: "upstream", query: "upstream.example.com.", opts: QueryOptions{SkipCache: true}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			if ans := c.QueryWithOptions(bm.query, dns.TypeA, bm.opts); len(ans) != 1 {
+				b.Fatalf("got %v", ans)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.QueryWithOptions(bm.query, dns.TypeA, bm.opts)
+			}
+		})
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	txt := Answer{Name: "upstream.example.com.", Type: dns.TypeTXT, TTL: 300, Data: "\"v=spf1 -all\""}
+	cname := Answer{Name: "upstream.example.com.", Type: dns.TypeCNAME, TTL: 300, Data: "cdn.example.net."}
+	a := Answer{Name: "cdn.example.net.", Type: dns.TypeA, TTL: 300, Data: "192.0.2.1"}
+
+	tests := []struct {
+		name     string
+		mismatch string
+		answer   []Answer
+		qtype    uint16
+		want     int
+		rcode    int
+	}{
+		{name: "kept", answer: []Answer{txt}, qtype: dns.TypeA, want: 1, rcode: dns.RcodeSuccess},
+		{name: "empty", mismatch: typeMismatchEmpty, answer: []Answer{txt}, qtype: dns.TypeA, want: 0, rcode: dns.RcodeSuccess},
+		{name: "reject", mismatch: typeMismatchReject, answer: []Answer{txt}, qtype: dns.TypeA, want: 0, rcode: dns.RcodeServerFailure},
+		{name: "matched", mismatch: typeMismatchReject, answer: []Answer{a}, qtype: dns.TypeA, want: 1, rcode: dns.RcodeSuccess},
+		{name: "cname chain", mismatch: typeMismatchReject, answer: []Answer{cname}, qtype: dns.TypeA, want: 1, rcode: dns.RcodeSuccess},
+		{name: "cname to type", mismatch: typeMismatchReject, answer: []Answer{cname, a}, qtype: dns.TypeA, want: 2, rcode: dns.RcodeSuccess},
+		{name: "cname to other type", mismatch: typeMismatchReject, answer: []Answer{cname, txt}, qtype: dns.TypeA, want: 0, rcode: dns.RcodeServerFailure},
+		{name: "any", mismatch: typeMismatchReject, answer: []Answer{txt}, qtype: dns.TypeANY, want: 1, rcode: dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{TypeMismatch: tt.mismatch})
+			defer c.Close()
+			up := &upstream{dns: "fake://upstream", query: staticClient(tt.answer, nil)}
+			c.view.router.add("upstream.example.com.", up)
+
+			ans, rcode := c.Resolve("upstream.example.com.", tt.qtype)
+			if len(ans) != tt.want || rcode != tt.rcode {
+				t.Errorf("got %v %v, want %v answers %v", ans, dns.RcodeToString[rcode], tt.want, dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
+
+func TestQueryOptions(t *testing.T) {
+	c := new(DNSClient)
+	c.Init(&config.Config{Forward: []config.Server{{DNS: "ipv4://2.2.2.2", Domain: []string{"static.example.com"}}}})
+	var calls, failing int32
+	c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: countingClient(&calls, &failing)})
+
+	// in order, on the same client
+	tests := []struct {
+		name  string
+		query string
+		opts  QueryOptions
+		want  string
+	}{
+		{name: "upstream", query: "www.example.com.", want: "1.1.1.1"},
+		{name: "cached", query: "www.example.com.", want: "1.1.1.1"},
+		{name: "skip cache", query: "www.example.com.", opts: QueryOptions{SkipCache: true}, want: "1.1.1.2"},
+		{name: "cached by skip cache", query: "www.example.com.", want: "1.1.1.2"},
+		{name: "static", query: "static.example.com.", want: "2.2.2.2"},
+		{name: "skip static", query: "static.example.com.", opts: QueryOptions{SkipStatic: true}, want: "1.1.1.3"},
+		{name: "skip static cached", query: "static.example.com.", opts: QueryOptions{SkipStatic: true}, want: "1.1.1.3"},
+		{name: "static after skipped", query: "static.example.com.", want: "2.2.2.2"},
+		{name: "skip both", query: "static.example.com.", opts: QueryOptions{SkipCache: true, SkipStatic: true}, want: "1.1.1.4"},
+		// only static IP is skipped, not other local sources
+		{name: "skip static special", query: "localhost.", opts: QueryOptions{SkipStatic: true}, want: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		ans := c.QueryWithOptions(tt.query, dns.TypeA, tt.opts)
+		if len(ans) != 1 || ans[0].Data != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.name, ans, tt.want)
+		}
+	}
+}
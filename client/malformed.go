@@ -0,0 +1,30 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// malformedError is a response failed to unpack, or larger than a DNS message can be.
+// miekg/dns bounds the compression pointers while unpacking, so a crafted response fails instead of looping.
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string {
+	return "malformed response: " + e.err.Error()
+}
+
+func (e *malformedError) Unwrap() error {
+	return e.err
+}
+
+// asMalformed wraps the errors of dns.Client/dns.Conn other than network errors, which are from unpacking the response.
+func asMalformed(err error) error {
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return &malformedError{err: err}
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// header is a response header with the counts of question and answer.
+func header(qd uint16, an uint16) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[2:], 0x8180)
+	binary.BigEndian.PutUint16(b[4:], qd)
+	binary.BigEndian.PutUint16(b[6:], an)
+	return b
+}
+
+var (
+	exampleName = []byte("\x07example\x03com\x00")
+	typeAClass  = []byte{0, 1, 0, 1}
+)
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// pointerChain is a question name of n labels "a", each pointing to the previous one, longer than 255 bytes for a large n.
+func pointerChain(n int) []byte {
+	// the question points forward to the last label, after the base name "a."
+	base := 12 + 2 + len(typeAClass)
+	last := base + 3 + 4*(n-1)
+	b := concat(header(1, 0), []byte{0xC0 | byte(last>>8), byte(last)}, typeAClass, []byte("\x01a\x00"))
+	prev := base
+	for i := 0; i < n; i++ {
+		start := len(b)
+		b = append(b, 1, 'a', 0xC0|byte(prev>>8), byte(prev))
+		prev = start
+	}
+	return b
+}
+
+// malformedCorpus is the regression corpus of responses failing to unpack, the ID is set by the server.
+var malformedCorpus = []struct {
+	name     string
+	response []byte
+	valid    bool
+	answers  int
+}{
+	{name: "valid", response: concat(header(1, 1), exampleName, typeAClass, []byte{0xC0, 12}, typeAClass, []byte{0, 0, 0, 60, 0, 4, 1, 1, 1, 1}), valid: true, answers: 1},
+	{name: "self pointer", response: concat(header(1, 0), []byte{0xC0, 12}, typeAClass)},
+	{name: "pointer loop", response: concat(header(1, 0), []byte{0xC0, 14, 0xC0, 12}, typeAClass)},
+	{name: "pointer beyond end", response: concat(header(1, 0), []byte{0xC0, 0xFF}, typeAClass)},
+	{name: "pointer chain", response: pointerChain(10), valid: true},
+	{name: "long pointer chain", response: pointerChain(200)},
+	{name: "invalid label type", response: concat(header(1, 0), []byte{0x40, 'a', 0}, typeAClass)},
+	{name: "truncated question", response: concat(header(1, 0), exampleName[:5])},
+	{name: "rdata beyond end", response: concat(header(1, 1), exampleName, typeAClass, []byte{0xC0, 12}, typeAClass, []byte{0, 0, 0, 60, 0, 16, 1, 1, 1, 1})},
+	{name: "counts beyond end", response: concat(header(0xFFFF, 0xFFFF), exampleName, typeAClass)},
+}
+
+func TestUnpackCorpus(t *testing.T) {
+	for _, tt := range malformedCorpus {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				done <- new(dns.Msg).Unpack(tt.response)
+			}()
+			select {
+			case err := <-done:
+				if valid := err == nil; valid != tt.valid {
+					t.Errorf("got %v, want valid = %v", err, tt.valid)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("unpack hangs")
+			}
+		})
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	for _, tt := range malformedCorpus {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := func(id uint16) []byte {
+				b := append([]byte(nil), tt.response...)
+				binary.BigEndian.PutUint16(b, id)
+				return b
+			}
+			udp := GetUDPClient(startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+				w.Write(reply(r.Id))
+			}), "", false, queryTimeout{attempt: 500 * time.Millisecond, total: 500 * time.Millisecond})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("content-type", "application/dns-message")
+				// the ID of DoH queries is 0
+				w.Write(reply(0))
+			}))
+			defer srv.Close()
+			doh := GetDoHClient(srv.URL, "", "", nil, dohFormatMessage, -1, dohRetry{})
+
+			// the TCP connection is closed, as the stream can't be trusted
+			tcp := GetTCPClient(startServer(t, "tcp", func(w dns.ResponseWriter, r *dns.Msg) {
+				w.Write(reply(r.Id))
+			}), "", false, defaultIdleTimeout, queryTimeout{attempt: 500 * time.Millisecond, total: 500 * time.Millisecond}, nil, -1)
+
+			for transport, cli := range map[string]dnsClient{"udp": udp, "doh": doh, "tcp": tcp} {
+				ans, err := cli(context.Background(), "example.com.", dns.TypeA)
+				if tt.valid {
+					if err != nil || len(ans) != tt.answers {
+						t.Errorf("%s: got %v %v", transport, ans, err)
+					}
+					continue
+				}
+				if transport == "tcp" {
+					if !isUpstreamFailure(err) {
+						t.Errorf("%s: got %v %v, want failed", transport, ans, err)
+					}
+					continue
+				}
+				var malformed *malformedError
+				if !errors.As(err, &malformed) {
+					t.Errorf("%s: got %v %v, want malformedError", transport, ans, err)
+				}
+			}
+		})
+	}
+}
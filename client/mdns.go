@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const (
+	mdnsDefaultServer = "224.0.0.251:5353"
+	// There is no single authoritative responder, collect responses until timeout.
+	mdnsTimeout = 500 * time.Millisecond
+	// Hosts come and go on LAN, only cache them briefly.
+	mdnsMaxTTL = 10
+)
+
+var mdnsClientCache = new(sync.Map)
+
+var errMDNSTimeout = errors.New("mdns: no response")
+
+func GetMDNSClient(mdnsServer string, bind string) dnsClient {
+	serverKey := mdnsServer + "-" + bind
+	c, found := mdnsClientCache.Load(serverKey)
+	if found {
+		return c.(dnsClient)
+	}
+
+	cc := func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		sublogger := logger.Module("client.mdns").With().
+			Str("server", mdnsServer).
+			Str("bind", bind).
+			Str("domain", name).
+			Uint16("type", qtype).
+			Logger()
+
+		sublogger.Debug().Msg("query")
+
+		serverAddr, err := net.ResolveUDPAddr("udp", mdnsServer)
+		if err != nil {
+			sublogger.Error().Err(err).Send()
+			return nil, err
+		}
+		// one-shot query from an ephemeral port, responders reply by unicast. RFC 6762 5.1
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(bind)})
+		if err != nil {
+			sublogger.Error().Err(err).Send()
+			return nil, err
+		}
+		defer conn.Close()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		msg.Id = 0
+		msg.RecursionDesired = false
+		packed, err := msg.Pack()
+		if err != nil {
+			sublogger.Error().Err(err).Send()
+			return nil, err
+		}
+		if _, err := conn.WriteToUDP(packed, serverAddr); err != nil {
+			sublogger.Error().Err(err).Send()
+			return nil, err
+		}
+
+		var ans []Answer
+		responded := false
+		seen := make(map[string]bool)
+		buf := make([]byte, dns.MaxMsgSize)
+		_ = conn.SetReadDeadline(time.Now().Add(mdnsTimeout))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			in := new(dns.Msg)
+			if err := in.Unpack(buf[:n]); err != nil {
+				sublogger.Debug().Err(err).Msg("invalid response")
+				continue
+			}
+			responded = true
+			for _, rr := range in.Answer {
+				hd := rr.Header()
+				if !strings.EqualFold(hd.Name, name) || (hd.Rrtype != qtype && hd.Rrtype != dns.TypeCNAME) {
+					continue
+				}
+				// clear the cache-flush bit. RFC 6762 10.2
+				hd.Class &^= 1 << 15
+				a, err := rr2ans(rr)
+				if err != nil {
+					sublogger.Error().Err(err).Send()
+					continue
+				}
+				if a.TTL > mdnsMaxTTL {
+					a.TTL = mdnsMaxTTL
+				}
+				key := a.Name + "|" + a.Data
+				if !seen[key] {
+					seen[key] = true
+					ans = append(ans, a)
+				}
+			}
+		}
+		if !responded {
+			// not a negative answer, no responder may be reachable
+			sublogger.Debug().Msg("timeout")
+			return nil, errMDNSTimeout
+		}
+		return ans, nil
+	}
+
+	logger.Module("client.mdns").Debug().Str("server", mdnsServer).Msg("create mDNS server")
+	mdnsClientCache.Store(serverKey, dnsClient(cc))
+	return cc
+}
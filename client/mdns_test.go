@@ -0,0 +1,34 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMDNSTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler dns.HandlerFunc
+		answer  int
+		err     error
+	}{
+		{name: "answered", handler: answerA("192.168.1.10"), answer: 1},
+		{name: "no such host", handler: answerA("192.168.1.10"), answer: 0},
+		{name: "no responder", handler: func(w dns.ResponseWriter, r *dns.Msg) {}, err: errMDNSTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qtype := dns.TypeA
+			if tt.answer == 0 {
+				qtype = dns.TypeAAAA
+			}
+			cli := GetMDNSClient(startServer(t, "udp", tt.handler), "")
+			ans, err := cli(context.Background(), "printer.local.", qtype)
+			if err != tt.err || len(ans) != tt.answer {
+				t.Errorf("got %v %v, want %d answers and %v", ans, err, tt.answer, tt.err)
+			}
+		})
+	}
+}
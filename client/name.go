@@ -0,0 +1,50 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// InvalidNameError is returned for a query name that can't be a domain name.
+type InvalidNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidNameError) Error() string {
+	return "invalid name " + e.Name + ": " + e.Reason
+}
+
+// maxNameWireLen is the max length of a name in wire format, RFC 1035 2.3.4.
+const maxNameWireLen = 255
+
+// ValidateName checks the length and labels of a query name, which dns.Fqdn doesn't.
+func ValidateName(name string) error {
+	fqdn := dns.Fqdn(name)
+	if fqdn == "." {
+		return nil
+	}
+	if strings.HasPrefix(fqdn, ".") || strings.Contains(fqdn, "..") {
+		return &InvalidNameError{Name: name, Reason: "empty label"}
+	}
+	if _, ok := dns.IsDomainName(fqdn); !ok {
+		// labels over 63 bytes, or the name over 255 bytes in wire format
+		return &InvalidNameError{Name: name, Reason: "too long"}
+	}
+	// dns.IsDomainName allows 256 bytes, without the root label
+	buf := make([]byte, 2*maxNameWireLen)
+	if n, err := dns.PackDomainName(fqdn, buf, 0, nil, false); err != nil || n > maxNameWireLen {
+		return &InvalidNameError{Name: name, Reason: "too long"}
+	}
+	return nil
+}
+
+// queryName converts the name to A-labels, and validates it.
+func queryName(name string) (string, error) {
+	ascii, err := ToASCII(name)
+	if err != nil {
+		return "", err
+	}
+	return ascii, ValidateName(ascii)
+}
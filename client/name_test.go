@@ -0,0 +1,64 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	tests := []struct {
+		name   string
+		query  string
+		reason string
+	}{
+		{name: "root", query: "."},
+		{name: "not fqdn", query: "www.example.com"},
+		{name: "fqdn", query: "www.example.com."},
+		{name: "label of 63 bytes", query: label63 + ".example.com."},
+		{name: "label over 63 bytes", query: label63 + "a.example.com.", reason: "too long"},
+		// 255 bytes in wire format, with the length bytes and the root label
+		{name: "name of 255 bytes", query: strings.Repeat(label63+".", 3) + strings.Repeat("a", 61) + "."},
+		{name: "name over 255 bytes", query: strings.Repeat(label63+".", 3) + strings.Repeat("a", 62) + ".", reason: "too long"},
+		{name: "escaped name over 255 bytes", query: strings.Repeat(label63+".", 3) + `\097` + strings.Repeat("a", 61) + ".", reason: "too long"},
+		{name: "empty label", query: "www..example.com.", reason: "empty label"},
+		{name: "empty first label", query: ".example.com.", reason: "empty label"},
+		{name: "empty last label", query: "example.com..", reason: "empty label"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateName(tt.query)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("got %v", err)
+				}
+				return
+			}
+			var invalid *InvalidNameError
+			if !errors.As(err, &invalid) || invalid.Reason != tt.reason || invalid.Name != tt.query {
+				t.Fatalf("got %v, want %s", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestQueryName(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		valid bool
+	}{
+		{query: "www.example.com.", want: "www.example.com.", valid: true},
+		{query: "café.com.", want: "xn--caf-dma.com.", valid: true},
+		// valid in Unicode, but the A-label is over 63 bytes
+		{query: strings.Repeat("a", 60) + "é.com."},
+		{query: "café..com."},
+	}
+	for _, tt := range tests {
+		got, err := queryName(tt.query)
+		if (err == nil) != tt.valid || (tt.valid && got != tt.want) {
+			t.Errorf("%s: got %q %v, want %q", tt.query, got, err, tt.want)
+		}
+	}
+}
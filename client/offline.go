@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// isOffline reports whether all routed upstreams failed for offlineAfter consecutive queries.
+// Then queries are answered from cache only, including stale answers, and other names are refused.
+func (c *DNSClient) isOffline() bool {
+	if c.offlineAfter <= 0 {
+		return false
+	}
+	c.rules.RLock()
+	defer c.rules.RUnlock()
+	if len(c.routed) == 0 {
+		return false
+	}
+	for _, stats := range c.routed {
+		if atomic.LoadInt64(&stats.failures) < c.offlineAfter {
+			return false
+		}
+	}
+	return true
+}
+
+// updateRouted collects the transports of the upstreams in routers, the others are not queried by routing,
+// e.g. bootstrap. It should be called with c.rules locked after the routers are changed.
+func (c *DNSClient) updateRouted() {
+	seen := make(map[*rttStats]bool)
+	c.routed = nil
+	add := func(up *upstream) {
+		for _, stats := range up.health {
+			if !seen[stats] {
+				seen[stats] = true
+				c.routed = append(c.routed, stats)
+			}
+		}
+	}
+	for _, view := range append([]*dnsView{&c.view}, c.views...) {
+		view.router.walk(nil, func(_ string, r *dnsRouter) {
+			if r.matched != nil {
+				add(r.matched)
+			}
+			if r.override != nil {
+				add(r.override)
+			}
+		})
+	}
+}
+
+// probe queries the upstream in background while offline, at most one at a time.
+// An answer resets the failures of the upstream, and ends offline mode. The probe isn't cancelled with the query.
+func (c *DNSClient) probe(ctx context.Context, key string, up *upstream, name string, qtype uint16) {
+	if !atomic.CompareAndSwapInt32(&c.probing, 0, 1) {
+		return
+	}
+	started := c.background(ctx, func(ctx context.Context) {
+		defer atomic.StoreInt32(&c.probing, 0)
+		if _, _, err := c.fetch(ctx, key, up, name, qtype); !isUpstreamFailure(err) {
+			logger.Module("client").Warn().Str("upstream", up.dns).Msg("online")
+		}
+	})
+	if !started {
+		atomic.StoreInt32(&c.probing, 0)
+	}
+}
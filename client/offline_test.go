@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestIsOffline(t *testing.T) {
+	const (
+		primary  = "udp://127.0.0.1:10053"
+		fallback = "udp://127.0.0.2:10053"
+		other    = "udp://127.0.0.3:10053"
+	)
+	tests := []struct {
+		name     string
+		fallback bool
+		failing  []string
+		offline  bool
+	}{
+		{name: "never queried"},
+		{name: "unrouted not failing", failing: []string{primary}, offline: true},
+		{name: "unrouted failing", failing: []string{other}},
+		{name: "fallback not failing", fallback: true, failing: []string{primary}},
+		{name: "fallback failing", fallback: true, failing: []string{primary, fallback}, offline: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forward := config.Server{DNS: primary, Domain: []string{"."}}
+			if tt.fallback {
+				forward.Fallback = fallback
+			}
+			c := new(DNSClient)
+			c.Init(&config.Config{OfflineAfter: 3, Forward: []config.Server{forward}})
+			// queried outside routing, e.g. by bootstrap
+			c.measure(other, staticClient(nil, nil))
+
+			for _, dns := range tt.failing {
+				val, _ := c.rtt.Load(dns)
+				atomic.StoreInt64(&val.(*rttStats).failures, 3)
+			}
+			if got := c.isOffline(); got != tt.offline {
+				t.Errorf("got %v, want %v", got, tt.offline)
+			}
+		})
+	}
+}
+
+func TestOfflineProbe(t *testing.T) {
+	tests := []struct {
+		name   string
+		cancel bool
+	}{
+		{name: "query done"},
+		{name: "query cancelled", cancel: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{OfflineAfter: 1})
+			var calls, failing int32
+			query := c.measure("fake://upstream", countingClient(&calls, &failing))
+			val, _ := c.rtt.Load("fake://upstream")
+			stats := val.(*rttStats)
+			c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: query, health: []*rttStats{stats}})
+			c.updateRouted()
+			atomic.StoreInt64(&stats.failures, 1)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			_, rcode := c.ResolveContext(ctx, "example.com.", dns.TypeA)
+			if tt.cancel {
+				cancel()
+			}
+			if rcode != dns.RcodeRefused {
+				t.Errorf("got %v, want REFUSED while offline", dns.RcodeToString[rcode])
+			}
+
+			// waits for the probe
+			c.Close()
+			cancel()
+			if atomic.LoadInt64(&stats.failures) != 0 || c.isOffline() {
+				t.Errorf("still offline after probed")
+			}
+		})
+	}
+}
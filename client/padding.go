@@ -0,0 +1,55 @@
+package client
+
+import (
+	"github.com/miekg/dns"
+)
+
+// The block sizes of queries over encrypted transports, and of responses. RFC 8467
+const (
+	defaultPaddingBlock  = 128
+	responsePaddingBlock = 468
+)
+
+// pad adds EDNS0 padding, the message length becomes a multiple of block. RFC 7830
+// It should be called after all other options are added.
+func pad(msg *dns.Msg, block int) {
+	if block <= 0 {
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		opt = msg.SetEdns0(dns.DefaultMsgSize, false).IsEdns0()
+	}
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	if rem := msg.Len() % block; rem != 0 {
+		padding.Padding = make([]byte, block-rem)
+	}
+}
+
+// HasPadding reports whether the message has EDNS0 padding, e.g. a query asking for padded responses.
+func HasPadding(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
+
+// PadResponse pads the response with EDNS0, unless it has no OPT record or becomes larger than limit (0 is unlimited).
+func PadResponse(msg *dns.Msg, limit int) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	n := len(opt.Option)
+	pad(msg, responsePaddingBlock)
+	if limit > 0 && msg.Len() > limit {
+		opt.Option = opt.Option[:n]
+	}
+}
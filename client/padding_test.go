@@ -0,0 +1,129 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestPad(t *testing.T) {
+	tests := []struct {
+		name  string
+		block int
+		edns  bool
+		// the length of message is a multiple of block, a padding is added
+		padded bool
+	}{
+		{name: "no padding", block: 0},
+		{name: "query block", block: defaultPaddingBlock, padded: true},
+		{name: "response block", block: responsePaddingBlock, padded: true},
+		{name: "with OPT", block: defaultPaddingBlock, edns: true, padded: true},
+		{name: "1-byte block", block: 1, padded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion("www.example.com.", dns.TypeA)
+			if tt.edns {
+				msg.SetEdns0(1232, true)
+			}
+			pad(msg, tt.block)
+
+			if HasPadding(msg) != tt.padded {
+				t.Fatalf("padded = %v, want %v", HasPadding(msg), tt.padded)
+			}
+			if tt.padded && msg.Len()%tt.block != 0 {
+				t.Errorf("length %d is not a multiple of %d", msg.Len(), tt.block)
+			}
+			if tt.edns && (msg.IsEdns0().UDPSize() != 1232 || !msg.IsEdns0().Do()) {
+				t.Errorf("OPT changed, got %v", msg.IsEdns0())
+			}
+			if tt.padded {
+				// the length is counted after packing, with the padding option
+				b, err := msg.Pack()
+				if err != nil || len(b)%tt.block != 0 {
+					t.Errorf("packed %d bytes, %v", len(b), err)
+				}
+			}
+		})
+	}
+}
+
+func TestPadResponse(t *testing.T) {
+	response := func(answers int, edns bool) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		msg.Response = true
+		for i := 0; i < answers; i++ {
+			rr, _ := dns.NewRR("www.example.com. 60 IN A 1.1.1.1")
+			msg.Answer = append(msg.Answer, rr)
+		}
+		if edns {
+			msg.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		return msg
+	}
+	tests := []struct {
+		name   string
+		msg    *dns.Msg
+		limit  int
+		padded bool
+	}{
+		{name: "unlimited", msg: response(1, true), padded: true},
+		{name: "within limit", msg: response(1, true), limit: 1232, padded: true},
+		{name: "over limit", msg: response(1, true), limit: 400},
+		{name: "larger than a block", msg: response(30, true), padded: true},
+		{name: "without OPT", msg: response(1, false)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer := append([]dns.RR(nil), tt.msg.Answer...)
+			PadResponse(tt.msg, tt.limit)
+
+			if HasPadding(tt.msg) != tt.padded {
+				t.Fatalf("padded = %v, want %v", HasPadding(tt.msg), tt.padded)
+			}
+			if tt.padded && tt.msg.Len()%responsePaddingBlock != 0 {
+				t.Errorf("length %d is not a multiple of %d", tt.msg.Len(), responsePaddingBlock)
+			}
+			if tt.limit > 0 && tt.msg.Len() > tt.limit {
+				t.Errorf("length %d is over limit %d", tt.msg.Len(), tt.limit)
+			}
+			if !reflect.DeepEqual(tt.msg.Answer, answer) {
+				t.Errorf("answers changed, got %v", tt.msg.Answer)
+			}
+		})
+	}
+}
+
+// TestPaddedUpstream checks the padding of upstream responses is not cached.
+func TestPaddedUpstream(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 1.1.1.1")
+		m.Answer = append(m.Answer, rr)
+		m.SetEdns0(1232, false)
+		PadResponse(m, 0)
+		w.WriteMsg(m)
+	})
+	c := new(DNSClient)
+	c.Init(&config.Config{Forward: []config.Server{{DNS: "udp://" + addr, Domain: []string{"example.com"}}}})
+	defer c.Close()
+
+	c.Query("www.example.com.", dns.TypeA)
+	var cached []Answer
+	c.cache.Range(func(_, val interface{}) bool {
+		if entry, ok := val.(*dnsCached); ok {
+			cached = entry.answer
+		}
+		return true
+	})
+	want := []Answer{{Name: "www.example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}}
+	if !reflect.DeepEqual(cached, want) {
+		t.Errorf("cached %v, want %v", cached, want)
+	}
+}
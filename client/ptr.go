@@ -0,0 +1,86 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// privatePTRNetworks are the reverse zones answered locally with privatePTR, RFC 6303.
+var privatePTRNetworks = parseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+const privatePTRNXDOMAIN = "nxdomain"
+
+// reverseNetwork parses "168.192.in-addr.arpa." into 192.168.0.0/16, or ip6.arpa by nibbles.
+func reverseNetwork(name string) *net.IPNet {
+	name = strings.ToLower(dns.Fqdn(name))
+	var labels []string
+	var bits, base int
+	var ip net.IP
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		ip, bits, base = make(net.IP, net.IPv4len), 8, 10
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		ip, bits, base = make(net.IP, net.IPv6len), 4, 16
+	default:
+		return nil
+	}
+	if len(labels)*bits > len(ip)*8 {
+		return nil
+	}
+	for idx := range labels {
+		// the labels are reversed
+		n, err := strconv.ParseUint(labels[len(labels)-1-idx], base, bits)
+		if err != nil {
+			return nil
+		}
+		if bits == 8 {
+			ip[idx] = byte(n)
+		} else if idx%2 == 0 {
+			ip[idx/2] = byte(n) << 4
+		} else {
+			ip[idx/2] |= byte(n)
+		}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(labels)*bits, len(ip)*8)}
+}
+
+// privatePTR answers the names under the reverse zones of private networks, instead of leaking them to upstream.
+func (c *DNSClient) privatePTR(name string, qtype uint16) (Result, bool) {
+	if len(c.privatePTRName) == 0 {
+		return Result{}, false
+	}
+	network := reverseNetwork(name)
+	if network == nil {
+		return Result{}, false
+	}
+	ones, _ := network.Mask.Size()
+	for _, private := range privatePTRNetworks {
+		privateOnes, _ := private.Mask.Size()
+		if ones < privateOnes || !private.Contains(network.IP) {
+			continue
+		}
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("private PTR")
+		if c.privatePTRName == privatePTRNXDOMAIN {
+			return Result{Rcode: dns.RcodeNameError, FromStatic: true}, true
+		}
+		if qtype != dns.TypePTR {
+			return Result{FromStatic: true}, true
+		}
+		return Result{Answer: []Answer{{Name: name, Type: dns.TypePTR, TTL: 60, Data: c.privatePTRName}}, FromStatic: true}, true
+	}
+	return Result{}, false
+}
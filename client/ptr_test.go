@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestReverseNetwork(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "10.in-addr.arpa.", want: "10.0.0.0/8"},
+		{name: "16.172.IN-ADDR.ARPA", want: "172.16.0.0/16"},
+		{name: "4.3.2.1.in-addr.arpa.", want: "1.2.3.4/32"},
+		{name: "d.f.ip6.arpa.", want: "fd00::/8"},
+		{name: "example.com."},
+		{name: "256.in-addr.arpa."},
+		{name: "5.4.3.2.1.in-addr.arpa."},
+		{name: "g.f.ip6.arpa."},
+	}
+	for _, tt := range tests {
+		network := reverseNetwork(tt.name)
+		got := ""
+		if network != nil {
+			got = network.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrivatePTR(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN PTR upstream.example.com.")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	reverse := func(ip string) string {
+		name, _ := dns.ReverseAddr(ip)
+		return name
+	}
+	tests := []struct {
+		name       string
+		privatePTR string
+		query      string
+		// answered locally, or forwarded to upstream
+		local bool
+		rcode int
+	}{
+		{name: "10/8", privatePTR: "lan.local", query: reverse("10.1.2.3"), local: true},
+		{name: "172.16/12 first", privatePTR: "lan.local", query: reverse("172.16.0.1"), local: true},
+		{name: "172.16/12 last", privatePTR: "lan.local", query: reverse("172.31.255.255"), local: true},
+		{name: "192.168/16", privatePTR: "lan.local", query: reverse("192.168.1.1"), local: true},
+		{name: "169.254/16", privatePTR: "lan.local", query: reverse("169.254.1.1"), local: true},
+		{name: "fc00::/7 fc", privatePTR: "lan.local", query: reverse("fc00::1"), local: true},
+		{name: "fc00::/7 fd", privatePTR: "lan.local", query: reverse("fd12:3456::1"), local: true},
+		{name: "fe80::/10", privatePTR: "lan.local", query: reverse("fe80::1"), local: true},
+		{name: "zone", privatePTR: "lan.local", query: "10.in-addr.arpa.", local: true},
+		{name: "nxdomain", privatePTR: "nxdomain", query: reverse("10.1.2.3"), local: true, rcode: dns.RcodeNameError},
+		{name: "public", privatePTR: "lan.local", query: reverse("8.8.8.8")},
+		{name: "next to 172.16/12", privatePTR: "lan.local", query: reverse("172.32.0.1")},
+		{name: "public ipv6", privatePTR: "lan.local", query: reverse("2001:db8::1")},
+		{name: "wider than 172.16/12", privatePTR: "lan.local", query: "172.in-addr.arpa."},
+		{name: "disabled", query: reverse("10.1.2.3")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{
+				PrivatePTR: tt.privatePTR,
+				Forward:    []config.Server{{DNS: "udp://" + addr, Domain: []string{"in-addr.arpa", "ip6.arpa"}}},
+			})
+			defer c.Close()
+
+			r := c.ResolveWithMeta(context.Background(), tt.query, dns.TypePTR)
+			if r.FromStatic != tt.local || r.Rcode != tt.rcode {
+				t.Fatalf("local = %v %s, want %v %s", r.FromStatic, dns.RcodeToString[r.Rcode], tt.local, dns.RcodeToString[tt.rcode])
+			}
+			want := "upstream.example.com."
+			if tt.local {
+				want = "lan.local."
+			}
+			if tt.rcode == dns.RcodeNameError {
+				want = ""
+			}
+			if (want == "" && len(r.Answer) != 0) || (want != "" && (len(r.Answer) != 1 || r.Answer[0].Data != want)) {
+				t.Errorf("got %v, want %q", r.Answer, want)
+			}
+		})
+	}
+}
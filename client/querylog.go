@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const defaultQueryLogMaxSize = 100 // MB
+
+// queryLog is the audit log of queries in JSON lines, separated from the operational log.
+type queryLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+type queryLogLine struct {
+	Time    time.Time `json:"time"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Client  string    `json:"client,omitempty"`
+	Source  Source    `json:"source,omitempty"`
+	Rcode   string    `json:"rcode"`
+	Answers int       `json:"answers"`
+	Latency float64   `json:"latency"` // ms
+}
+
+func newQueryLog(cfg *config.QueryLog) *queryLog {
+	if cfg == nil || len(cfg.Path) == 0 {
+		return nil
+	}
+	l := &queryLog{path: cfg.Path, maxSize: defaultQueryLogMaxSize << 20}
+	if cfg.MaxSize > 0 {
+		l.maxSize = int64(cfg.MaxSize) << 20
+	}
+	if err := l.open(); err != nil {
+		logger.Module("client").Error().Str("path", cfg.Path).Err(err).Msg("invalid config")
+		panic(err)
+	}
+	return l
+}
+
+func (l *queryLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file to path.1, replacing the previous one.
+func (l *queryLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// record is an OnResponse hook.
+func (l *queryLog) record(ctx context.Context, e Event) {
+	line := queryLogLine{
+		Time:    time.Now(),
+		Name:    e.Name,
+		Type:    dns.Type(e.Type).String(),
+		Source:  e.Source,
+		Rcode:   dns.RcodeToString[e.Rcode],
+		Answers: len(e.Answer),
+		Latency: float64(e.Latency) / float64(time.Millisecond),
+	}
+	if ip := clientIPFromContext(ctx); ip != nil {
+		line.Client = ip.String()
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.size+int64(len(b)) > l.maxSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			logger.Module("client").Error().Str("path", l.path).Err(err).Msg("rotate query log")
+			if l.file == nil {
+				return
+			}
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		logger.Module("client").Error().Str("path", l.path).Err(err).Msg("write query log")
+	}
+}
+
+func (l *queryLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
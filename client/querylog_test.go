@@ -0,0 +1,178 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestQueryLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "query.log")
+
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "nx.example.com." {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(m)
+			return
+		}
+		answerA("1.1.1.1")(w, r)
+	})
+	c := new(DNSClient)
+	c.Init(&config.Config{
+		QueryLog: &config.QueryLog{Path: path},
+		Forward: []config.Server{
+			{DNS: "ipv4://2.2.2.2", Domain: []string{"static.example.com"}},
+			{DNS: "udp://" + addr, Domain: []string{"example.com"}},
+		},
+	})
+
+	tests := []struct {
+		name   string
+		query  string
+		qtype  uint16
+		client net.IP
+		want   queryLogLine
+	}{
+		{name: "static", query: "static.example.com.", qtype: dns.TypeA,
+			want: queryLogLine{Name: "static.example.com.", Type: "A", Source: SourceStatic, Rcode: "NOERROR", Answers: 1}},
+		{name: "upstream with client", query: "www.example.com.", qtype: dns.TypeA, client: net.IPv4(192, 168, 1, 2),
+			want: queryLogLine{Name: "www.example.com.", Type: "A", Client: "192.168.1.2", Source: SourceUpstream, Rcode: "NOERROR", Answers: 1}},
+		{name: "cached", query: "www.example.com.", qtype: dns.TypeA,
+			want: queryLogLine{Name: "www.example.com.", Type: "A", Source: SourceCache, Rcode: "NOERROR", Answers: 1}},
+		{name: "no data", query: "www.example.com.", qtype: dns.TypeAAAA,
+			want: queryLogLine{Name: "www.example.com.", Type: "AAAA", Source: SourceUpstream, Rcode: "NOERROR"}},
+		{name: "nxdomain", query: "nx.example.com.", qtype: dns.TypeA,
+			want: queryLogLine{Name: "nx.example.com.", Type: "A", Source: SourceUpstream, Rcode: "NXDOMAIN"}},
+	}
+	start := time.Now()
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.client != nil {
+			ctx = WithClientIP(ctx, tt.client)
+		}
+		c.QueryContext(ctx, tt.query, tt.qtype)
+	}
+	c.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !scanner.Scan() {
+				t.Fatal("line missing")
+			}
+			var got queryLogLine
+			if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+				t.Fatalf("%s: %v", scanner.Text(), err)
+			}
+			if got.Time.Before(start) || got.Latency < 0 {
+				t.Errorf("got time %v latency %v", got.Time, got.Latency)
+			}
+			got.Time, got.Latency = time.Time{}, 0
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if scanner.Scan() {
+		t.Errorf("unexpected line %s", scanner.Text())
+	}
+}
+
+func TestQueryLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "query.log")
+
+	e := Event{Name: "www.example.com.", Type: dns.TypeA, Source: SourceUpstream}
+	line, _ := json.Marshal(queryLogLine{Time: time.Now(), Name: e.Name, Type: "A", Source: e.Source, Rcode: "NOERROR"})
+	size := int64(len(line) + 1)
+
+	tests := []struct {
+		name    string
+		records int
+		// the number of lines in path and path.1
+		current int
+		rotated int
+	}{
+		{name: "not full", records: 2, current: 2},
+		{name: "full", records: 3, current: 3},
+		{name: "rotated", records: 4, current: 1, rotated: 3},
+		{name: "rotated again, the previous is replaced", records: 7, current: 1, rotated: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(path)
+			os.Remove(path + ".1")
+			l := newQueryLog(&config.QueryLog{Path: path})
+			// 3 lines fit, the time of a line may be a few bytes shorter or longer
+			l.maxSize = 3*size + size/2
+			for i := 0; i < tt.records; i++ {
+				l.record(context.Background(), e)
+			}
+			l.close()
+
+			if got := countLines(t, path); got != tt.current {
+				t.Errorf("current has %d lines, want %d", got, tt.current)
+			}
+			if got := countLines(t, path+".1"); got != tt.rotated {
+				t.Errorf("rotated has %d lines, want %d", got, tt.rotated)
+			}
+		})
+	}
+}
+
+func TestNewQueryLog(t *testing.T) {
+	if l := newQueryLog(nil); l != nil {
+		t.Errorf("got %v, want nil without config", l)
+	}
+	if l := newQueryLog(&config.QueryLog{}); l != nil {
+		t.Errorf("got %v, want nil without path", l)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("want panic for an invalid path")
+		}
+	}()
+	newQueryLog(&config.QueryLog{Path: "/nonexistent/query.log"})
+}
+
+func countLines(t *testing.T, path string) int {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, c := range b {
+		if c == '\n' {
+			n++
+		}
+	}
+	return n
+}
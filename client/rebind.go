@@ -0,0 +1,70 @@
+package client
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// bogonNetworks are the addresses not expected from public domains.
+var bogonNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range networks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRebind drops A/AAAA answers of private addresses, against DNS rebinding.
+// Answers from local upstream, or in the allowed networks of upstream, are kept.
+func (c *DNSClient) filterRebind(up *upstream, name string, answer []Answer) []Answer {
+	if !c.rebindProtection || up.local {
+		return answer
+	}
+	filtered := answer[:0]
+	for _, ans := range answer {
+		if ans.Type == dns.TypeA || ans.Type == dns.TypeAAAA {
+			ip := net.ParseIP(ans.Data)
+			if ip != nil && containsIP(bogonNetworks, ip) && !containsIP(up.allowPrivate, ip) {
+				logger.Module("client").Warn().Str("domain", name).Str("upstream", up.dns).Str("data", ans.Data).Msg("private address dropped")
+				continue
+			}
+		}
+		filtered = append(filtered, ans)
+	}
+	return filtered
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFilterRebind(t *testing.T) {
+	tests := []struct {
+		name         string
+		ans          Answer
+		local        bool
+		allowPrivate []string
+		kept         bool
+	}{
+		{name: "public v4", ans: Answer{Type: dns.TypeA, Data: "1.1.1.1"}, kept: true},
+		{name: "public v6", ans: Answer{Type: dns.TypeAAAA, Data: "2606:4700::1111"}, kept: true},
+		{name: "private v4", ans: Answer{Type: dns.TypeA, Data: "192.168.1.1"}},
+		{name: "loopback v4", ans: Answer{Type: dns.TypeA, Data: "127.0.0.1"}},
+		{name: "shared v4", ans: Answer{Type: dns.TypeA, Data: "100.64.0.1"}},
+		{name: "unspecified v4", ans: Answer{Type: dns.TypeA, Data: "0.0.0.0"}},
+		{name: "loopback v6", ans: Answer{Type: dns.TypeAAAA, Data: "::1"}},
+		{name: "unique local v6", ans: Answer{Type: dns.TypeAAAA, Data: "fd00::1"}},
+		{name: "link local v6", ans: Answer{Type: dns.TypeAAAA, Data: "fe80::1"}},
+		{name: "mapped v4", ans: Answer{Type: dns.TypeAAAA, Data: "::ffff:10.0.0.1"}},
+		{name: "other type", ans: Answer{Type: dns.TypeTXT, Data: "\"10.0.0.1\""}, kept: true},
+		{name: "local upstream", ans: Answer{Type: dns.TypeA, Data: "192.168.1.1"}, local: true, kept: true},
+		{name: "allowed", ans: Answer{Type: dns.TypeA, Data: "10.1.2.3"}, allowPrivate: []string{"10.1.0.0/16"}, kept: true},
+		{name: "not allowed", ans: Answer{Type: dns.TypeA, Data: "10.2.2.3"}, allowPrivate: []string{"10.1.0.0/16"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &DNSClient{rebindProtection: true}
+			up := &upstream{dns: "udp://1.1.1.1", local: tt.local, allowPrivate: parseCIDRs(tt.allowPrivate...)}
+			tt.ans.Name = "example.com."
+			got := c.filterRebind(up, "example.com.", []Answer{tt.ans})
+			if kept := len(got) == 1; kept != tt.kept {
+				t.Errorf("kept = %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"github.com/miekg/dns"
+)
+
+// referralError is a NOERROR response without answers, delegating the name by NS records in authority section.
+// It is a response, not a failure of upstream.
+type referralError struct {
+	// the minimum TTL of NS records
+	ttl int
+}
+
+func (e *referralError) Error() string {
+	return "referral"
+}
+
+func (e *referralError) Unwrap() error {
+	return rcodeError(dns.RcodeSuccess)
+}
+
+// referral returns a referralError if authority has NS records but no SOA, which would be NODATA.
+func referral(authority []Answer) error {
+	ttl := -1
+	for _, a := range authority {
+		switch a.Type {
+		case dns.TypeSOA:
+			return nil
+		case dns.TypeNS:
+			if ttl < 0 || a.TTL < ttl {
+				ttl = a.TTL
+			}
+		}
+	}
+	if ttl < 0 {
+		return nil
+	}
+	return &referralError{ttl: ttl}
+}
+
+func msgReferral(in *dns.Msg) error {
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) > 0 || in.Authoritative {
+		return nil
+	}
+	authority := make([]Answer, 0, len(in.Ns))
+	for _, rr := range in.Ns {
+		authority = append(authority, Answer{Type: rr.Header().Rrtype, TTL: int(rr.Header().Ttl)})
+	}
+	return referral(authority)
+}
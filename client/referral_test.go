@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestMsgReferral(t *testing.T) {
+	ns := func(ttl string) dns.RR {
+		rr, _ := dns.NewRR("example.com. " + ttl + " IN NS ns.example.com.")
+		return rr
+	}
+	soa, _ := dns.NewRR("example.com. 60 IN SOA ns.example.com. admin.example.com. 1 60 60 60 60")
+	a, _ := dns.NewRR("www.example.com. 60 IN A 1.1.1.1")
+	tests := []struct {
+		name          string
+		rcode         int
+		authoritative bool
+		answer        []dns.RR
+		ns            []dns.RR
+		// -1 is not a referral
+		ttl int
+	}{
+		{name: "referral", ns: []dns.RR{ns("300"), ns("60")}, ttl: 60},
+		{name: "nodata", ns: []dns.RR{soa}, ttl: -1},
+		{name: "nodata with NS", ns: []dns.RR{ns("300"), soa}, ttl: -1},
+		{name: "empty", ttl: -1},
+		{name: "answered", answer: []dns.RR{a}, ns: []dns.RR{ns("300")}, ttl: -1},
+		{name: "authoritative", authoritative: true, ns: []dns.RR{ns("300")}, ttl: -1},
+		{name: "nxdomain", rcode: dns.RcodeNameError, ns: []dns.RR{ns("300")}, ttl: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := new(dns.Msg)
+			in.SetQuestion("www.example.com.", dns.TypeA)
+			in.Response = true
+			in.Rcode = tt.rcode
+			in.Authoritative = tt.authoritative
+			in.Answer = tt.answer
+			in.Ns = tt.ns
+
+			err := msgReferral(in)
+			ref, ok := err.(*referralError)
+			if (tt.ttl < 0 && err != nil) || (tt.ttl >= 0 && (!ok || ref.ttl != tt.ttl)) {
+				t.Errorf("got %v, want ttl %d", err, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestReferral(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR("example.com. 300 IN NS ns.example.com.")
+		m.Ns = append(m.Ns, rr)
+		w.WriteMsg(m)
+	})
+	tests := []struct {
+		name          string
+		cacheReferral bool
+		cachedTTL     time.Duration
+	}{
+		{name: "not cached"},
+		{name: "cached for the TTL of NS", cacheReferral: true, cachedTTL: 300 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{
+				CacheReferral: tt.cacheReferral,
+				Forward:       []config.Server{{DNS: "udp://" + addr, Domain: []string{"example.com"}}},
+			})
+			defer c.Close()
+
+			r := c.ResolveWithMeta(context.Background(), "www.example.com.", dns.TypeA)
+			if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 || r.ExtendedError != nil {
+				t.Errorf("got %s %v %v, want an empty response", dns.RcodeToString[r.Rcode], r.Answer, r.ExtendedError)
+			}
+			// a response, not a failure of upstream
+			if val, _ := c.rtt.Load("udp://" + addr); atomic.LoadInt64(&val.(*rttStats).failures) != 0 {
+				t.Errorf("counted as a failure")
+			}
+			if cached := c.Explain("www.example.com.", dns.TypeA).Cached; cached != tt.cacheReferral {
+				t.Fatalf("cached = %v, want %v", cached, tt.cacheReferral)
+			}
+			if tt.cacheReferral {
+				if got := cachedTTL(c); got != tt.cachedTTL {
+					t.Errorf("cached for %v, want %v", got, tt.cachedTTL)
+				}
+				if r := c.ResolveWithMeta(context.Background(), "www.example.com.", dns.TypeA); !r.FromCache || len(r.Answer) != 0 {
+					t.Errorf("got %v from cache %v", r.Answer, r.FromCache)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package client
+
+import (
+	"context"
+)
+
+// Resolver is the query API of DNSClient, to be replaced in tests, e.g. by clienttest.StaticResolver.
+// Methods are only added to it along with a major version.
+type Resolver interface {
+	Query(name string, qtype uint16) []Answer
+	QueryContext(ctx context.Context, name string, qtype uint16) []Answer
+	// ResolveContext is QueryContext with the response code.
+	ResolveContext(ctx context.Context, name string, qtype uint16) ([]Answer, int)
+	// ResolveWithMeta is ResolveContext with where the answers come from.
+	ResolveWithMeta(ctx context.Context, name string, qtype uint16) Result
+}
+
+var _ Resolver = (*DNSClient)(nil)
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultAttemptTimeout = 2 * time.Second
+
+type queryTimeout struct {
+	attempt time.Duration // timeout of each attempt
+	total   time.Duration // deadline of all attempts
+}
+
+var defaultQueryTimeout = queryTimeout{attempt: defaultAttemptTimeout, total: defaultAttemptTimeout}
+
+func (t queryTimeout) String() string {
+	return t.attempt.String() + "/" + t.total.String()
+}
+
+// withTimeout copies the client with another timeout.
+func withTimeout(cli *dns.Client, timeout time.Duration) *dns.Client {
+	return &dns.Client{
+		Net:       cli.Net,
+		UDPSize:   cli.UDPSize,
+		TLSConfig: cli.TLSConfig,
+		Dialer:    cli.Dialer,
+		Timeout:   timeout,
+	}
+}
+
+// exchangeWithRetry retransmits the query after an attempt timed out, until the total deadline, or the ctx deadline if earlier.
+// It returns at once when ctx is cancelled.
+func exchangeWithRetry(ctx context.Context, t queryTimeout, exchange func(timeout time.Duration) (*dns.Msg, error)) (*dns.Msg, error) {
+	deadline := time.Now().Add(t.total)
+	if d, bounded := ctx.Deadline(); bounded && d.Before(deadline) {
+		deadline = d
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		timeout := t.attempt
+		if remain := time.Until(deadline); remain <= 0 {
+			// a zero timeout is the default of dns.Client
+			return nil, context.DeadlineExceeded
+		} else if remain < timeout {
+			timeout = remain
+		}
+		in, err := attempt(ctx, timeout, exchange)
+		if err == nil {
+			return in, nil
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() || time.Until(deadline) <= 0 {
+			return nil, err
+		}
+	}
+}
+
+// attempt waits for exchange until ctx is done, since dns.Client isn't cancellable.
+// The exchange abandoned is still bounded by timeout.
+func attempt(ctx context.Context, timeout time.Duration, exchange func(timeout time.Duration) (*dns.Msg, error)) (*dns.Msg, error) {
+	if ctx.Done() == nil {
+		return exchange(timeout)
+	}
+	type result struct {
+		in  *dns.Msg
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		in, err := exchange(timeout)
+		done <- result{in, err}
+	}()
+	select {
+	case r := <-done:
+		return r.in, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// shareDeadline bounds ctx to 1/n of the time left before its deadline, leaving the rest for n-1 later attempts.
+// It is ctx itself without deadline.
+func shareDeadline(ctx context.Context, n int) (context.Context, context.CancelFunc) {
+	deadline, bounded := ctx.Deadline()
+	if !bounded || n <= 1 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(n))
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUDPRetransmit(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name     string
+		timeout  queryTimeout
+		deadline time.Duration
+		// cancels ctx after, or before the query if negative
+		cancel time.Duration
+		// the queries not answered
+		dropped int32
+		failed  bool
+		queries int32
+		within  time.Duration
+	}{
+		{name: "answered", timeout: queryTimeout{attempt: 50 * ms, total: 500 * ms}, queries: 1, within: 50 * ms},
+		{name: "retransmitted", timeout: queryTimeout{attempt: 50 * ms, total: 500 * ms}, dropped: 1, queries: 2, within: 100 * ms},
+		{name: "retransmitted twice", timeout: queryTimeout{attempt: 50 * ms, total: 500 * ms}, dropped: 2, queries: 3, within: 150 * ms},
+		{name: "total deadline", timeout: queryTimeout{attempt: 50 * ms, total: 80 * ms}, dropped: 5, failed: true, queries: 2, within: 120 * ms},
+		{name: "ctx deadline", timeout: queryTimeout{attempt: 50 * ms, total: time.Second}, deadline: 80 * ms, dropped: 5, failed: true, queries: 2, within: 120 * ms},
+		{name: "cancelled", timeout: queryTimeout{attempt: 50 * ms, total: time.Second}, cancel: 70 * ms, dropped: 5, failed: true, queries: 2, within: 90 * ms},
+		{name: "cancelled before", timeout: queryTimeout{attempt: 50 * ms, total: time.Second}, cancel: -1, failed: true, queries: 0, within: 10 * ms},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries int32
+			addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+				if atomic.AddInt32(&queries, 1) <= tt.dropped {
+					return
+				}
+				answerA("1.1.1.1")(w, r)
+			})
+			cli := GetUDPClient(addr, "", false, tt.timeout)
+
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			if tt.cancel != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				defer cancel()
+				if tt.cancel < 0 {
+					cancel()
+				} else {
+					time.AfterFunc(tt.cancel, cancel)
+				}
+			}
+			start := time.Now()
+			ans, err := cli(ctx, "example.com.", dns.TypeA)
+			if elapsed := time.Since(start); elapsed >= tt.within {
+				t.Errorf("returned after %v, want within %v", elapsed, tt.within)
+			}
+			if failed := err != nil || len(ans) != 1; failed != tt.failed {
+				t.Errorf("got %v %v, want failed = %v", ans, err, tt.failed)
+			}
+			if got := atomic.LoadInt32(&queries); got != tt.queries {
+				t.Errorf("sent %d queries, want %d", got, tt.queries)
+			}
+		})
+	}
+}
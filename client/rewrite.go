@@ -0,0 +1,137 @@
+package client
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+type rewriteRule struct {
+	name   string // empty matches any name
+	qtype  uint16 // 0 matches any type
+	data   string // empty matches any data
+	action string
+	value  string
+	target uint16 // the type of value, for "map"
+}
+
+func compileRewrite(rules []config.Rewrite) []rewriteRule {
+	var compiled []rewriteRule
+	for _, r := range rules {
+		rule := rewriteRule{data: r.Data, action: r.Action, value: r.Value}
+		if len(r.Name) > 0 {
+			rule.name = strings.ToLower(dns.Fqdn(r.Name))
+		}
+		if len(r.Type) > 0 {
+			qtype, found := dns.StringToType[strings.ToUpper(r.Type)]
+			if !found {
+				logger.Module("client.rewrite").Error().Str("type", r.Type).Msg("invalid config")
+				panic("invalid rewrite type: " + r.Type)
+			}
+			rule.qtype = qtype
+		}
+		switch r.Action {
+		case "replace":
+		case "drop":
+		case "cname":
+			rule.value = dns.Fqdn(r.Value)
+		case "map":
+			// A to AAAA or the reverse, e.g. static NAT of a legacy service
+			from, to := net.ParseIP(r.Data), net.ParseIP(r.Value)
+			if len(rule.name) == 0 || from == nil || to == nil || (from.To4() == nil) == (to.To4() == nil) {
+				logger.Module("client.rewrite").Error().Str("name", r.Name).Str("data", r.Data).Str("value", r.Value).Msg("invalid config")
+				panic("invalid rewrite map: " + r.Name)
+			}
+			rule.qtype, rule.target = dns.TypeA, dns.TypeAAAA
+			if from.To4() == nil {
+				rule.qtype, rule.target = dns.TypeAAAA, dns.TypeA
+			}
+			rule.data, rule.value = from.String(), to.String()
+		default:
+			logger.Module("client.rewrite").Error().Str("action", r.Action).Msg("invalid config")
+			panic("invalid rewrite action: " + r.Action)
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled
+}
+
+func (r *rewriteRule) match(ans Answer) bool {
+	return (len(r.name) == 0 || strings.EqualFold(r.name, ans.Name)) &&
+		(r.qtype == 0 || r.qtype == ans.Type) &&
+		(len(r.data) == 0 || r.data == ans.Data)
+}
+
+// rewrite applies the first matched rule of each answer.
+// A "cname" rule replaces all answers with a CNAME to its value.
+func (c *DNSClient) rewrite(answer []Answer) []Answer {
+	if len(c.rewriteRules) == 0 {
+		return answer
+	}
+
+	var rewritten []Answer
+	for _, ans := range answer {
+		rule := c.matchRewrite(ans)
+		if rule == nil {
+			rewritten = append(rewritten, ans)
+			continue
+		}
+		logger.Module("client.rewrite").Debug().Str("domain", ans.Name).Str("data", ans.Data).Str("action", rule.action).Send()
+		switch rule.action {
+		case "replace":
+			ans.Data = rule.value
+			rewritten = append(rewritten, ans)
+		case "drop":
+		case "cname":
+			return []Answer{{Name: answer[0].Name, Type: dns.TypeCNAME, TTL: ans.TTL, Data: rule.value}}
+		}
+	}
+	return rewritten
+}
+
+func (c *DNSClient) matchRewrite(ans Answer) *rewriteRule {
+	for idx := range c.rewriteRules {
+		if c.rewriteRules[idx].action != "map" && c.rewriteRules[idx].match(ans) {
+			return &c.rewriteRules[idx]
+		}
+	}
+	return nil
+}
+
+// mappedType returns the type queried from upstream for the query,
+// i.e. A for an AAAA query of a name with "map" rules from A to AAAA, and the reverse.
+func (c *DNSClient) mappedType(name string, qtype uint16) uint16 {
+	for idx := range c.rewriteRules {
+		rule := &c.rewriteRules[idx]
+		if rule.action == "map" && rule.target == qtype && strings.EqualFold(rule.name, name) {
+			return rule.qtype
+		}
+	}
+	return qtype
+}
+
+// mapAddresses converts the answers of mappedType by "map" rules of the query name, the addresses not mapped are dropped.
+func (c *DNSClient) mapAddresses(name string, qtype uint16, answer []Answer) []Answer {
+	var mapped []Answer
+	for _, ans := range answer {
+		if ans.Type != dns.TypeA && ans.Type != dns.TypeAAAA {
+			mapped = append(mapped, ans)
+			continue
+		}
+		for idx := range c.rewriteRules {
+			rule := &c.rewriteRules[idx]
+			if rule.action == "map" && rule.target == qtype && strings.EqualFold(rule.name, name) &&
+				rule.qtype == ans.Type && net.ParseIP(rule.data).Equal(net.ParseIP(ans.Data)) {
+				logger.Module("client.rewrite").Debug().Str("domain", name).Str("data", ans.Data).Str("value", rule.value).Msg("map")
+				ans.Type, ans.Data = rule.target, rule.value
+				mapped = append(mapped, ans)
+				break
+			}
+		}
+	}
+	return mapped
+}
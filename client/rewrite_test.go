@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestRewrite(t *testing.T) {
+	a1 := Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}
+	a2 := Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "2.2.2.2"}
+	txt := Answer{Name: "example.com.", Type: dns.TypeTXT, TTL: 60, Data: `"txt"`}
+	tests := []struct {
+		name   string
+		rules  []config.Rewrite
+		answer []Answer
+		want   []Answer
+	}{
+		{name: "none", answer: []Answer{a1, a2}, want: []Answer{a1, a2}},
+		{
+			name:   "replace IP",
+			rules:  []config.Rewrite{{Data: "1.1.1.1", Action: "replace", Value: "10.0.0.1"}},
+			answer: []Answer{a1, a2},
+			want:   []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "10.0.0.1"}, a2},
+		},
+		{
+			name:   "drop by data",
+			rules:  []config.Rewrite{{Data: "2.2.2.2", Action: "drop"}},
+			answer: []Answer{a1, a2},
+			want:   []Answer{a1},
+		},
+		{
+			name:   "drop by type",
+			rules:  []config.Rewrite{{Name: "example.com", Type: "txt", Action: "drop"}},
+			answer: []Answer{a1, txt},
+			want:   []Answer{a1},
+		},
+		{
+			name:   "other name",
+			rules:  []config.Rewrite{{Name: "example.net", Action: "drop"}},
+			answer: []Answer{a1},
+			want:   []Answer{a1},
+		},
+		{
+			name: "first rule wins",
+			rules: []config.Rewrite{
+				{Data: "1.1.1.1", Action: "replace", Value: "10.0.0.1"},
+				{Data: "1.1.1.1", Action: "drop"},
+			},
+			answer: []Answer{a1},
+			want:   []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "10.0.0.1"}},
+		},
+		{
+			name:   "cname",
+			rules:  []config.Rewrite{{Name: "EXAMPLE.com", Action: "cname", Value: "local.lan"}},
+			answer: []Answer{a1, a2},
+			want:   []Answer{{Name: "example.com.", Type: dns.TypeCNAME, TTL: 60, Data: "local.lan."}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{Rewrite: tt.rules})
+			if got := c.rewrite(append([]Answer(nil), tt.answer...)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteCached(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  config.Rewrite
+		qtype uint16
+		want  []Answer
+	}{
+		{
+			name:  "replace",
+			rule:  config.Rewrite{Data: "192.0.2.1", Action: "replace", Value: "198.51.100.1"},
+			qtype: dns.TypeA,
+			want:  []Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 300, Data: "198.51.100.1"}},
+		},
+		{
+			name:  "drop",
+			rule:  config.Rewrite{Data: "192.0.2.1", Action: "drop"},
+			qtype: dns.TypeA,
+		},
+		{
+			name:  "map",
+			rule:  config.Rewrite{Name: "example.com", Data: "192.0.2.1", Action: "map", Value: "2001:db8::1"},
+			qtype: dns.TypeAAAA,
+			want:  []Answer{{Name: "example.com.", Type: dns.TypeAAAA, TTL: 300, Data: "2001:db8::1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{Rewrite: []config.Rewrite{tt.rule}})
+			c.view.router.add("example.com.", &upstream{dns: "fake://upstream", query: fakeExchanger})
+
+			ans := c.Query("example.com.", tt.qtype)
+			if !reflect.DeepEqual(ans, tt.want) {
+				t.Errorf("got %v, want %v", ans, tt.want)
+			}
+			// the rewritten answers are cached, not the original
+			cached, _, _, _ := c.cacheGet(c.cacheKey(context.Background(), &c.view, "example.com.", tt.qtype))
+			if !reflect.DeepEqual(cached, tt.want) {
+				t.Errorf("cached %v, want %v", cached, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteMap(t *testing.T) {
+	rules := []config.Rewrite{
+		{Name: "legacy.example.com", Data: "10.0.0.1", Action: "map", Value: "2001:db8::1"},
+		{Name: "legacy.example.com", Data: "10.0.0.2", Action: "map", Value: "2001:db8::2"},
+		{Name: "v6only.example.com", Data: "2001:db8::3", Action: "map", Value: "10.0.0.3"},
+	}
+	records := []Answer{
+		{Name: "legacy.example.com.", Type: dns.TypeA, TTL: 60, Data: "10.0.0.1"},
+		{Name: "legacy.example.com.", Type: dns.TypeA, TTL: 60, Data: "10.0.0.9"},
+		{Name: "v6only.example.com.", Type: dns.TypeAAAA, TTL: 60, Data: "2001:db8::3"},
+		{Name: "other.example.com.", Type: dns.TypeA, TTL: 60, Data: "10.0.0.1"},
+	}
+	tests := []struct {
+		name  string
+		query string
+		qtype uint16
+		sent  uint16
+		want  []Answer
+	}{
+		{
+			name:  "A to AAAA",
+			query: "legacy.example.com.",
+			qtype: dns.TypeAAAA,
+			sent:  dns.TypeA,
+			want:  []Answer{{Name: "legacy.example.com.", Type: dns.TypeAAAA, TTL: 60, Data: "2001:db8::1"}},
+		},
+		{
+			name:  "AAAA to A",
+			query: "v6only.example.com.",
+			qtype: dns.TypeA,
+			sent:  dns.TypeAAAA,
+			want:  []Answer{{Name: "v6only.example.com.", Type: dns.TypeA, TTL: 60, Data: "10.0.0.3"}},
+		},
+		{
+			name:  "source type unchanged",
+			query: "legacy.example.com.",
+			qtype: dns.TypeA,
+			sent:  dns.TypeA,
+			want:  records[:2],
+		},
+		{
+			name:  "other name",
+			query: "other.example.com.",
+			qtype: dns.TypeAAAA,
+			sent:  dns.TypeAAAA,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{Rewrite: rules})
+			defer c.Close()
+			var sent uint16
+			up := &upstream{dns: "fake://upstream", query: func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+				sent = qtype
+				var ans []Answer
+				for _, rr := range records {
+					if rr.Name == name && rr.Type == qtype {
+						ans = append(ans, rr)
+					}
+				}
+				return ans, nil
+			}}
+			c.view.router.add("example.com.", up)
+
+			ans := c.Query(tt.query, tt.qtype)
+			if sent != tt.sent {
+				t.Errorf("sent %v, want %v", dns.TypeToString[sent], dns.TypeToString[tt.sent])
+			}
+			if len(ans)+len(tt.want) > 0 && !reflect.DeepEqual(ans, tt.want) {
+				t.Errorf("got %v, want %v", ans, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// rotateDomain marks the domains in DNSClient.rotated.
+var rotateDomain = new(upstream)
+
+// rotates reports whether the cached addresses of the domain should be rotated on each hit, for client-side round-robin.
+func (c *DNSClient) rotates(domain string) bool {
+	return c.rotated.route(domain) != nil
+}
+
+// rotation is the number of hits of the cached entry.
+func (c *DNSClient) rotation(key string) int {
+	val, found := c.cache.Load(key)
+	if !found {
+		return 0
+	}
+	cached, ok := val.(*dnsCached)
+	if !ok {
+		return 0
+	}
+	return int(atomic.AddUint32(&cached.hits, 1) - 1)
+}
+
+// rotateAddresses shifts the A/AAAA answers by n, in their own positions, so a CNAME chain is still in order.
+func rotateAddresses(answer []Answer, n int) []Answer {
+	var idx []int
+	for i, ans := range answer {
+		if ans.Type == dns.TypeA || ans.Type == dns.TypeAAAA {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < 2 {
+		return answer
+	}
+	rotated := make([]Answer, len(answer))
+	copy(rotated, answer)
+	for i, pos := range idx {
+		rotated[pos] = answer[idx[(i+n)%len(idx)]]
+	}
+	return rotated
+}
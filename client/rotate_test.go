@@ -0,0 +1,113 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestRotateAddresses(t *testing.T) {
+	answers := func(data string) []Answer {
+		var ans []Answer
+		for _, d := range strings.Fields(data) {
+			switch {
+			case strings.HasSuffix(d, "."):
+				ans = append(ans, Answer{Name: "example.com.", Type: dns.TypeCNAME, Data: d})
+			case strings.Contains(d, ":"):
+				ans = append(ans, Answer{Name: "example.com.", Type: dns.TypeAAAA, Data: d})
+			default:
+				ans = append(ans, Answer{Name: "example.com.", Type: dns.TypeA, Data: d})
+			}
+		}
+		return ans
+	}
+	tests := []struct {
+		name   string
+		answer string
+		n      int
+		want   string
+	}{
+		{name: "not rotated", answer: "1.1.1.1 2.2.2.2 3.3.3.3", n: 0, want: "1.1.1.1 2.2.2.2 3.3.3.3"},
+		{name: "by one", answer: "1.1.1.1 2.2.2.2 3.3.3.3", n: 1, want: "2.2.2.2 3.3.3.3 1.1.1.1"},
+		{name: "by two", answer: "1.1.1.1 2.2.2.2 3.3.3.3", n: 2, want: "3.3.3.3 1.1.1.1 2.2.2.2"},
+		{name: "wrapped", answer: "1.1.1.1 2.2.2.2 3.3.3.3", n: 4, want: "2.2.2.2 3.3.3.3 1.1.1.1"},
+		{name: "CNAME kept in position", answer: "cdn.example.net. 1.1.1.1 2.2.2.2", n: 1, want: "cdn.example.net. 2.2.2.2 1.1.1.1"},
+		{name: "mixed A and AAAA", answer: "1.1.1.1 2001:db8::1 2.2.2.2", n: 1, want: "2001:db8::1 2.2.2.2 1.1.1.1"},
+		{name: "single address", answer: "cdn.example.net. 1.1.1.1", n: 1, want: "cdn.example.net. 1.1.1.1"},
+		{name: "empty", n: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer := answers(tt.answer)
+			got := rotateAddresses(answer, tt.n)
+			if answerData(got) != tt.want {
+				t.Errorf("got %q, want %q", answerData(got), tt.want)
+			}
+			if answerData(answer) != tt.answer {
+				t.Errorf("input modified, got %q", answerData(answer))
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	addr := startServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, s := range []string{" 60 IN CNAME cdn.example.net.", " 60 IN A 1.1.1.1", " 60 IN A 2.2.2.2", " 60 IN A 3.3.3.3"} {
+			rr, _ := dns.NewRR(r.Question[0].Name + s)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	tests := []struct {
+		name  string
+		query string
+		// the answers of each query, the first one from upstream
+		want []string
+	}{
+		{name: "rotated on each hit", query: "www.example.com.", want: []string{
+			"cdn.example.net. 1.1.1.1 2.2.2.2 3.3.3.3",
+			"cdn.example.net. 1.1.1.1 2.2.2.2 3.3.3.3",
+			"cdn.example.net. 2.2.2.2 3.3.3.3 1.1.1.1",
+			"cdn.example.net. 3.3.3.3 1.1.1.1 2.2.2.2",
+			"cdn.example.net. 1.1.1.1 2.2.2.2 3.3.3.3",
+		}},
+		{name: "not configured", query: "www.example.org.", want: []string{
+			"cdn.example.net. 1.1.1.1 2.2.2.2 3.3.3.3",
+			"cdn.example.net. 1.1.1.1 2.2.2.2 3.3.3.3",
+			"cdn.example.net. 1.1.1.1 2.2.2.2 3.3.3.3",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{
+				Rotate:  []string{"example.com"},
+				Forward: []config.Server{{DNS: "udp://" + addr, Domain: []string{"."}}},
+			})
+			defer c.Close()
+
+			for idx, want := range tt.want {
+				if got := answerData(c.Query(tt.query, dns.TypeA)); got != want {
+					t.Errorf("query %d got %q, want %q", idx, got, want)
+				}
+			}
+			// the cached answers are not modified
+			if got := cachedData(c); got != "cdn.example.net." {
+				t.Errorf("cached %q", got)
+			}
+		})
+	}
+}
+
+func answerData(answer []Answer) string {
+	data := make([]string, 0, len(answer))
+	for _, ans := range answer {
+		data = append(data, ans.Data)
+	}
+	return strings.Join(data, " ")
+}
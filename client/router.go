@@ -3,67 +3,114 @@ package client
 import (
 	"strings"
 
-	"github.com/rs/zerolog/log"
+	"github.com/dhcmrlchtdj/dns/logger"
 )
 
 type dnsRouter struct {
-	matched dnsClient
-	router  map[string]*dnsRouter
+	matched  *upstream
+	override *upstream // added at runtime, takes precedence over matched
+	router   map[string]*dnsRouter
 }
 
-func (c *dnsRouter) add(domain string, cli dnsClient) {
-	log.Debug().Str("module", "client.router").Str("domain", domain).Msg("add")
+func (c *dnsRouter) add(domain string, cli *upstream) {
+	logger.Module("client.router").Debug().Str("domain", domain).Msg("add")
 
+	r := c.node(domain)
+	if r.matched == nil {
+		r.matched = cli
+	}
+}
+
+// node returns the router of domain, creates it if not exist.
+func (c *dnsRouter) node(domain string) *dnsRouter {
+	r := c
 	if domain == "." {
-		if c.matched == nil {
-			c.matched = cli
-		}
+		return r
+	}
+	if ascii, err := ToASCII(domain); err != nil {
+		// kept as is, it matches no query
+		logger.Module("client.router").Warn().Str("domain", domain).Err(err).Send()
 	} else {
-		r := c
-		for _, part := range revDomain(domain) {
-			if r.router == nil {
-				r.router = make(map[string]*dnsRouter)
-			}
-			next, found := r.router[part]
-			if !found {
-				next = new(dnsRouter)
-				r.router[part] = next
-			}
-			r = next
+		domain = ascii
+	}
+	for _, part := range revDomain(domain) {
+		if r.router == nil {
+			r.router = make(map[string]*dnsRouter)
 		}
-		if r.matched == nil {
-			r.matched = cli
+		next, found := r.router[part]
+		if !found {
+			next = new(dnsRouter)
+			r.router[part] = next
 		}
+		r = next
 	}
+	return r
 }
 
-func (c *dnsRouter) route(domain string) dnsClient {
-	log.Debug().Str("module", "client.router").Str("domain", domain).Msg("route")
+func (c *dnsRouter) rule() *upstream {
+	if c.override != nil {
+		return c.override
+	}
+	return c.matched
+}
+
+func (c *dnsRouter) route(domain string) *upstream {
+	logger.Module("client.router").Debug().Str("domain", domain).Msg("route")
 
 	if domain == "." {
-		return c.matched
+		return c.rule()
 	} else {
-		matched := c.matched
-
-		r := c
-		for _, part := range revDomain(domain) {
-			if r.router == nil {
-				break
-			} else {
-				next, found := r.router[part]
-				if found {
-					if next.matched != nil {
-						matched = next.matched
-					}
-					r = next
-				} else {
-					break
-				}
-			}
+		matched, _, _ := c.match(revDomain(domain), 0)
+		return matched
+	}
+}
+
+// match returns the deepest rule matching the labels, its depth, and its labels in reverse order.
+// A "*" label matches any single label, but a literal label wins at the same depth.
+func (c *dnsRouter) match(parts []string, depth int) (*upstream, int, []string) {
+	matched, matchedDepth := c.rule(), depth
+	var matchedRule []string
+	if matched == nil {
+		matchedDepth = -1
+	}
+
+	if len(parts) == 0 || c.router == nil {
+		return matched, matchedDepth, matchedRule
+	}
+
+	for _, part := range []string{parts[0], "*"} {
+		next, found := c.router[part]
+		if !found {
+			continue
 		}
+		m, d, r := next.match(parts[1:], depth+1)
+		if m != nil && d > matchedDepth {
+			matched, matchedDepth = m, d
+			matchedRule = append([]string{part}, r...)
+		}
+	}
 
-		return matched
+	return matched, matchedDepth, matchedRule
+}
+
+// candidates returns all rules matching the labels, as reversed labels.
+func (c *dnsRouter) candidates(parts []string, rule []string) [][]string {
+	var all [][]string
+	if c.rule() != nil {
+		all = append(all, rule)
 	}
+	if len(parts) == 0 || c.router == nil {
+		return all
+	}
+	for _, part := range []string{parts[0], "*"} {
+		next, found := c.router[part]
+		if !found {
+			continue
+		}
+		r := append(append([]string{}, rule...), part)
+		all = append(all, next.candidates(parts[1:], r)...)
+	}
+	return all
 }
 
 func revDomain(domain string) []string {
@@ -74,3 +121,16 @@ func revDomain(domain string) []string {
 	}
 	return rev
 }
+
+// joinRevDomain is the reverse of revDomain.
+func joinRevDomain(rev []string) string {
+	domain := "."
+	for _, part := range rev {
+		if domain == "." {
+			domain = part + "."
+		} else {
+			domain = part + "." + domain
+		}
+	}
+	return domain
+}
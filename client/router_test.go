@@ -0,0 +1,39 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestRouterWildcard(t *testing.T) {
+	var router dnsRouter
+	rules := []string{"example.com.", "_acme-challenge.*.example.com.", "*.wild.example.com.", "a.wild.example.com."}
+	for _, rule := range rules {
+		router.add(rule, &upstream{dns: rule})
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "_acme-challenge.a.example.com.", want: "_acme-challenge.*.example.com."},
+		{query: "x._acme-challenge.a.example.com.", want: "_acme-challenge.*.example.com."},
+		{query: "a.example.com.", want: "example.com."},
+		{query: "_acme-challenge.example.com.", want: "example.com."},
+		{query: "b.wild.example.com.", want: "*.wild.example.com."},
+		{query: "a.wild.example.com.", want: "a.wild.example.com."},
+		{query: "x.a.wild.example.com.", want: "a.wild.example.com."},
+		{query: "wild.example.com.", want: "example.com."},
+		{query: "example.net.", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got := ""
+			if up := router.route(tt.query); up != nil {
+				got = up.dns
+			}
+			if got != tt.want {
+				t.Errorf("routed to %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"sort"
+)
+
+// RouteInfo is a configured route of a view.
+type RouteInfo struct {
+	View string
+	// The domain, with "*" labels of wildcard rules, or "*." of static IP matching subdomains.
+	Domain string
+	// "static", "zone" or "upstream".
+	Type string
+	// The static address, the zone file, or the upstream.
+	Target string
+	// Added by AddRule, and takes precedence over the rule from config.
+	Runtime bool
+}
+
+// DumpRoutes returns the routes of all views, the default view first, sorted by domain in each view.
+// The routers are read under the lock of AddRule/RemoveRule, so it is a consistent snapshot.
+func (c *DNSClient) DumpRoutes() []RouteInfo {
+	c.rules.RLock()
+	defer c.rules.RUnlock()
+
+	var routes []RouteInfo
+	for _, view := range append([]*dnsView{&c.view}, c.views...) {
+		var viewRoutes []RouteInfo
+		add := func(domain string, typ string, target string, runtime bool) {
+			viewRoutes = append(viewRoutes, RouteInfo{View: view.name, Domain: domain, Type: typ, Target: target, Runtime: runtime})
+		}
+		for domain, ip := range view.staticIpV4 {
+			add(domain, "static", ip, false)
+		}
+		for domain, ip := range view.staticIpV6 {
+			add(domain, "static", ip, false)
+		}
+		for domain, z := range view.zones {
+			add(domain, "zone", z.path, false)
+		}
+		view.router.walk(nil, func(domain string, r *dnsRouter) {
+			if r.matched != nil {
+				add(domain, "upstream", r.matched.dns, false)
+			}
+			if r.override != nil {
+				add(domain, "upstream", r.override.dns, true)
+			}
+		})
+		sort.SliceStable(viewRoutes, func(i, j int) bool {
+			a, b := viewRoutes[i], viewRoutes[j]
+			if a.Domain != b.Domain {
+				return a.Domain < b.Domain
+			}
+			if a.Type != b.Type {
+				return a.Type < b.Type
+			}
+			return a.Target < b.Target
+		})
+		routes = append(routes, viewRoutes...)
+	}
+	return routes
+}
+
+// walk calls fn for the router and all its descendants, rev is the reversed labels of c.
+func (c *dnsRouter) walk(rev []string, fn func(domain string, r *dnsRouter)) {
+	fn(joinRevDomain(rev), c)
+	parts := make([]string, 0, len(c.router))
+	for part := range c.router {
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	for _, part := range parts {
+		next := append(rev[:len(rev):len(rev)], part)
+		c.router[part].walk(next, fn)
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestDumpRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zone := writeZone(t, dir, "example.zone", "3.3.3.3")
+
+	c := new(DNSClient)
+	c.Init(&config.Config{
+		Forward: []config.Server{
+			{DNS: "ipv4://1.1.1.1", Domain: []string{"static.example.com", "*.wild.example.com"}},
+			{DNS: "ipv6://::1", Domain: []string{"static.example.com"}},
+			{DNS: "zone://" + zone, Domain: []string{"example.com"}},
+			{DNS: "udp://8.8.8.8", Domain: []string{"*.cdn.example.net", "example.org"}},
+			{DNS: "udp://9.9.9.9", Domain: []string{"."}},
+		},
+		View: []config.View{{
+			Name:    "lan",
+			Client:  []string{"192.168.0.0/16"},
+			Forward: []config.Server{{DNS: "udp://1.0.0.1", Domain: []string{"example.org"}}},
+		}},
+	})
+
+	configured := []RouteInfo{
+		{Domain: "*.cdn.example.net.", Type: "upstream", Target: "udp://8.8.8.8"},
+		{Domain: "*.wild.example.com.", Type: "static", Target: "1.1.1.1"},
+		{Domain: ".", Type: "upstream", Target: "udp://9.9.9.9"},
+		{Domain: "example.com.", Type: "zone", Target: zone},
+		{Domain: "example.org.", Type: "upstream", Target: "udp://8.8.8.8"},
+		{Domain: "static.example.com.", Type: "static", Target: "1.1.1.1"},
+		{Domain: "static.example.com.", Type: "static", Target: "::1"},
+		{View: "lan", Domain: "example.org.", Type: "upstream", Target: "udp://1.0.0.1"},
+	}
+	runtime := append([]RouteInfo(nil), configured[:4]...)
+	runtime = append(runtime, RouteInfo{Domain: "example.org.", Type: "upstream", Target: "udp://8.8.4.4", Runtime: true})
+	runtime = append(runtime, configured[4:]...)
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T)
+		want   []RouteInfo
+	}{
+		{name: "configured", change: func(t *testing.T) {}, want: configured},
+		{
+			name: "add rule",
+			change: func(t *testing.T) {
+				if err := c.AddRule("Example.org", config.Server{DNS: "udp://8.8.4.4"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: runtime,
+		},
+		{name: "remove rule", change: func(t *testing.T) { c.RemoveRule("example.org") }, want: configured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change(t)
+			if got := c.DumpRoutes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
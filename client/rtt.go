@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const defaultRttAlpha = 0.3
+
+type rttStats struct {
+	sync.Mutex
+	avg time.Duration
+	// consecutive queries failed without response
+	failures int64
+	// nil without breaker_after
+	breaker *circuitBreaker
+}
+
+func (r *rttStats) observe(rtt time.Duration, alpha float64) {
+	r.Lock()
+	defer r.Unlock()
+	if r.avg == 0 {
+		r.avg = rtt
+	} else {
+		r.avg = time.Duration(alpha*float64(rtt) + (1-alpha)*float64(r.avg))
+	}
+}
+
+func (r *rttStats) get() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return r.avg
+}
+
+// measure wraps cli to track an exponentially-weighted moving average of its latency, and the consecutive failures.
+func (c *DNSClient) measure(upstream string, cli dnsClient) dnsClient {
+	val, _ := c.rtt.LoadOrStore(upstream, new(rttStats))
+	stats := val.(*rttStats)
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		start := time.Now()
+		ans, err := cli(ctx, name, qtype)
+		if !isUpstreamFailure(err) {
+			elapsed := time.Since(start)
+			stats.observe(elapsed, c.rttAlpha)
+			logger.Module("client.rtt").Debug().Str("upstream", upstream).Dur("rtt", elapsed).Dur("avg", stats.get()).Send()
+			atomic.StoreInt64(&stats.failures, 0)
+		} else {
+			atomic.AddInt64(&stats.failures, 1)
+		}
+		return ans, err
+	}
+}
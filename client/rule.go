@@ -0,0 +1,82 @@
+package client
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// AddRule forwards domain to server at runtime, for the default view.
+// It takes precedence over the rule from config, until RemoveRule.
+func (c *DNSClient) AddRule(domain string, server config.Server) error {
+	domain = dns.Fqdn(strings.ToLower(domain))
+
+	parsed, err := url.Parse(server.DNS)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme == "ipv4" || parsed.Scheme == "ipv6" {
+		return errors.New("static IP is not supported: " + server.DNS)
+	}
+	up, err := c.newUpstream(server)
+	if err != nil {
+		return err
+	}
+	if !up.encrypted && c.isPrivate(domain) {
+		return errors.New("private domain with plaintext upstream: " + domain)
+	}
+
+	logger.Module("client").Info().Str("domain", domain).Str("dns", server.DNS).Msg("add rule")
+	c.rules.Lock()
+	c.view.router.node(domain).override = up
+	c.updateRouted()
+	c.rules.Unlock()
+
+	c.invalidate(domain)
+	return nil
+}
+
+// RemoveRule removes the rule added by AddRule, the rule from config is restored.
+func (c *DNSClient) RemoveRule(domain string) {
+	domain = dns.Fqdn(strings.ToLower(domain))
+
+	logger.Module("client").Info().Str("domain", domain).Msg("remove rule")
+	c.rules.Lock()
+	c.view.router.node(domain).override = nil
+	c.updateRouted()
+	c.rules.Unlock()
+
+	c.invalidate(domain)
+}
+
+// invalidate removes the cached answers of domain and its subdomains.
+func (c *DNSClient) invalidate(domain string) {
+	suffix := strings.TrimPrefix(domain, "*.")
+	c.cache.Range(func(key, _ interface{}) bool {
+		k := key.(string)
+		if !strings.HasPrefix(k, c.cachePrefix) {
+			return true
+		}
+		if c.cacheKeyFunc != nil || suffix == "." {
+			// unknown key format
+			c.cache.Delete(k)
+			return true
+		}
+		name := k[len(c.cachePrefix):]
+		if idx := strings.LastIndexByte(name, '|'); idx >= 0 {
+			name = name[:idx]
+		}
+		if idx := strings.LastIndexAny(name, "#@"); idx >= 0 {
+			name = name[idx+1:]
+		}
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			c.cache.Delete(k)
+		}
+		return true
+	})
+}
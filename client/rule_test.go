@@ -0,0 +1,107 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestRule(t *testing.T) {
+	configured := startServer(t, "udp", answerA("1.1.1.1"))
+	added := startServer(t, "udp", answerA("2.2.2.2"))
+
+	c := new(DNSClient)
+	c.Init(&config.Config{Forward: []config.Server{
+		{DNS: "udp://" + configured, Domain: []string{"example.com", "example.net"}},
+	}})
+	defer c.Close()
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T)
+		// whether cached after change, before queried
+		cached map[string]bool
+		want   map[string]string
+	}{
+		{
+			name:   "configured",
+			change: func(t *testing.T) {},
+			want:   map[string]string{"www.example.com.": "1.1.1.1", "example.com.": "1.1.1.1", "www.example.net.": "1.1.1.1"},
+		},
+		{
+			name: "add rule",
+			change: func(t *testing.T) {
+				if err := c.AddRule("WWW.Example.com", config.Server{DNS: "udp://" + added}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			cached: map[string]bool{"www.example.com.": false, "example.com.": true, "www.example.net.": true},
+			want:   map[string]string{"www.example.com.": "2.2.2.2", "a.www.example.com.": "2.2.2.2", "example.com.": "1.1.1.1"},
+		},
+		{
+			name:   "remove rule",
+			change: func(t *testing.T) { c.RemoveRule("www.example.com") },
+			cached: map[string]bool{"www.example.com.": false, "a.www.example.com.": false, "example.com.": true},
+			want:   map[string]string{"www.example.com.": "1.1.1.1", "a.www.example.com.": "1.1.1.1"},
+		},
+		{
+			name: "add wildcard rule",
+			change: func(t *testing.T) {
+				if err := c.AddRule("*.example.com", config.Server{DNS: "udp://" + added}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			cached: map[string]bool{"www.example.com.": false, "a.www.example.com.": false, "www.example.net.": true},
+			want:   map[string]string{"www.example.com.": "2.2.2.2", "www.example.net.": "1.1.1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change(t)
+			for name, cached := range tt.cached {
+				if got := c.Explain(name, dns.TypeA).Cached; got != cached {
+					t.Errorf("%s cached = %v, want %v", name, got, cached)
+				}
+			}
+			for name, want := range tt.want {
+				if ans := c.Query(name, dns.TypeA); len(ans) != 1 || ans[0].Data != want {
+					t.Errorf("%s got %v, want %s", name, ans, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAddRuleInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		server config.Server
+	}{
+		{name: "static IP", domain: "corp.example.com", server: config.Server{DNS: "ipv4://1.1.1.1"}},
+		{name: "unsupported scheme", domain: "corp.example.com", server: config.Server{DNS: "ftp://1.1.1.1"}},
+		{name: "invalid url", domain: "corp.example.com", server: config.Server{DNS: "udp://[::1"}},
+		{name: "private domain with plaintext", domain: "corp.example.com", server: config.Server{DNS: "udp://1.1.1.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{
+				Private: []string{"corp.example.com"},
+				Forward: []config.Server{{DNS: "ipv4://1.1.1.1", Domain: []string{"corp.example.com"}}},
+			})
+			defer c.Close()
+
+			if err := c.AddRule(tt.domain, tt.server); err == nil {
+				t.Fatal("want error")
+			}
+			for _, route := range c.DumpRoutes() {
+				if route.Runtime {
+					t.Errorf("rule added, got %v", route)
+				}
+			}
+		})
+	}
+}
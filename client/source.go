@@ -0,0 +1,69 @@
+package client
+
+import (
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// The local sources answering before cache and upstream.
+const (
+	localStatic  = "static"
+	localZone    = "zone"
+	localPTR     = "privatePTR"
+	localSpecial = "specialNames"
+)
+
+var defaultLocalSources = []string{localStatic, localZone, localPTR, localSpecial}
+
+func compileSources(sources []string) []string {
+	if len(sources) == 0 {
+		return defaultLocalSources
+	}
+	seen := make(map[string]bool)
+	for _, source := range sources {
+		switch source {
+		case localStatic, localZone, localPTR, localSpecial:
+		default:
+			logger.Module("client").Error().Str("source", source).Msg("invalid config")
+			panic("unsupported source: " + source)
+		}
+		if seen[source] {
+			logger.Module("client").Error().Str("source", source).Msg("invalid config")
+			panic("duplicated source: " + source)
+		}
+		seen[source] = true
+	}
+	return sources
+}
+
+// localAnswer consults the local sources in the configured order, the first one having the name wins.
+// A source not listed is not consulted. The source answered is returned, e.g. localZone.
+func (c *DNSClient) localAnswer(view *dnsView, name string, qtype uint16, opts QueryOptions) (Result, string, bool) {
+	sources := c.sources
+	if sources == nil {
+		sources = defaultLocalSources
+	}
+	for _, source := range sources {
+		switch source {
+		case localStatic:
+			if opts.SkipStatic {
+				continue
+			}
+			if ans, found := view.static(name, qtype); found {
+				return Result{Answer: ans, FromStatic: true}, source, true
+			}
+		case localZone:
+			if r, found := view.zone(name, qtype); found {
+				return r, source, true
+			}
+		case localPTR:
+			if r, found := c.privatePTR(name, qtype); found {
+				return r, source, true
+			}
+		case localSpecial:
+			if r, found := c.specialName(name, qtype); found {
+				return r, source, true
+			}
+		}
+	}
+	return Result{}, "", false
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zone := writeZone(t, dir, "example.zone", "2.2.2.2")
+
+	type check struct {
+		query string
+		rcode int
+		data  string
+	}
+	var (
+		fromStatic  = check{query: "www.example.com.", data: "1.1.1.1"}
+		fromZone    = check{query: "www.example.com.", data: "2.2.2.2"}
+		noZone      = check{query: "www.example.com."}
+		staticOnly  = check{query: "static.example.org.", data: "3.3.3.3"}
+		noStatic    = check{query: "static.example.org."}
+		fromPTR     = check{query: "1.0.168.192.in-addr.arpa.", rcode: dns.RcodeNameError}
+		noPTR       = check{query: "1.0.168.192.in-addr.arpa."}
+		fromSpecial = check{query: "localhost.", data: "127.0.0.1"}
+		noSpecial   = check{query: "localhost."}
+	)
+	tests := []struct {
+		name    string
+		sources []string
+		checks  []check
+	}{
+		{name: "default", checks: []check{fromStatic, staticOnly, fromPTR, fromSpecial}},
+		{name: "zone first", sources: []string{"zone", "static"}, checks: []check{fromZone, staticOnly, noPTR, noSpecial}},
+		{name: "zone only", sources: []string{"zone"}, checks: []check{fromZone, noStatic}},
+		{name: "static only", sources: []string{"static"}, checks: []check{fromStatic, noPTR, noSpecial}},
+		{name: "no zone", sources: []string{"privatePTR", "specialNames"}, checks: []check{noZone, noStatic, fromPTR, fromSpecial}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{
+				Sources:    tt.sources,
+				PrivatePTR: privatePTRNXDOMAIN,
+				Forward: []config.Server{
+					{DNS: "ipv4://1.1.1.1", Domain: []string{"www.example.com"}},
+					{DNS: "ipv4://3.3.3.3", Domain: []string{"static.example.org"}},
+					{DNS: "zone://" + zone, Domain: []string{"example.com"}},
+				},
+			})
+			defer c.Close()
+
+			for _, check := range tt.checks {
+				qtype := dns.TypeA
+				if check.query == fromPTR.query {
+					qtype = dns.TypePTR
+				}
+				r := c.ResolveWithMeta(context.Background(), check.query, qtype)
+				data := ""
+				if len(r.Answer) > 0 {
+					data = r.Answer[0].Data
+				}
+				if r.Rcode != check.rcode || data != check.data {
+					t.Errorf("%s got %s %q, want %s %q", check.query, dns.RcodeToString[r.Rcode], data, dns.RcodeToString[check.rcode], check.data)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []string
+		want    []string
+		panics  bool
+	}{
+		{name: "default", want: defaultLocalSources},
+		{name: "reordered", sources: []string{"specialNames", "static"}, want: []string{"specialNames", "static"}},
+		{name: "unsupported", sources: []string{"static", "cache"}, panics: true},
+		{name: "duplicated", sources: []string{"zone", "static", "zone"}, panics: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != tt.panics {
+					t.Errorf("panic = %v, want %v", r, tt.panics)
+				}
+			}()
+			if got := compileSources(tt.sources); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
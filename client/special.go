@@ -0,0 +1,97 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// Answers of special-use names, RFC 6761
+const (
+	specialLoopback = "loopback"
+	specialNXDOMAIN = "nxdomain"
+	// only for ".", its NS query is answered with the root servers (RFC 8109), the other queries of "." are forwarded
+	specialRoot = "root"
+	// sent to upstream as usual, to override a default
+	specialForward = "forward"
+)
+
+var defaultSpecialNames = map[string]string{
+	".":          specialRoot,
+	"localhost.": specialLoopback,
+	"invalid.":   specialNXDOMAIN,
+}
+
+// rootServers are the names of the root servers, without glue addresses.
+var rootServers = [...]string{
+	"a.root-servers.net.", "b.root-servers.net.", "c.root-servers.net.", "d.root-servers.net.",
+	"e.root-servers.net.", "f.root-servers.net.", "g.root-servers.net.", "h.root-servers.net.",
+	"i.root-servers.net.", "j.root-servers.net.", "k.root-servers.net.", "l.root-servers.net.",
+	"m.root-servers.net.",
+}
+
+// the TTL of the root NS records in the root zone
+const rootNSTTL = 518400
+
+func compileSpecialNames(names map[string]string) map[string]string {
+	special := make(map[string]string)
+	for name, action := range defaultSpecialNames {
+		special[name] = action
+	}
+	for name, action := range names {
+		name = dns.Fqdn(strings.ToLower(name))
+		if (name == ".") != (action == specialRoot) && action != specialForward {
+			logger.Module("client").Error().Str("name", name).Str("action", action).Msg("invalid config")
+			panic("special name action " + action + " of " + name)
+		}
+		switch action {
+		case specialLoopback, specialNXDOMAIN, specialRoot:
+			special[name] = action
+		case specialForward:
+			delete(special, name)
+		default:
+			logger.Module("client").Error().Str("name", name).Str("action", action).Msg("invalid config")
+			panic("unsupported special name action: " + action)
+		}
+	}
+	return special
+}
+
+// specialName answers the special-use domains and their subdomains locally, before routing.
+func (c *DNSClient) specialName(name string, qtype uint16) (Result, bool) {
+	if len(c.specialNames) == 0 {
+		return Result{}, false
+	}
+	if name == "." {
+		if c.specialNames[name] != specialRoot || qtype != dns.TypeNS {
+			return Result{}, false
+		}
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Str("special", specialRoot).Msg("special name")
+		answer := make([]Answer, len(rootServers))
+		for idx, server := range rootServers {
+			answer[idx] = Answer{Name: name, Type: dns.TypeNS, TTL: rootNSTTL, Data: server}
+		}
+		return Result{Answer: answer, FromStatic: true}, true
+	}
+	for domain := strings.ToLower(name); domain != "."; domain = parentDomain(domain) {
+		action, found := c.specialNames[domain]
+		if !found {
+			continue
+		}
+		logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Str("special", action).Msg("special name")
+		if action == specialNXDOMAIN {
+			return Result{Rcode: dns.RcodeNameError, FromStatic: true}, true
+		}
+		switch qtype {
+		case dns.TypeA:
+			return Result{Answer: []Answer{{Name: name, Type: qtype, TTL: 60, Data: "127.0.0.1"}}, FromStatic: true}, true
+		case dns.TypeAAAA:
+			return Result{Answer: []Answer{{Name: name, Type: qtype, TTL: 60, Data: "::1"}}, FromStatic: true}, true
+		default:
+			return Result{FromStatic: true}, true
+		}
+	}
+	return Result{}, false
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestSpecialName(t *testing.T) {
+	tests := []struct {
+		name    string
+		special map[string]string
+		query   string
+		qtype   uint16
+		// answered locally, with the rcode and the data of answers
+		local bool
+		rcode int
+		data  []string
+	}{
+		{name: "localhost A", query: "localhost.", qtype: dns.TypeA, local: true, data: []string{"127.0.0.1"}},
+		{name: "localhost AAAA", query: "localhost.", qtype: dns.TypeAAAA, local: true, data: []string{"::1"}},
+		{name: "localhost subdomain", query: "www.LOCALHOST.", qtype: dns.TypeA, local: true, data: []string{"127.0.0.1"}},
+		{name: "localhost other type", query: "localhost.", qtype: dns.TypeMX, local: true},
+		{name: "invalid", query: "invalid.", qtype: dns.TypeA, local: true, rcode: dns.RcodeNameError},
+		{name: "invalid subdomain", query: "www.invalid.", qtype: dns.TypeAAAA, local: true, rcode: dns.RcodeNameError},
+		{name: "root NS", query: ".", qtype: dns.TypeNS, local: true, data: rootServers[:]},
+		{name: "root other type", query: ".", qtype: dns.TypeSOA},
+		{name: "other name", query: "example.com.", qtype: dns.TypeA},
+		{name: "added", special: map[string]string{"onion": "nxdomain"}, query: "www.onion.", qtype: dns.TypeA, local: true, rcode: dns.RcodeNameError},
+		{name: "forwarded", special: map[string]string{"localhost": "forward"}, query: "localhost.", qtype: dns.TypeA},
+		{name: "root forwarded", special: map[string]string{".": "forward"}, query: ".", qtype: dns.TypeNS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{SpecialNames: tt.special})
+			r := c.ResolveWithMeta(context.Background(), tt.query, tt.qtype)
+			if r.FromStatic != tt.local {
+				t.Fatalf("local = %v, want %v", r.FromStatic, tt.local)
+			}
+			if !tt.local {
+				return
+			}
+			if r.Rcode != tt.rcode || len(r.Answer) != len(tt.data) {
+				t.Fatalf("got %v %v, want %v %v", dns.RcodeToString[r.Rcode], r.Answer, dns.RcodeToString[tt.rcode], tt.data)
+			}
+			for idx, ans := range r.Answer {
+				if ans.Name != dns.Fqdn(tt.query) || ans.Type != tt.qtype || ans.Data != tt.data[idx] {
+					t.Errorf("got %v, want %v", ans, tt.data[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestSpecialNameConfig(t *testing.T) {
+	tests := []struct {
+		special map[string]string
+		valid   bool
+	}{
+		{special: map[string]string{"onion": "nxdomain", "test": "loopback"}, valid: true},
+		{special: map[string]string{".": "forward"}, valid: true},
+		{special: map[string]string{".": "nxdomain"}},
+		{special: map[string]string{"example": "root"}},
+		{special: map[string]string{"example": "drop"}},
+	}
+	for _, tt := range tests {
+		valid := true
+		func() {
+			defer func() {
+				if recover() != nil {
+					valid = false
+				}
+			}()
+			compileSpecialNames(tt.special)
+		}()
+		if valid != tt.valid {
+			t.Errorf("%v: valid = %v, want %v", tt.special, valid, tt.valid)
+		}
+	}
+}
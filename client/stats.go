@@ -0,0 +1,119 @@
+package client
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The upper bounds of histogram buckets, the last bucket is unbounded.
+var (
+	answerCountBounds  = [...]int{0, 1, 2, 4, 8, 16, 32}
+	responseSizeBounds = [...]int{128, 256, 512, 1232, 4096}
+)
+
+type dnsStats struct {
+	refused        uint64
+	fallback       uint64
+	mirrorMismatch uint64
+	pruned         uint64
+	dohRetries     uint64
+	answerCounts   [len(answerCountBounds) + 1]uint64
+	responseSizes  [len(responseSizeBounds) + 1]uint64
+}
+
+type Stats struct {
+	// The number of queries refused in strict mode.
+	Refused uint64 `json:"refused"`
+	// The number of queries sent to fallback upstreams.
+	Fallback uint64 `json:"fallback"`
+	// The number of queries answered differently by shadow upstreams of mirror.
+	MirrorMismatch uint64 `json:"mirrorMismatch"`
+	// The moving average of latency, by upstream.
+	Upstreams map[string]UpstreamStats `json:"upstreams"`
+	// The number of expired cache entries removed by pruneInterval.
+	Pruned uint64 `json:"pruned"`
+	// All upstreams are down, and queries are answered from cache only.
+	Offline bool `json:"offline"`
+	// The number of open TCP/DoT connections in the process, shared by all DNSClients.
+	ProcessOpenConns int64 `json:"processOpenConns"`
+	// The number of DoH requests retried.
+	DoHRetries uint64 `json:"dohRetries"`
+	// The number of answers per response, and the approximate size of responses in bytes.
+	AnswerCounts  Histogram `json:"answerCounts"`
+	ResponseSizes Histogram `json:"responseSizes"`
+}
+
+// Histogram counts the observed values by bucket. Counts[i] is of values in (Bounds[i-1], Bounds[i]],
+// and the last one is of values greater than all bounds.
+type Histogram struct {
+	Bounds []int    `json:"bounds"`
+	Counts []uint64 `json:"counts"`
+}
+
+func newHistogram(bounds []int, counts []uint64) Histogram {
+	h := Histogram{Bounds: bounds, Counts: make([]uint64, len(counts))}
+	for idx := range counts {
+		h.Counts[idx] = atomic.LoadUint64(&counts[idx])
+	}
+	return h
+}
+
+func observe(bounds []int, counts []uint64, val int) {
+	atomic.AddUint64(&counts[sort.SearchInts(bounds, val)], 1)
+}
+
+// observeResponse records the number of answers, and the response size approximated without name compression.
+func (c *DNSClient) observeResponse(name string, answer []Answer) {
+	size := 12 + len(name) + 1 + 4 // header and question
+	for _, ans := range answer {
+		size += len(ans.Name) + 1 + 10
+		switch ans.Type {
+		case dns.TypeA:
+			size += net.IPv4len
+		case dns.TypeAAAA:
+			size += net.IPv6len
+		default:
+			size += len(ans.Data) + 1
+		}
+	}
+	observe(answerCountBounds[:], c.stats.answerCounts[:], len(answer))
+	observe(responseSizeBounds[:], c.stats.responseSizes[:], size)
+}
+
+type UpstreamStats struct {
+	RTT time.Duration `json:"rtt"`
+	// "closed", "open" or "half-open", empty without breaker_after
+	Breaker string `json:"breaker,omitempty"`
+}
+
+func (c *DNSClient) Stats() Stats {
+	upstreams := make(map[string]UpstreamStats)
+	c.rtt.Range(func(key, val interface{}) bool {
+		stats := val.(*rttStats)
+		up := UpstreamStats{RTT: stats.get()}
+		stats.Lock()
+		if stats.breaker != nil {
+			up.Breaker = stats.breaker.String()
+		}
+		stats.Unlock()
+		upstreams[key.(string)] = up
+		return true
+	})
+
+	return Stats{
+		Refused:          atomic.LoadUint64(&c.stats.refused),
+		Fallback:         atomic.LoadUint64(&c.stats.fallback),
+		MirrorMismatch:   atomic.LoadUint64(&c.stats.mirrorMismatch),
+		Upstreams:        upstreams,
+		Pruned:           atomic.LoadUint64(&c.stats.pruned),
+		Offline:          c.isOffline(),
+		ProcessOpenConns: atomic.LoadInt64(&processOpenConns),
+		DoHRetries:       atomic.LoadUint64(&c.stats.dohRetries),
+		AnswerCounts:     newHistogram(answerCountBounds[:], c.stats.answerCounts[:]),
+		ResponseSizes:    newHistogram(responseSizeBounds[:], c.stats.responseSizes[:]),
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestObserve(t *testing.T) {
+	bounds := []int{0, 1, 4}
+	tests := []struct {
+		name   string
+		val    int
+		bucket int
+	}{
+		{name: "first bound", val: 0, bucket: 0},
+		{name: "bound is inclusive", val: 1, bucket: 1},
+		{name: "between bounds", val: 3, bucket: 2},
+		{name: "last bound", val: 4, bucket: 2},
+		{name: "unbounded", val: 5, bucket: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := make([]uint64, len(bounds)+1)
+			observe(bounds, counts, tt.val)
+			want := make([]uint64, len(bounds)+1)
+			want[tt.bucket] = 1
+			if !reflect.DeepEqual(counts, want) {
+				t.Errorf("got %v, want %v", counts, want)
+			}
+		})
+	}
+}
+
+func TestObserveResponse(t *testing.T) {
+	addresses := func(n int, qtype uint16, data string) []Answer {
+		var ans []Answer
+		for i := 0; i < n; i++ {
+			ans = append(ans, Answer{Name: "example.com.", Type: qtype, TTL: 60, Data: data})
+		}
+		return ans
+	}
+	tests := []struct {
+		name   string
+		answer []Answer
+		// the buckets of answerCountBounds and responseSizeBounds
+		count int
+		size  int
+	}{
+		{name: "no answer", count: 0, size: 0},
+		{name: "one A", answer: addresses(1, dns.TypeA, "1.1.1.1"), count: 1, size: 0},
+		{name: "four A", answer: addresses(4, dns.TypeA, "1.1.1.1"), count: 3, size: 1},
+		{name: "eight AAAA", answer: addresses(8, dns.TypeAAAA, "2001:db8::1"), count: 4, size: 2},
+		{name: "long TXT", answer: addresses(1, dns.TypeTXT, `"`+strings.Repeat("a", 600)+`"`), count: 1, size: 3},
+		{name: "many answers", answer: addresses(40, dns.TypeAAAA, "2001:db8::1"), count: 7, size: 4},
+		{name: "large TXT", answer: addresses(20, dns.TypeTXT, `"`+strings.Repeat("a", 250)+`"`), count: 6, size: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.observeResponse("example.com.", tt.answer)
+			stats := c.Stats()
+			counts := make([]uint64, len(answerCountBounds)+1)
+			counts[tt.count] = 1
+			sizes := make([]uint64, len(responseSizeBounds)+1)
+			sizes[tt.size] = 1
+			if !reflect.DeepEqual(stats.AnswerCounts.Counts, counts) || !reflect.DeepEqual(stats.AnswerCounts.Bounds, answerCountBounds[:]) {
+				t.Errorf("got answer counts %+v, want %v", stats.AnswerCounts, counts)
+			}
+			if !reflect.DeepEqual(stats.ResponseSizes.Counts, sizes) || !reflect.DeepEqual(stats.ResponseSizes.Bounds, responseSizeBounds[:]) {
+				t.Errorf("got response sizes %+v, want %v", stats.ResponseSizes, sizes)
+			}
+		})
+	}
+}
+
+func TestStatsHistogram(t *testing.T) {
+	c := new(DNSClient)
+	c.Init(&config.Config{Forward: []config.Server{
+		{DNS: "ipv4://1.1.1.1", Domain: []string{"example.com"}},
+	}})
+	defer c.Close()
+
+	c.Query("example.com.", dns.TypeA)
+	c.Query("example.com.", dns.TypeA)
+	c.Query("example.com.", dns.TypeMX)
+
+	if got, want := c.Stats().AnswerCounts.Counts, []uint64{1, 2, 0, 0, 0, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got answer counts %v, want %v", got, want)
+	}
+	if got, want := c.Stats().ResponseSizes.Counts, []uint64{3, 0, 0, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got response sizes %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// thenPublic queries the public upstream if the primary doesn't have the domain, e.g. for overlay network.
+func thenPublic(primaryDNS string, primary dnsClient, public *upstream) dnsClient {
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		ans, err := primary(ctx, name, qtype)
+		if err != rcodeError(dns.RcodeNameError) {
+			return ans, err
+		}
+		logger.Module("client.strategy").Debug().Str("upstream", primaryDNS).Str("public", public.dns).Str("domain", name).Uint16("type", qtype).Msg("NXDOMAIN, then public")
+		return public.query(ctx, name, qtype)
+	}
+}
+
+// mirror serves the primary, and compares the answers of the shadow upstream in background, e.g. to validate a new upstream.
+// Discrepancies are logged by client.mirror, and counted in stats.
+func (c *DNSClient) mirror(primaryDNS string, primary dnsClient, shadow *upstream) dnsClient {
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		shadowed := make(chan struct{})
+		var shadowAns []Answer
+		var shadowErr error
+		go func() {
+			shadowAns, shadowErr = shadow.query(ctx, name, qtype)
+			close(shadowed)
+		}()
+
+		ans, err := primary(ctx, name, qtype)
+
+		// the answers are modified in place after returned, e.g. by normalize and cacheSet
+		primaryAns := append([]Answer(nil), ans...)
+		go func() {
+			<-shadowed
+			if answerSet(primaryAns, err) == answerSet(shadowAns, shadowErr) {
+				return
+			}
+			atomic.AddUint64(&c.stats.mirrorMismatch, 1)
+			logger.Module("client.mirror").Warn().
+				Str("domain", name).
+				Uint16("type", qtype).
+				Str("upstream", primaryDNS).
+				Str("answer", answerSet(primaryAns, err)).
+				Str("shadow", shadow.dns).
+				Str("shadowAnswer", answerSet(shadowAns, shadowErr)).
+				Msg("discrepancy")
+		}()
+
+		return ans, err
+	}
+}
+
+// answerSet is the sorted answers without TTL, or the error, to compare responses.
+func answerSet(answer []Answer, err error) string {
+	var ref *referralError
+	if err != nil && !errors.As(err, &ref) {
+		return err.Error()
+	}
+	set := make([]string, 0, len(answer))
+	for _, ans := range answer {
+		set = append(set, strings.ToLower(dns.Fqdn(ans.Name))+" "+dns.Type(ans.Type).String()+" "+ans.Data)
+	}
+	sort.Strings(set)
+	return strings.Join(set, "; ")
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func staticClient(ans []Answer, err error) dnsClient {
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		return append([]Answer(nil), ans...), err
+	}
+}
+
+func TestMirror(t *testing.T) {
+	a1 := Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}
+	a2 := Answer{Name: "example.com.", Type: dns.TypeA, TTL: 300, Data: "2.2.2.2"}
+	errTimeout := errors.New("timeout")
+
+	tests := []struct {
+		name      string
+		primary   []Answer
+		primErr   error
+		shadow    []Answer
+		shadowErr error
+		// modifies the answers after returned, as normalize and cacheSet do
+		mutate   bool
+		mismatch bool
+	}{
+		{name: "same", primary: []Answer{a1, a2}, shadow: []Answer{a1, a2}},
+		{name: "order and ttl ignored", primary: []Answer{a1, a2}, shadow: []Answer{{Name: "EXAMPLE.com", Type: dns.TypeA, TTL: 1, Data: "2.2.2.2"}, a1}},
+		{name: "different", primary: []Answer{a1}, shadow: []Answer{a2}, mismatch: true},
+		{name: "shadow failed", primary: []Answer{a1}, shadowErr: errTimeout, mismatch: true},
+		{name: "same rcode", primErr: rcodeError(dns.RcodeNameError), shadowErr: rcodeError(dns.RcodeNameError)},
+		{name: "different rcode", primErr: rcodeError(dns.RcodeNameError), shadow: []Answer{a1}, mismatch: true},
+		{name: "mutated after returned", primary: []Answer{a1, a2}, shadow: []Answer{a1, a2}, mutate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			shadow := &upstream{dns: "udp://shadow", query: staticClient(tt.shadow, tt.shadowErr)}
+			query := c.mirror("udp://primary", staticClient(tt.primary, tt.primErr), shadow)
+
+			ans, err := query(context.Background(), "example.com.", dns.TypeA)
+			if err != tt.primErr || len(ans) != len(tt.primary) {
+				t.Fatalf("got %v %v, want the primary %v %v", ans, err, tt.primary, tt.primErr)
+			}
+			if tt.mutate {
+				ans[0].Data = "9.9.9.9"
+			}
+
+			deadline := time.Now().Add(200 * time.Millisecond)
+			for atomic.LoadUint64(&c.stats.mirrorMismatch) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := atomic.LoadUint64(&c.stats.mirrorMismatch) == 1; got != tt.mismatch {
+				t.Errorf("mismatch = %v, want %v", got, tt.mismatch)
+			}
+		})
+	}
+}
+
+func TestThenPublic(t *testing.T) {
+	a1 := Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}
+	a2 := Answer{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "2.2.2.2"}
+	errTimeout := errors.New("timeout")
+
+	tests := []struct {
+		name    string
+		primary []Answer
+		primErr error
+		want    []Answer
+		err     error
+		public  bool
+	}{
+		{name: "primary answered", primary: []Answer{a1}, want: []Answer{a1}},
+		{name: "primary has no data", want: nil},
+		{name: "nxdomain then public", primErr: rcodeError(dns.RcodeNameError), want: []Answer{a2}, public: true},
+		{name: "servfail is not retried", primErr: rcodeError(dns.RcodeServerFailure), err: rcodeError(dns.RcodeServerFailure)},
+		{name: "failure is not retried", primErr: errTimeout, err: errTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			public := &upstream{dns: "udp://public", query: func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+				atomic.AddInt32(&calls, 1)
+				return []Answer{a2}, nil
+			}}
+			query := thenPublic("udp://primary", staticClient(tt.primary, tt.primErr), public)
+
+			ans, err := query(context.Background(), "example.com.", dns.TypeA)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if len(ans) != len(tt.want) || (len(ans) == 1 && ans[0] != tt.want[0]) {
+				t.Errorf("got %v, want %v", ans, tt.want)
+			}
+			if (calls == 1) != tt.public {
+				t.Errorf("public queried %d times", calls)
+			}
+		})
+	}
+}
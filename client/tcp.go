@@ -0,0 +1,380 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const defaultIdleTimeout = 10 * time.Second
+
+var tcpClientCache = new(sync.Map)
+
+// tcpClient is the client of tcpClientCache, with its session shared by the DNSClients using it.
+type tcpClient struct {
+	query   dnsClient
+	session *tcpSession
+}
+
+// processOpenConns is the number of TCP/DoT connections of all DNSClients in the process, both in use and idle,
+// since connections are shared through tcpClientCache.
+var processOpenConns int64
+
+func GetTCPClient(tcpServer string, bind string, useTLS bool, idleTimeout time.Duration, timeout queryTimeout, bootstrap *bootstrapResolver, padding int) dnsClient {
+	return getTCPClient(tcpServer, bind, useTLS, idleTimeout, timeout, bootstrap, padding).query
+}
+
+func getTCPClient(tcpServer string, bind string, useTLS bool, idleTimeout time.Duration, timeout queryTimeout, bootstrap *bootstrapResolver, padding int) *tcpClient {
+	serverKey := tcpServer + "-" + bind + "-" + idleTimeout.String() + "-" + timeout.String() + "-" + bootstrap.String() + "-" + strconv.Itoa(padding)
+	if useTLS {
+		serverKey = "tls-" + serverKey
+	}
+	c, found := tcpClientCache.Load(serverKey)
+	if found {
+		return c.(*tcpClient)
+	}
+
+	host, port, err := net.SplitHostPort(tcpServer)
+	if err != nil {
+		panic(err)
+	}
+	pinned := newPinnedHost(host, bootstrap)
+
+	module := "client.tcp"
+	tcpDnsClient := &dns.Client{Net: "tcp"}
+	if useTLS {
+		module = "client.dot"
+		tcpDnsClient.Net = "tcp-tls"
+		tcpDnsClient.TLSConfig = &tls.Config{ServerName: host}
+	}
+	if len(bind) > 0 {
+		tcpDnsClient.Dialer = &net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: net.ParseIP(bind)},
+		}
+	}
+
+	session := &tcpSession{
+		dialer: func(timeout time.Duration) (*dns.Conn, error) {
+			cli := withTimeout(tcpDnsClient, timeout)
+			if pinned == nil {
+				return cli.Dial(tcpServer)
+			}
+			var conn *dns.Conn
+			err := pinned.each(func(ip string) (err error) {
+				conn, err = cli.Dial(net.JoinHostPort(ip, port))
+				return err
+			})
+			return conn, err
+		},
+		idleTimeout: idleTimeout,
+	}
+
+	cc := func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		sublogger := logger.Module(module).With().
+			Str("server", tcpServer).
+			Str("bind", bind).
+			Str("domain", name).
+			Uint16("type", qtype).
+			Logger()
+
+		sublogger.Debug().Msg("query")
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		opt := msg.SetEdns0(dns.DefaultMsgSize, true).IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+		pad(msg, padding)
+
+		in, err := exchangeWithRetry(ctx, timeout, func(attemptTimeout time.Duration) (*dns.Msg, error) {
+			return session.exchange(msg, attemptTimeout)
+		})
+		if err != nil {
+			sublogger.Error().Err(err).Send()
+			return nil, err
+		}
+
+		var ans []Answer
+		for _, rr := range in.Answer {
+			a, err := rr2ans(rr)
+			if err != nil {
+				sublogger.Error().Err(err).Send()
+				continue
+			}
+			ans = append(ans, a)
+		}
+
+		if in.Rcode != dns.RcodeSuccess {
+			// NXDOMAIN may have a CNAME chain
+			sublogger.Debug().Int("rcode", in.Rcode).Send()
+			return ans, rcodeError(in.Rcode)
+		}
+		if err := msgReferral(in); err != nil {
+			sublogger.Debug().Msg("referral")
+			return nil, err
+		}
+		return ans, nil
+	}
+
+	logger.Module(module).Debug().Str("server", tcpServer).Msg("create TCP server")
+	client := &tcpClient{query: cc, session: session}
+	tcpClientCache.Store(serverKey, client)
+	return client
+}
+
+// keepalive returns the idle timeout from the EDNS0 TCP Keepalive option, -1 if absent. RFC 7828
+func keepalive(m *dns.Msg) time.Duration {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return -1
+	}
+	for _, o := range opt.Option {
+		if ka, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok && ka.Length == 2 {
+			return time.Duration(ka.Timeout) * 100 * time.Millisecond
+		}
+	}
+	return -1
+}
+
+///
+
+// tcpSession pipelines concurrent queries on one connection, responses are matched by ID. RFC 7766
+type tcpSession struct {
+	sync.Mutex
+	dialer      func(timeout time.Duration) (*dns.Conn, error)
+	idleTimeout time.Duration
+	conn        *sessionConn
+	refs        int // the DNSClients using the session, see acquire
+}
+
+type sessionConn struct {
+	*dns.Conn
+	session *tcpSession
+	writing sync.Mutex
+
+	sync.Mutex
+	pending  map[uint16]chan *dns.Msg // closed if the connection is closed
+	idle     time.Duration            // closed after being idle for this, updated by keepalive
+	timer    *time.Timer
+	closed   bool
+	lastRead time.Time // of the last response
+}
+
+var errSessionClosed = errors.New("tcp connection closed")
+
+type sessionTimeout struct{}
+
+func (sessionTimeout) Error() string   { return "tcp query timeout" }
+func (sessionTimeout) Timeout() bool   { return true }
+func (sessionTimeout) Temporary() bool { return true }
+
+func (s *tcpSession) exchange(msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	conn, err := s.get(timeout)
+	if err != nil {
+		return nil, err
+	}
+	in, err := conn.exchange(msg, timeout)
+	if err == errSessionClosed {
+		// the connection may be closed by server, or broken as found by another query, retry on a new one
+		conn, err = s.get(timeout)
+		if err != nil {
+			return nil, err
+		}
+		in, err = conn.exchange(msg, timeout)
+	}
+	return in, err
+}
+
+// acquire marks the session used by a DNSClient, until release.
+func (s *tcpSession) acquire() {
+	s.Lock()
+	s.refs++
+	s.Unlock()
+}
+
+// release closes the connection after the last DNSClient using the session is closed, the pending queries fail.
+// A new query opens another one.
+func (s *tcpSession) release() {
+	s.Lock()
+	s.refs--
+	conn := s.conn
+	if s.refs > 0 {
+		conn = nil
+	}
+	s.Unlock()
+	if conn != nil {
+		conn.Lock()
+		conn.closeLocked()
+		conn.Unlock()
+	}
+}
+
+func (s *tcpSession) get(timeout time.Duration) (*sessionConn, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	c, err := s.dialer(timeout)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&processOpenConns, 1)
+	s.conn = &sessionConn{
+		Conn:    c,
+		session: s,
+		pending: make(map[uint16]chan *dns.Msg),
+		idle:    s.idleTimeout,
+	}
+	go s.conn.read()
+	return s.conn, nil
+}
+
+func (conn *sessionConn) exchange(msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	m := msg.Copy()
+	ch := make(chan *dns.Msg, 1)
+
+	conn.Lock()
+	if conn.closed {
+		conn.Unlock()
+		return nil, errSessionClosed
+	}
+	for {
+		m.Id = dns.Id()
+		if _, found := conn.pending[m.Id]; !found {
+			break
+		}
+	}
+	conn.pending[m.Id] = ch
+	if conn.timer != nil {
+		conn.timer.Stop()
+		conn.timer = nil
+	}
+	conn.Unlock()
+
+	conn.writing.Lock()
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := conn.WriteMsg(m)
+	conn.writing.Unlock()
+	if err != nil {
+		conn.Lock()
+		conn.closeLocked()
+		conn.Unlock()
+		return nil, errSessionClosed
+	}
+
+	sent := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case in, ok := <-ch:
+		if !ok {
+			return nil, errSessionClosed
+		}
+		return in, nil
+	case <-timer.C:
+		conn.Lock()
+		defer conn.Unlock()
+		if _, found := conn.pending[m.Id]; !found {
+			// answered or closed meanwhile
+			in, ok := <-ch
+			if !ok {
+				return nil, errSessionClosed
+			}
+			return in, nil
+		}
+		delete(conn.pending, m.Id)
+		if conn.lastRead.Before(sent) {
+			// no response since sent, the connection may be broken, the other queries are retried on a new one
+			conn.closeLocked()
+		} else {
+			// only this query is lost, the others are still answered
+			conn.idleLocked()
+		}
+		return nil, sessionTimeout{}
+	}
+}
+
+// read dispatches responses to the pending queries, until the connection is closed.
+func (conn *sessionConn) read() {
+	for {
+		in, err := conn.ReadMsg()
+		conn.Lock()
+		if err != nil {
+			var malformed *malformedError
+			if errors.As(asMalformed(err), &malformed) {
+				// the stream can't be trusted anymore, the pending queries are retried on a new connection
+				logger.Module("client.tcp").Warn().Err(malformed).Msg("connection closed")
+			} else {
+				logger.Module("client.tcp").Debug().Err(err).Msg("connection closed")
+			}
+			conn.closeLocked()
+			conn.Unlock()
+			return
+		}
+		conn.lastRead = time.Now()
+		if timeout := keepalive(in); timeout >= 0 {
+			conn.idle = timeout
+		}
+		if ch, found := conn.pending[in.Id]; found {
+			delete(conn.pending, in.Id)
+			ch <- in
+		}
+		conn.idleLocked()
+		conn.Unlock()
+	}
+}
+
+// idleLocked closes the connection after being idle for the timeout.
+func (conn *sessionConn) idleLocked() {
+	if conn.closed || len(conn.pending) > 0 {
+		return
+	}
+	if conn.idle == 0 {
+		conn.closeLocked()
+		return
+	}
+	if conn.timer != nil {
+		conn.timer.Stop()
+	}
+	conn.timer = time.AfterFunc(conn.idle, func() {
+		conn.Lock()
+		defer conn.Unlock()
+		// a query may be sent after the timer fired
+		if len(conn.pending) == 0 {
+			conn.closeLocked()
+		}
+	})
+}
+
+func (conn *sessionConn) closeLocked() {
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	conn.Close()
+	atomic.AddInt64(&processOpenConns, -1)
+	for id, ch := range conn.pending {
+		close(ch)
+		delete(conn.pending, id)
+	}
+	if conn.timer != nil {
+		conn.timer.Stop()
+	}
+
+	s := conn.session
+	s.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.Unlock()
+}
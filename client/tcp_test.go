@@ -0,0 +1,147 @@
+package client
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func sessionOpen(s *tcpSession) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.conn != nil
+}
+
+func TestCloseSharedSession(t *testing.T) {
+	addr := startServer(t, "tcp", answerA("1.1.1.1"))
+	forward := config.Server{DNS: "tcp://" + addr, Domain: []string{"."}, IdleTimeout: 60}
+	session := getTCPClient(addr, "", false, idleTimeout(forward), exchangeTimeout(forward), nil, 0).session
+
+	tests := []struct {
+		name string
+		// the clients to close, by index
+		close []int
+		open  bool
+	}{
+		{name: "none closed", open: true},
+		{name: "one closed", close: []int{0}, open: true},
+		{name: "closed twice", close: []int{0, 0}, open: true},
+		{name: "all closed", close: []int{0, 1}, open: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := []*DNSClient{new(DNSClient), new(DNSClient)}
+			for _, c := range clients {
+				c.Init(&config.Config{Forward: []config.Server{forward}})
+				if ans := c.Query("example.com.", dns.TypeA); len(ans) != 1 {
+					t.Fatalf("got %v", ans)
+				}
+			}
+			defer func() {
+				for _, c := range clients {
+					c.Close()
+				}
+			}()
+
+			for _, idx := range tt.close {
+				clients[idx].Close()
+			}
+			if open := sessionOpen(session); open != tt.open {
+				t.Errorf("connection open = %v, want %v", open, tt.open)
+			}
+		})
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	const slow = "slow.example.com."
+	tests := []struct {
+		name string
+		// whether the server answers the other queries
+		answer bool
+		open   bool
+	}{
+		{name: "only the query lost", answer: true, open: true},
+		{name: "no response", answer: false, open: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer := int32(1)
+			addr := startServer(t, "tcp", func(w dns.ResponseWriter, r *dns.Msg) {
+				if r.Question[0].Name == slow || atomic.LoadInt32(&answer) == 0 {
+					return
+				}
+				answerA("1.1.1.1")(w, r)
+			})
+			session := getTCPClient(addr, "", false, time.Minute, defaultQueryTimeout, nil, 0).session
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if _, err := session.exchange(q, time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.answer {
+				atomic.StoreInt32(&answer, 0)
+			}
+
+			timedOut := make(chan error, 1)
+			go func() {
+				m := new(dns.Msg)
+				m.SetQuestion(slow, dns.TypeA)
+				_, err := session.exchange(m, 100*time.Millisecond)
+				timedOut <- err
+			}()
+			// pipelined on the same connection, before and after the slow query times out
+			for i := 0; i < 4 && tt.answer; i++ {
+				if _, err := session.exchange(q, time.Second); err != nil {
+					t.Errorf("query %d: %v", i, err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if err := <-timedOut; err != (sessionTimeout{}) {
+				t.Errorf("got %v, want timeout", err)
+			}
+			if open := sessionOpen(session); open != tt.open {
+				t.Errorf("connection open = %v, want %v", open, tt.open)
+			}
+		})
+	}
+}
+
+func TestForceTCP(t *testing.T) {
+	tests := []struct {
+		name     string
+		forceTCP bool
+		network  string
+	}{
+		{name: "udp", network: "udp"},
+		{name: "force_tcp", forceTCP: true, network: "tcp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries int32
+			addr := startServer(t, tt.network, func(w dns.ResponseWriter, r *dns.Msg) {
+				atomic.AddInt32(&queries, 1)
+				answerA("1.1.1.1")(w, r)
+			})
+			c := new(DNSClient)
+			c.Init(&config.Config{Forward: []config.Server{
+				{DNS: "udp://" + addr, Domain: []string{"example.com"}, ForceTCP: tt.forceTCP, AttemptTimeout: 200},
+			}})
+			defer c.Close()
+
+			// a small answer, not truncated over UDP
+			ans := c.Query("example.com.", dns.TypeA)
+			if len(ans) != 1 || ans[0].Data != "1.1.1.1" {
+				t.Errorf("got %v", ans)
+			}
+			if got := atomic.LoadInt32(&queries); got != 1 {
+				t.Errorf("%d queries over %s, want 1", got, tt.network)
+			}
+		})
+	}
+}
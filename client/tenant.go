@@ -0,0 +1,33 @@
+package client
+
+import (
+	"context"
+	"strings"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose queries use a cache partition separated from other tenants.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// FlushTenant removes all cached answers of the tenant.
+func (c *DNSClient) FlushTenant(tenant string) {
+	logger.Module("client.cache").Info().Str("tenant", tenant).Msg("flush")
+
+	prefix := c.cachePrefix + tenant + "#"
+	c.cache.Range(func(key, _ interface{}) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			c.cache.Delete(key)
+		}
+		return true
+	})
+}
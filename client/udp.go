@@ -1,58 +1,116 @@
 package client
 
 import (
-	"strings"
+	"context"
+	"errors"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
-	"github.com/rs/zerolog/log"
+
+	"github.com/dhcmrlchtdj/dns/logger"
 )
 
 var udpClientCache = new(sync.Map)
 
-func GetUDPClient(udpServer string) dnsClient {
-	c, found := dohClientCache.Load(udpServer)
+// The EDNS payload size advertised to upstream, to avoid IP fragmentation. A truncated response is retried over TCP.
+const upstreamUDPSize = 1232
+
+func GetUDPClient(udpServer string, bind string, cookie bool, timeout queryTimeout) dnsClient {
+	serverKey := udpServer + "-" + bind + "-" + timeout.String()
+	if cookie {
+		serverKey = "cookie-" + serverKey
+	}
+	c, found := udpClientCache.Load(serverKey)
 	if found {
 		return c.(dnsClient)
 	}
 
-	cc := func(name string, qtype uint16) []Answer {
-		sublogger := log.With().
-			Str("module", "client.udp").
+	udpDnsClient := new(dns.Client)
+	tcpDnsClient := &dns.Client{Net: "tcp"}
+	if len(bind) > 0 {
+		udpDnsClient.Dialer = &net.Dialer{
+			LocalAddr: &net.UDPAddr{IP: net.ParseIP(bind)},
+		}
+		tcpDnsClient.Dialer = &net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: net.ParseIP(bind)},
+		}
+	}
+
+	var udpCookie *dnsCookie
+	if cookie {
+		udpCookie = newDNSCookie()
+	}
+
+	cc := func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		sublogger := logger.Module("client.udp").With().
 			Str("server", udpServer).
+			Str("bind", bind).
 			Str("domain", name).
 			Uint16("type", qtype).
 			Logger()
 
 		sublogger.Debug().Msg("query")
 
-		msg := new(dns.Msg)
-		msg.SetQuestion(name, qtype)
-		in, err := dns.Exchange(msg, udpServer)
+		exchange := func(dnsClient *dns.Client) (*dns.Msg, error) {
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, qtype)
+			msg.SetEdns0(upstreamUDPSize, true)
+			if udpCookie != nil {
+				udpCookie.attach(msg)
+			}
+			in, err := exchangeWithRetry(ctx, timeout, func(attemptTimeout time.Duration) (*dns.Msg, error) {
+				cli := withTimeout(dnsClient, attemptTimeout)
+				in, _, err := cli.Exchange(msg, udpServer)
+				return in, asMalformed(err)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if udpCookie != nil && !udpCookie.verify(in) {
+				return nil, errors.New("cookie mismatch")
+			}
+			return in, nil
+		}
+
+		in, err := exchange(udpDnsClient)
+		if err == nil && udpCookie != nil && in.Rcode == dns.RcodeBadCookie {
+			// retry with the server cookie just learned
+			in, err = exchange(udpDnsClient)
+		}
+		if err == nil && in.Truncated {
+			sublogger.Debug().Msg("truncated, retry over TCP")
+			in, err = exchange(tcpDnsClient)
+		}
 		if err != nil {
 			sublogger.Error().Err(err).Send()
-			return nil
+			return nil, err
 		}
 
 		var ans []Answer
 		for _, rr := range in.Answer {
-			ans = append(ans, rr2ans(rr))
+			a, err := rr2ans(rr)
+			if err != nil {
+				sublogger.Error().Err(err).Send()
+				continue
+			}
+			ans = append(ans, a)
 		}
-		return ans
+
+		if in.Rcode != dns.RcodeSuccess {
+			// NXDOMAIN may have a CNAME chain
+			sublogger.Debug().Int("rcode", in.Rcode).Send()
+			return ans, rcodeError(in.Rcode)
+		}
+		if err := msgReferral(in); err != nil {
+			sublogger.Debug().Msg("referral")
+			return nil, err
+		}
+		return ans, nil
 	}
 
-	log.Debug().Str("module", "client.udp").Str("server", udpServer).Msg("create UDP server")
-	udpClientCache.Store(udpServer, cc)
+	logger.Module("client.udp").Debug().Str("server", udpServer).Msg("create UDP server")
+	udpClientCache.Store(serverKey, dnsClient(cc))
 	return cc
 }
-
-func rr2ans(rr dns.RR) Answer {
-	hd := rr.Header()
-	var a Answer
-	a.Name = hd.Name
-	a.Type = hd.Rrtype
-	a.TTL = int(hd.Ttl)
-	// TODO: how to extract Data from RR
-	a.Data = strings.TrimSpace(rr.String()[len(hd.String()):])
-	return a
-}
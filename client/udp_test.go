@@ -0,0 +1,69 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestUDPTruncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers int
+		tcp     int32
+	}{
+		{name: "fits", answers: 10},
+		{name: "retried over tcp", answers: 100, tcp: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var udpSize uint32
+			var tcpQueries int32
+			handler := func(w dns.ResponseWriter, r *dns.Msg) {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				for i := 0; i < tt.answers; i++ {
+					rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 10.0.0." + strconv.Itoa(i))
+					m.Answer = append(m.Answer, rr)
+				}
+				if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+					atomic.AddInt32(&tcpQueries, 1)
+				} else if opt := r.IsEdns0(); opt != nil {
+					atomic.StoreUint32(&udpSize, uint32(opt.UDPSize()))
+					m.Truncate(int(opt.UDPSize()))
+				} else {
+					m.Truncate(dns.MinMsgSize)
+				}
+				w.WriteMsg(m)
+			}
+			addr := startServer(t, "udp", handler)
+			// the TCP server on the same address
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Skip(err)
+			}
+			tcpServer := &dns.Server{Listener: l, Handler: dns.HandlerFunc(handler)}
+			go tcpServer.ActivateAndServe()
+			defer tcpServer.Shutdown()
+
+			c := new(DNSClient)
+			c.Init(&config.Config{Forward: []config.Server{{DNS: "udp://" + addr, Domain: []string{"example.com"}}}})
+			defer c.Close()
+
+			if ans := c.Query("www.example.com.", dns.TypeA); len(ans) != tt.answers {
+				t.Errorf("got %d answers, want %d", len(ans), tt.answers)
+			}
+			if got := atomic.LoadUint32(&udpSize); got != upstreamUDPSize {
+				t.Errorf("advertised %d, want %d", got, upstreamUDPSize)
+			}
+			if got := atomic.LoadInt32(&tcpQueries); got != tt.tcp {
+				t.Errorf("%d queries over tcp, want %d", got, tt.tcp)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const (
+	upgradeUnknown = iota
+	upgradeProbing
+	upgradeDoT
+	upgradeUDP
+)
+
+// withUpgrade sends queries to plain until the host is probed for DoT support by the first query in background,
+// then to dot if it answers. A query failed over DoT is retried over plain.
+// The upstream isn't encrypted for private domains, since the upgrade is opportunistic.
+func (c *DNSClient) withUpgrade(upstream string, plain dnsClient, dot dnsClient) dnsClient {
+	var state int32
+	return func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+		switch atomic.LoadInt32(&state) {
+		case upgradeUnknown:
+			if atomic.CompareAndSwapInt32(&state, upgradeUnknown, upgradeProbing) {
+				started := c.background(ctx, func(ctx context.Context) {
+					if _, err := dot(ctx, ".", dns.TypeNS); isUpstreamFailure(err) {
+						logger.Module("client.upgrade").Info().Str("upstream", upstream).Err(err).Msg("dot unavailable, use udp")
+						atomic.StoreInt32(&state, upgradeUDP)
+						return
+					}
+					logger.Module("client.upgrade").Info().Str("upstream", upstream).Msg("upgraded to dot")
+					atomic.StoreInt32(&state, upgradeDoT)
+				})
+				if !started {
+					atomic.StoreInt32(&state, upgradeUnknown)
+				}
+			}
+		case upgradeDoT:
+			ans, err := dot(ctx, name, qtype)
+			if !isUpstreamFailure(err) {
+				return ans, err
+			}
+			logger.Module("client.upgrade").Debug().Str("upstream", upstream).Str("domain", name).Uint16("type", qtype).Err(err).Msg("retry over udp")
+		}
+		return plain(ctx, name, qtype)
+	}
+}
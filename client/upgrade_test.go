@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestUpgrade(t *testing.T) {
+	tests := []struct {
+		name string
+		// the probe, and the queries over DoT after it
+		probeErr error
+		dotErr   error
+		// the transports of the query probing, in any order since the probe is in background,
+		// and the query after the probe
+		first, second []string
+	}{
+		{name: "probe succeeds", first: []string{"probe", "udp"}, second: []string{"dot"}},
+		{name: "probe NXDOMAIN", probeErr: rcodeError(dns.RcodeNameError), first: []string{"probe", "udp"}, second: []string{"dot"}},
+		{name: "probe fails", probeErr: errors.New("connection refused"), first: []string{"probe", "udp"}, second: []string{"udp"}},
+		{name: "dot fails after upgrade", dotErr: errors.New("connection reset"), first: []string{"probe", "udp"}, second: []string{"dot", "udp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var used []string
+			transport := func(name string, err error) dnsClient {
+				return func(ctx context.Context, q string, qtype uint16) ([]Answer, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					if q == "." {
+						used = append(used, "probe")
+						return nil, tt.probeErr
+					}
+					used = append(used, name)
+					return []Answer{{Name: q, Type: qtype, TTL: 60, Data: "1.1.1.1"}}, err
+				}
+			}
+			c := new(DNSClient)
+			c.Init(&config.Config{})
+			cli := c.withUpgrade("udp://127.0.0.1", transport("udp", nil), transport("dot", tt.dotErr))
+
+			if ans, err := cli(context.Background(), "example.com.", dns.TypeA); err != nil || len(ans) != 1 {
+				t.Fatalf("got %v %v", ans, err)
+			}
+			// waits for the probe
+			c.Close()
+			mu.Lock()
+			sort.Strings(used)
+			if !reflect.DeepEqual(used, tt.first) {
+				t.Errorf("first query: got %v, want %v", used, tt.first)
+			}
+			used = nil
+			mu.Unlock()
+
+			if ans, err := cli(context.Background(), "example.com.", dns.TypeA); err != nil || len(ans) != 1 {
+				t.Fatalf("got %v %v", ans, err)
+			}
+			if !reflect.DeepEqual(used, tt.second) {
+				t.Errorf("second query: got %v, want %v", used, tt.second)
+			}
+		})
+	}
+
+	t.Run("closed", func(t *testing.T) {
+		c := new(DNSClient)
+		c.Init(&config.Config{})
+		c.Close()
+		probed := false
+		cli := c.withUpgrade("udp://127.0.0.1", staticClient(nil, nil), func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+			probed = true
+			return nil, nil
+		})
+		cli(context.Background(), "example.com.", dns.TypeA)
+		cli(context.Background(), "example.com.", dns.TypeA)
+		if probed {
+			t.Error("probed after Close")
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rcodeError is an upstream response with rcode other than NOERROR.
+type rcodeError int
+
+func (e rcodeError) Error() string {
+	return "rcode: " + dns.RcodeToString[int(e)]
+}
+
+// isUpstreamFailure reports whether err is a failure without response, e.g. timeout or network error.
+// An rcodeError, including a referral, means the upstream responded.
+func isUpstreamFailure(err error) bool {
+	var rcodeErr rcodeError
+	return err != nil && !errors.As(err, &rcodeErr)
+}
+
+type upstream struct {
+	// The upstream as configured, e.g. "udp://1.1.1.1:53".
+	dns string
+	// Whether the transport hides the query from the network.
+	encrypted bool
+	// Whether the answers are from local network, e.g. mDNS.
+	local bool
+	// Whether the upstream is alias://, which resolves another domain.
+	alias bool
+	// Private addresses allowed in answers, with rebind protection.
+	allowPrivate []*net.IPNet
+	// How answers out of the chain of query name are dropped, empty to keep them.
+	bailiwick string
+	// The stats of transports, including public and fallback upstreams, the upstream is degraded if all of them are failing.
+	health []*rttStats
+	query  dnsClient
+}
+
+// degraded reports whether all transports failed for consecutive times.
+func (up *upstream) degraded(after int64) bool {
+	if len(up.health) == 0 {
+		return false
+	}
+	for _, stats := range up.health {
+		if atomic.LoadInt64(&stats.failures) < after {
+			return false
+		}
+	}
+	return true
+}
+
+// latency is the lowest RTT EWMA of the transports, 0 if not measured yet.
+func (up *upstream) latency() time.Duration {
+	var rtt time.Duration
+	for _, stats := range up.health {
+		if avg := stats.get(); avg > 0 && (rtt == 0 || avg < rtt) {
+			rtt = avg
+		}
+	}
+	return rtt
+}
+
+// privateDomain marks the domains in DNSClient.private.
+var privateDomain = new(upstream)
+
+// revalidateDomain marks the domains in DNSClient.revalidated.
+var revalidateDomain = new(upstream)
+
+// alwaysRevalidate reports whether a cache hit of the domain should be refreshed in background.
+func (c *DNSClient) alwaysRevalidate(domain string) bool {
+	return c.revalidated.route(domain) != nil
+}
+
+// serveStaleDomain marks the domains in DNSClient.staleAlways.
+var serveStaleDomain = new(upstream)
+
+// alwaysServeStale reports whether expired answers of the domain are kept, and served while refreshed in background.
+func (c *DNSClient) alwaysServeStale(domain string) bool {
+	return c.staleAlways.route(domain) != nil
+}
+
+// isPrivate reports whether the domain should only be sent over an encrypted upstream.
+func (c *DNSClient) isPrivate(domain string) bool {
+	return c.private.route(domain) != nil
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"net"
+	"strings"
+)
+
+// parseVia splits "example.com.via.8.8.8.8." into "example.com." and an UDP
+// upstream "8.8.8.8:53".
+func (c *DNSClient) parseVia(name string) (string, *upstream, bool) {
+	sep := "." + c.via + "."
+	idx := strings.LastIndex(strings.ToLower(name), sep)
+	if idx <= 0 {
+		return "", nil, false
+	}
+
+	host := strings.TrimSuffix(name[idx+len(sep):], ".")
+	if net.ParseIP(host) == nil {
+		return "", nil, false
+	}
+
+	target := name[:idx+1]
+	server := net.JoinHostPort(host, "53")
+	up := &upstream{
+		dns:   "udp://" + server,
+		query: GetUDPClient(server, "", false, defaultQueryTimeout),
+	}
+	return target, up, true
+}
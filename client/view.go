@@ -0,0 +1,510 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+///
+
+// dnsView is a rule set of split-horizon.
+type dnsView struct {
+	name       string
+	client     []*net.IPNet
+	router     dnsRouter
+	staticIpV4 map[string]string
+	staticIpV6 map[string]string
+	staticPTR  map[string]string   // MAP(reverse address) => domain, of static IP
+	zones      map[string]*dnsZone // MAP(domain) => zone
+}
+
+func (c *DNSClient) initView(v *dnsView, forwards []config.Server, private []string) {
+	for _, forward := range forwards {
+		parsed, err := url.Parse(splitHosts(forward.DNS)[0])
+		if err != nil {
+			logger.Module("client").Error().Str("dns", forward.DNS).Msg("invalid config")
+			panic(err)
+		}
+		switch parsed.Scheme {
+		case "ipv4":
+			if ip := net.ParseIP(parsed.Host); ip == nil || ip.To4() == nil {
+				logger.Module("client").Error().Str("dns", forward.DNS).Msg("invalid IPv4 address")
+				panic("invalid IPv4 address: " + forward.DNS)
+			}
+			if v.staticIpV4 == nil {
+				v.staticIpV4 = make(map[string]string)
+			}
+			for _, domain := range forward.Domain {
+				// the first forward of a domain wins, as the router
+				domain = staticDomain(domain)
+				if _, found := v.staticIpV4[domain]; !found {
+					v.staticIpV4[domain] = parsed.Host
+				}
+			}
+			v.addStaticPTR(parsed.Host, forward.Domain)
+			continue
+		case "ipv6":
+			if ip := net.ParseIP(parsed.Host); ip == nil || ip.To4() != nil {
+				logger.Module("client").Error().Str("dns", forward.DNS).Msg("invalid IPv6 address")
+				panic("invalid IPv6 address: " + forward.DNS)
+			}
+			if v.staticIpV6 == nil {
+				v.staticIpV6 = make(map[string]string)
+			}
+			for _, domain := range forward.Domain {
+				domain = staticDomain(domain)
+				if _, found := v.staticIpV6[domain]; !found {
+					v.staticIpV6[domain] = parsed.Host
+				}
+			}
+			v.addStaticPTR(parsed.Host, forward.Domain)
+			continue
+		case "zone":
+			origin := ""
+			if len(forward.Domain) > 0 {
+				origin = staticDomain(forward.Domain[0])
+			}
+			z, err := newZone(parsed.Host+parsed.Path, origin, c.stop)
+			if err != nil {
+				logger.Module("client").Error().Str("dns", forward.DNS).Err(err).Msg("invalid zone")
+				panic(err)
+			}
+			if v.zones == nil {
+				v.zones = make(map[string]*dnsZone)
+			}
+			domains := forward.Domain
+			if len(domains) == 0 {
+				domains = []string{z.origin}
+			}
+			for _, domain := range domains {
+				domain = staticDomain(strings.ToLower(domain))
+				if _, found := v.zones[domain]; !found {
+					v.zones[domain] = z
+				}
+			}
+			continue
+		case "mdns":
+			if len(forward.Domain) == 0 {
+				forward.Domain = []string{"local"}
+			}
+		}
+
+		up, err := c.newUpstream(forward)
+		if err == errUnsupportedScheme {
+			logger.Module("client").Error().Str("dns", forward.DNS).Msg("unsupported scheme")
+			continue
+		} else if err != nil {
+			logger.Module("client").Error().Str("dns", forward.DNS).Err(err).Msg("invalid config")
+			panic(err)
+		}
+		for _, domain := range forward.Domain {
+			domain = dns.Fqdn(domain)
+			if !up.encrypted && c.isPrivate(domain) {
+				logger.Module("client").Error().Str("dns", forward.DNS).Str("domain", domain).Msg("private domain with plaintext upstream")
+				panic("private domain with plaintext upstream: " + domain)
+			}
+			v.router.add(domain, up)
+		}
+	}
+
+	for _, domain := range private {
+		domain = dns.Fqdn(domain)
+		up := v.router.route(domain)
+		if up != nil && !up.encrypted {
+			logger.Module("client").Error().Str("dns", up.dns).Str("domain", domain).Msg("private domain with plaintext upstream")
+			panic("private domain with plaintext upstream: " + domain)
+		}
+	}
+}
+
+var errUnsupportedScheme = errors.New("unsupported scheme")
+
+// newUpstream creates the upstream of a forward, static IP is not an upstream.
+func (c *DNSClient) newUpstream(forward config.Server) (*upstream, error) {
+	if len(forward.Bind) > 0 && net.ParseIP(forward.Bind) == nil {
+		return nil, errors.New("invalid bind address: " + forward.Bind)
+	}
+	if len(forward.HttpsProxy) > 0 {
+		if _, err := url.Parse(forward.HttpsProxy); err != nil {
+			return nil, err
+		}
+	}
+
+	var allowPrivate []*net.IPNet
+	for _, cidr := range forward.AllowPrivate {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		allowPrivate = append(allowPrivate, ipNet)
+	}
+
+	if err := validateStrategy(forward); err != nil {
+		return nil, err
+	}
+
+	switch forward.Bailiwick {
+	case "", bailiwickLoose, bailiwickStrict:
+	default:
+		return nil, errors.New("unsupported bailiwick: " + forward.Bailiwick)
+	}
+
+	var up *upstream
+	var err error
+	if len(forward.Transport) > 0 {
+		var urls []string
+		urls, err = transportURLs(forward.DNS, forward.Transport)
+		if err != nil {
+			return nil, err
+		}
+		up, err = c.newGroup(forward, urls)
+	} else if hosts := splitHosts(forward.DNS); len(hosts) > 1 {
+		up, err = c.newGroup(forward, hosts)
+	} else {
+		up, err = c.newTransport(forward)
+	}
+	if err != nil {
+		return nil, err
+	}
+	up.allowPrivate = allowPrivate
+	up.bailiwick = forward.Bailiwick
+
+	switch forward.Strategy {
+	case "":
+	case "failover", "round-robin", "race":
+		// by newGroup
+	case "then-public":
+		public := subForward(forward, forward.Public)
+		pub, err := c.newUpstream(public)
+		if err != nil {
+			return nil, err
+		}
+		up.query = thenPublic(forward.DNS, up.query, pub)
+		up.encrypted = up.encrypted && pub.encrypted
+		up.health = append(up.health, pub.health...)
+	case "mirror":
+		shadow := subForward(forward, forward.Shadow)
+		sh, err := c.newUpstream(shadow)
+		if err != nil {
+			return nil, err
+		}
+		up.query = c.mirror(forward.DNS, up.query, sh)
+		up.encrypted = up.encrypted && sh.encrypted
+	default:
+		return nil, errors.New("unsupported strategy: " + forward.Strategy)
+	}
+	if len(forward.Fallback) > 0 {
+		fallback := subForward(forward, forward.Fallback)
+		fb, err := c.newUpstream(fallback)
+		if err != nil {
+			return nil, err
+		}
+		after := forward.FallbackAfter
+		if after <= 0 {
+			after = defaultFallbackAfter
+		}
+		up.query = c.withFallback(forward.DNS, up.query, fb, after)
+		up.encrypted = up.encrypted && fb.encrypted
+		up.health = append(up.health, fb.health...)
+	}
+
+	return up, nil
+}
+
+// validateStrategy reports the options of forward which conflict with its strategy or hosts.
+func validateStrategy(forward config.Server) error {
+	switch forward.Merge {
+	case "", mergeFirst, mergeUnion:
+	default:
+		return errors.New("unsupported merge: " + forward.Merge)
+	}
+	if len(forward.Merge) > 0 && forward.Strategy != "race" {
+		return errors.New("merge without race strategy: " + forward.DNS)
+	}
+	if forward.RaceFanout < 0 {
+		return errors.New("negative race_fanout: " + forward.DNS)
+	}
+	if forward.RaceFanout != 0 && forward.Strategy != "race" {
+		return errors.New("race_fanout without race strategy: " + forward.DNS)
+	}
+	if forward.StickyTTL < 0 {
+		return errors.New("negative sticky_ttl: " + forward.DNS)
+	}
+	if forward.StickyTTL != 0 && forward.Strategy != "round-robin" {
+		return errors.New("sticky_ttl without round-robin strategy: " + forward.DNS)
+	}
+
+	hosts := len(splitHosts(forward.DNS))
+	if len(forward.Transport) > 0 {
+		if forward.Strategy == "round-robin" || forward.Strategy == "race" {
+			return errors.New("transport only fails over in order: " + forward.DNS)
+		}
+		hosts = len(forward.Transport)
+	}
+	if (forward.Strategy == "round-robin" || forward.Strategy == "race") && hosts < 2 {
+		return errors.New(forward.Strategy + " with a single host: " + forward.DNS)
+	}
+
+	if forward.Strategy == "then-public" && len(forward.Public) == 0 {
+		return errors.New("then-public without public upstream: " + forward.DNS)
+	}
+	if len(forward.Public) > 0 && forward.Strategy != "then-public" {
+		return errors.New("public without then-public strategy: " + forward.DNS)
+	}
+	if forward.Strategy == "mirror" && len(forward.Shadow) == 0 {
+		return errors.New("mirror without shadow upstream: " + forward.DNS)
+	}
+	if len(forward.Shadow) > 0 && forward.Strategy != "mirror" {
+		return errors.New("shadow without mirror strategy: " + forward.DNS)
+	}
+	if len(forward.Shadow) > 0 && forward.Shadow == forward.DNS {
+		return errors.New("mirror to itself: " + forward.DNS)
+	}
+	if forward.ForceTCP && forward.Upgrade {
+		return errors.New("force_tcp with upgrade: " + forward.DNS)
+	}
+	if forward.FallbackAfter != 0 && len(forward.Fallback) == 0 {
+		return errors.New("fallback_after without fallback upstream: " + forward.DNS)
+	}
+	if len(forward.Fallback) > 0 && forward.Fallback == forward.DNS {
+		return errors.New("fallback to itself: " + forward.DNS)
+	}
+	return nil
+}
+
+// subForward is the forward of a public/shadow/fallback upstream, with the options of forward except the strategy.
+func subForward(forward config.Server, dnsURL string) config.Server {
+	sub := forward
+	sub.DNS = dnsURL
+	sub.Strategy = ""
+	sub.Transport = nil
+	sub.Merge = ""
+	sub.RaceFanout = 0
+	sub.StickyTTL = 0
+	sub.Public = ""
+	sub.Shadow = ""
+	sub.Fallback = ""
+	sub.FallbackAfter = 0
+	return sub
+}
+
+// newTransport creates the upstream of a single host.
+func (c *DNSClient) newTransport(forward config.Server) (*upstream, error) {
+	parsed, err := url.Parse(forward.DNS)
+	if err != nil {
+		return nil, err
+	}
+
+	up := &upstream{dns: forward.DNS}
+	var cli dnsClient
+	switch parsed.Scheme {
+	case "udp":
+		if forward.ForceTCP {
+			// for large answers, without the round trip of truncation
+			cli = c.tcpTransport(parsed.Host, forward.Bind, false, idleTimeout(forward), exchangeTimeout(forward), c.bootstrap, forward.Padding)
+			break
+		}
+		cli = GetUDPClient(parsed.Host, forward.Bind, forward.Cookie, exchangeTimeout(forward))
+		if forward.Upgrade {
+			dot := c.tcpTransport(net.JoinHostPort(parsed.Hostname(), "853"), forward.Bind, true, idleTimeout(forward), exchangeTimeout(forward), c.bootstrap, paddingBlock(forward))
+			cli = c.withUpgrade(forward.DNS, cli, dot)
+		}
+	case "mdns":
+		host := parsed.Host
+		if len(host) == 0 {
+			host = mdnsDefaultServer
+		}
+		cli = GetMDNSClient(host, forward.Bind)
+		up.local = true
+	case "doh":
+		parsed.Scheme = "https"
+		if forward.DoHFormat != "" && forward.DoHFormat != dohFormatJSON && forward.DoHFormat != dohFormatMessage {
+			return nil, errors.New("unsupported doh_format: " + forward.DoHFormat)
+		}
+		cli = GetDoHClient(parsed.String(), forward.HttpsProxy, forward.Bind, c.bootstrap, forward.DoHFormat, paddingBlock(forward), c.dohRetryPolicy(forward))
+		up.encrypted = true
+	case "tcp":
+		cli = c.tcpTransport(parsed.Host, forward.Bind, false, idleTimeout(forward), exchangeTimeout(forward), c.bootstrap, forward.Padding)
+	case "dot":
+		host := parsed.Host
+		if len(parsed.Port()) == 0 {
+			host = net.JoinHostPort(host, "853")
+		}
+		cli = c.tcpTransport(host, forward.Bind, true, idleTimeout(forward), exchangeTimeout(forward), c.bootstrap, paddingBlock(forward))
+		up.encrypted = true
+	case "alias":
+		target := dns.Fqdn(strings.ToLower(parsed.Host))
+		cli = c.flatten(target)
+		up.alias = true
+		// only the target is sent to upstream, by its own rule
+		up.encrypted = true
+	default:
+		return nil, errUnsupportedScheme
+	}
+
+	if forward.Warmup && (parsed.Scheme == "https" || parsed.Scheme == "dot") {
+		c.warmups = append(c.warmups, warmupTarget{dns: forward.DNS, query: cli})
+	}
+
+	up.query = c.measure(forward.DNS, c.inject(forward.DNS, cli))
+	if val, found := c.rtt.Load(forward.DNS); found {
+		stats := val.(*rttStats)
+		up.health = []*rttStats{stats}
+		up.query = c.withBreaker(forward.DNS, stats, forward.BreakerAfter, time.Duration(forward.BreakerCooldown)*time.Second, up.query)
+	}
+	return up, nil
+}
+
+func (v *dnsView) static(name string, qtype uint16) ([]Answer, bool) {
+	if qtype == dns.TypeA {
+		staticIp, found := staticLookup(v.staticIpV4, name)
+		if found {
+			logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("staticIpV4 hit")
+			return []Answer{{Name: name, Type: qtype, TTL: 60, Data: staticIp}}, true
+		}
+	} else if qtype == dns.TypeAAAA {
+		staticIp, found := staticLookup(v.staticIpV6, name)
+		if found {
+			logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("staticIpV6 hit")
+			return []Answer{{Name: name, Type: qtype, TTL: 60, Data: staticIp}}, true
+		}
+	} else if qtype == dns.TypePTR {
+		domain, found := v.staticPTR[strings.ToLower(name)]
+		if found {
+			logger.Module("client").Debug().Str("domain", name).Uint16("type", qtype).Msg("staticPTR hit")
+			return []Answer{{Name: name, Type: qtype, TTL: 60, Data: domain}}, true
+		}
+	}
+	return nil, false
+}
+
+// addStaticPTR answers reverse queries of the static IP with its first domain, wildcards are skipped.
+func (v *dnsView) addStaticPTR(ip string, domains []string) {
+	reverse, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return
+	}
+	if v.staticPTR == nil {
+		v.staticPTR = make(map[string]string)
+	}
+	for _, domain := range domains {
+		if _, found := v.staticPTR[reverse]; found || strings.HasPrefix(domain, "*.") {
+			continue
+		}
+		v.staticPTR[reverse] = staticDomain(domain)
+	}
+}
+
+// staticDomain is the FQDN of a static IP or zone domain, with A-labels as query names.
+func staticDomain(domain string) string {
+	if ascii, err := ToASCII(domain); err != nil {
+		// kept as is, it matches no query
+		logger.Module("client").Warn().Str("domain", domain).Err(err).Send()
+	} else {
+		domain = ascii
+	}
+	return dns.Fqdn(strings.ToLower(domain))
+}
+
+// staticLookup finds the exact name, or the longest "*." suffix matching any subdomain, case-insensitively.
+func staticLookup(table map[string]string, name string) (string, bool) {
+	name = strings.ToLower(name)
+	if ip, found := table[name]; found {
+		return ip, true
+	}
+	for idx := strings.IndexByte(name, '.'); idx >= 0 && idx < len(name)-1; idx = strings.IndexByte(name, '.') {
+		name = name[idx+1:]
+		if ip, found := table["*."+name]; found {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// tcpTransport gets the TCP/DoT client, whose session is released by CloseContext.
+func (c *DNSClient) tcpTransport(tcpServer string, bind string, useTLS bool, idleTimeout time.Duration, timeout queryTimeout, bootstrap *bootstrapResolver, padding int) dnsClient {
+	cli := getTCPClient(tcpServer, bind, useTLS, idleTimeout, timeout, bootstrap, padding)
+	if _, loaded := c.tcpSessions.LoadOrStore(cli.session, struct{}{}); !loaded {
+		cli.session.acquire()
+	}
+	return cli.query
+}
+
+func idleTimeout(forward config.Server) time.Duration {
+	if forward.IdleTimeout > 0 {
+		return time.Duration(forward.IdleTimeout) * time.Second
+	}
+	return defaultIdleTimeout
+}
+
+func exchangeTimeout(forward config.Server) queryTimeout {
+	t := defaultQueryTimeout
+	if forward.AttemptTimeout > 0 {
+		t.attempt = time.Duration(forward.AttemptTimeout) * time.Millisecond
+		t.total = t.attempt
+	}
+	if forward.TotalTimeout > 0 {
+		t.total = time.Duration(forward.TotalTimeout) * time.Millisecond
+	}
+	return t
+}
+
+// paddingBlock is the padding of queries over encrypted transports, RFC 8467 by default.
+func paddingBlock(forward config.Server) int {
+	if forward.Padding == 0 {
+		return defaultPaddingBlock
+	}
+	return forward.Padding
+}
+
+// dohRetryPolicy is the retry of a DoH forward, within total_timeout if set.
+func (c *DNSClient) dohRetryPolicy(forward config.Server) dohRetry {
+	r := defaultDoHRetry
+	r.retried = &c.stats.dohRetries
+	if forward.DoHRetry != 0 {
+		r.count = forward.DoHRetry
+	}
+	r.backoff = time.Duration(forward.DoHBackoff) * time.Millisecond
+	r.jitter = time.Duration(forward.DoHJitter) * time.Millisecond
+	r.budget = time.Duration(forward.TotalTimeout) * time.Millisecond
+	return r
+}
+
+///
+
+type clientIPKey struct{}
+
+// WithClientIP returns a context whose queries are resolved in the view matching the client.
+func WithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+func clientIPFromContext(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(clientIPKey{}).(net.IP)
+	return ip
+}
+
+// selectView returns the first view containing the client, or the default view.
+func (c *DNSClient) selectView(ctx context.Context) *dnsView {
+	ip := clientIPFromContext(ctx)
+	if ip == nil {
+		return &c.view
+	}
+	for _, v := range c.views {
+		for _, ipNet := range v.client {
+			if ipNet.Contains(ip) {
+				return v
+			}
+		}
+	}
+	return &c.view
+}
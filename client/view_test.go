@@ -0,0 +1,256 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func writeZone(t *testing.T, dir string, name string, addr string) string {
+	path := filepath.Join(dir, name)
+	zone := "example.com. 60 IN SOA ns.example.com. admin.example.com. 1 60 60 60 60\n" +
+		"www.example.com. 60 IN A " + addr + "\n"
+	if err := ioutil.WriteFile(path, []byte(zone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestFirstForward checks the first forward of a domain wins, as the forwards from environment are merged before the file.
+func TestFirstForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	firstZone := writeZone(t, dir, "first.zone", "1.1.1.1")
+	secondZone := writeZone(t, dir, "second.zone", "2.2.2.2")
+
+	tests := []struct {
+		name    string
+		forward []config.Server
+		query   string
+		qtype   uint16
+		want    string
+	}{
+		{
+			name: "ipv4",
+			forward: []config.Server{
+				{DNS: "ipv4://1.1.1.1", Domain: []string{"example.com"}},
+				{DNS: "ipv4://2.2.2.2", Domain: []string{"example.com"}},
+			},
+			query: "example.com.",
+			qtype: dns.TypeA,
+			want:  "1.1.1.1",
+		},
+		{
+			name: "ipv6",
+			forward: []config.Server{
+				{DNS: "ipv6://::1", Domain: []string{"example.com"}},
+				{DNS: "ipv6://::2", Domain: []string{"example.com"}},
+			},
+			query: "example.com.",
+			qtype: dns.TypeAAAA,
+			want:  "::1",
+		},
+		{
+			name: "zone",
+			forward: []config.Server{
+				{DNS: "zone://" + firstZone, Domain: []string{"example.com"}},
+				{DNS: "zone://" + secondZone, Domain: []string{"example.com"}},
+			},
+			query: "www.example.com.",
+			qtype: dns.TypeA,
+			want:  "1.1.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(DNSClient)
+			c.Init(&config.Config{Forward: tt.forward})
+
+			ans := c.Query(tt.query, tt.qtype)
+			if len(ans) != 1 || ans[0].Data != tt.want {
+				t.Errorf("got %v, want %v", ans, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticIDN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zone := filepath.Join(dir, "idn.zone")
+	records := "xn--bcher-kva.example. 60 IN SOA ns.example. admin.example. 1 60 60 60 60\n" +
+		"www.xn--bcher-kva.example. 60 IN A 2.2.2.2\n"
+	if err := ioutil.WriteFile(zone, []byte(records), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := new(DNSClient)
+	c.Init(&config.Config{Forward: []config.Server{
+		{DNS: "ipv4://1.1.1.1", Domain: []string{"café.example", "*.münchen.example"}},
+		{DNS: "zone://" + zone, Domain: []string{"bücher.example"}},
+	}})
+
+	tests := []struct {
+		name  string
+		query string
+		qtype uint16
+		want  string
+	}{
+		{name: "static unicode", query: "café.example.", qtype: dns.TypeA, want: "1.1.1.1"},
+		{name: "static A-label", query: "xn--caf-dma.example.", qtype: dns.TypeA, want: "1.1.1.1"},
+		{name: "static NFD", query: "cafe\u0301.example.", qtype: dns.TypeA, want: "1.1.1.1"},
+		{name: "static fullwidth", query: "\uff23af\u00e9.example.", qtype: dns.TypeA, want: "1.1.1.1"},
+		{name: "static wildcard", query: "www.xn--mnchen-3ya.example.", qtype: dns.TypeA, want: "1.1.1.1"},
+		{name: "static PTR", query: "1.1.1.1.in-addr.arpa.", qtype: dns.TypePTR, want: "xn--caf-dma.example."},
+		{name: "zone unicode", query: "www.bücher.example.", qtype: dns.TypeA, want: "2.2.2.2"},
+		{name: "zone A-label", query: "www.xn--bcher-kva.example.", qtype: dns.TypeA, want: "2.2.2.2"},
+		{name: "zone fullwidth", query: "\uff37ww.bu\u0308cher.example.", qtype: dns.TypeA, want: "2.2.2.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ans := c.Query(tt.query, tt.qtype)
+			if len(ans) != 1 || ans[0].Data != tt.want {
+				t.Errorf("got %v, want %v", ans, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticAddress(t *testing.T) {
+	tests := []struct {
+		dns   string
+		valid bool
+	}{
+		{dns: "ipv4://1.1.1.1", valid: true},
+		{dns: "ipv4://", valid: false},
+		{dns: "ipv4://1.1.1.256", valid: false},
+		{dns: "ipv4://example.com", valid: false},
+		{dns: "ipv4://::1", valid: false},
+		{dns: "ipv6://::1", valid: true},
+		{dns: "ipv6://2001:db8::1", valid: true},
+		{dns: "ipv6://", valid: false},
+		{dns: "ipv6://1.1.1.1", valid: false},
+		{dns: "ipv6://::ffff:1.1.1.1", valid: false},
+		{dns: "ipv6://example.com", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dns, func(t *testing.T) {
+			valid := true
+			func() {
+				defer func() {
+					if recover() != nil {
+						valid = false
+					}
+				}()
+				c := new(DNSClient)
+				c.Init(&config.Config{Forward: []config.Server{{DNS: tt.dns, Domain: []string{"example.com"}}}})
+			}()
+			if valid != tt.valid {
+				t.Errorf("valid = %v, want %v", valid, tt.valid)
+			}
+		})
+	}
+}
+
+func TestStaticWildcard(t *testing.T) {
+	c := new(DNSClient)
+	// the wildcards first, the order of config doesn't matter
+	c.Init(&config.Config{Forward: []config.Server{
+		{DNS: "ipv4://1.1.1.1", Domain: []string{"*.dev.example.com"}},
+		{DNS: "ipv4://2.2.2.2", Domain: []string{"*.api.dev.example.com"}},
+		{DNS: "ipv4://3.3.3.3", Domain: []string{"www.dev.example.com", "X.API.dev.example.com"}},
+		{DNS: "ipv6://2001:db8::1", Domain: []string{"*.dev.example.com"}},
+		{DNS: "ipv6://2001:db8::3", Domain: []string{"www.dev.example.com"}},
+	}})
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		{name: "www.dev.example.com.", qtype: dns.TypeA, want: "3.3.3.3"},
+		{name: "WWW.dev.example.com.", qtype: dns.TypeA, want: "3.3.3.3"},
+		{name: "other.dev.example.com.", qtype: dns.TypeA, want: "1.1.1.1"},
+		{name: "a.b.dev.example.com.", qtype: dns.TypeA, want: "1.1.1.1"},
+		{name: "api.dev.example.com.", qtype: dns.TypeA, want: "1.1.1.1"},
+		{name: "y.api.dev.example.com.", qtype: dns.TypeA, want: "2.2.2.2"},
+		{name: "x.api.dev.example.com.", qtype: dns.TypeA, want: "3.3.3.3"},
+		{name: "Other.DEV.example.com.", qtype: dns.TypeA, want: "1.1.1.1"},
+		// the wildcard doesn't match the domain itself
+		{name: "dev.example.com.", qtype: dns.TypeA},
+		{name: "www.dev.example.com.", qtype: dns.TypeAAAA, want: "2001:db8::3"},
+		{name: "other.dev.example.com.", qtype: dns.TypeAAAA, want: "2001:db8::1"},
+		// reverse of the exact domain only
+		{name: "3.3.3.3.in-addr.arpa.", qtype: dns.TypePTR, want: "www.dev.example.com."},
+		{name: "1.1.1.1.in-addr.arpa.", qtype: dns.TypePTR},
+	}
+	for _, tt := range tests {
+		ans := c.Query(tt.name, tt.qtype)
+		got := ""
+		if len(ans) > 0 {
+			got = ans[0].Data
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: got %v, want %q", tt.name, dns.TypeToString[tt.qtype], ans, tt.want)
+		}
+	}
+}
+
+func TestValidateStrategy(t *testing.T) {
+	const (
+		single = "udp://1.1.1.1"
+		pair   = "udp://1.1.1.1,8.8.8.8"
+	)
+	tests := []struct {
+		name    string
+		forward config.Server
+		valid   bool
+	}{
+		{name: "plain", forward: config.Server{DNS: single}, valid: true},
+		{name: "failover", forward: config.Server{DNS: pair, Strategy: "failover"}, valid: true},
+		{name: "failover transport", forward: config.Server{DNS: single, Strategy: "failover", Transport: []string{"udp", "tcp"}}, valid: true},
+		{name: "round-robin", forward: config.Server{DNS: pair, Strategy: "round-robin", StickyTTL: 60}, valid: true},
+		{name: "race", forward: config.Server{DNS: pair, Strategy: "race", Merge: mergeUnion, RaceFanout: 1}, valid: true},
+		{name: "then-public", forward: config.Server{DNS: single, Strategy: "then-public", Public: "udp://8.8.8.8"}, valid: true},
+		{name: "mirror", forward: config.Server{DNS: single, Strategy: "mirror", Shadow: "udp://8.8.8.8"}, valid: true},
+		{name: "fallback", forward: config.Server{DNS: single, Fallback: "udp://8.8.8.8", FallbackAfter: 2}, valid: true},
+
+		{name: "unsupported merge", forward: config.Server{DNS: pair, Strategy: "race", Merge: "all"}},
+		{name: "merge without race", forward: config.Server{DNS: pair, Strategy: "failover", Merge: mergeFirst}},
+		{name: "negative race_fanout", forward: config.Server{DNS: pair, Strategy: "race", RaceFanout: -1}},
+		{name: "race_fanout without race", forward: config.Server{DNS: pair, Strategy: "round-robin", RaceFanout: 1}},
+		{name: "negative sticky_ttl", forward: config.Server{DNS: pair, Strategy: "round-robin", StickyTTL: -1}},
+		{name: "sticky_ttl without round-robin", forward: config.Server{DNS: pair, Strategy: "race", StickyTTL: 60}},
+		{name: "round-robin transport", forward: config.Server{DNS: single, Strategy: "round-robin", Transport: []string{"udp", "tcp"}}},
+		{name: "race transport", forward: config.Server{DNS: single, Strategy: "race", Transport: []string{"udp", "tcp"}}},
+		{name: "round-robin single host", forward: config.Server{DNS: single, Strategy: "round-robin"}},
+		{name: "race single host", forward: config.Server{DNS: single, Strategy: "race"}},
+		{name: "then-public without public", forward: config.Server{DNS: single, Strategy: "then-public"}},
+		{name: "public without then-public", forward: config.Server{DNS: single, Public: "udp://8.8.8.8"}},
+		{name: "mirror without shadow", forward: config.Server{DNS: single, Strategy: "mirror"}},
+		{name: "shadow without mirror", forward: config.Server{DNS: single, Shadow: "udp://8.8.8.8"}},
+		{name: "mirror to itself", forward: config.Server{DNS: single, Strategy: "mirror", Shadow: single}},
+		{name: "force_tcp", forward: config.Server{DNS: single, ForceTCP: true}, valid: true},
+		{name: "force_tcp with upgrade", forward: config.Server{DNS: single, ForceTCP: true, Upgrade: true}},
+		{name: "fallback_after without fallback", forward: config.Server{DNS: single, FallbackAfter: 2}},
+		{name: "fallback to itself", forward: config.Server{DNS: single, Fallback: single}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateStrategy(tt.forward)
+			if (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const warmupAttempts = 3
+
+// warmupBackoff is doubled after each failed attempt, a var so tests can shorten it.
+var warmupBackoff = 500 * time.Millisecond
+
+type warmupTarget struct {
+	dns   string
+	query dnsClient
+}
+
+// warmup establishes the connections of DoH/DoT upstreams, so the first query doesn't pay the TLS handshake.
+// A failure is logged only, the connection is established lazily by the next query.
+func (c *DNSClient) warmup() {
+	var wg sync.WaitGroup
+	for _, t := range c.warmups {
+		wg.Add(1)
+		go func(t warmupTarget) {
+			defer wg.Done()
+			backoff := warmupBackoff
+			for attempt := 1; ; attempt++ {
+				_, err := t.query(context.Background(), ".", dns.TypeNS)
+				if !isUpstreamFailure(err) {
+					logger.Module("client").Debug().Str("upstream", t.dns).Msg("warmup")
+					return
+				}
+				if attempt == warmupAttempts {
+					logger.Module("client").Warn().Str("upstream", t.dns).Err(err).Msg("warmup failed")
+					return
+				}
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}(t)
+	}
+	wg.Wait()
+	c.warmups = nil
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+func TestWarmup(t *testing.T) {
+	defer func(backoff time.Duration) { warmupBackoff = backoff }(warmupBackoff)
+	warmupBackoff = time.Millisecond
+
+	errRefused := errors.New("connection refused")
+	tests := []struct {
+		name string
+		// the errors of attempts, the last one is repeated
+		errs     []error
+		attempts int
+	}{
+		{name: "connected", errs: []error{nil}, attempts: 1},
+		{name: "refused by rcode", errs: []error{rcodeError(dns.RcodeRefused)}, attempts: 1},
+		{name: "retried", errs: []error{errRefused, errRefused, nil}, attempts: 3},
+		{name: "failed", errs: []error{errRefused}, attempts: warmupAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			c := new(DNSClient)
+			c.warmups = []warmupTarget{{dns: "dot://127.0.0.1", query: func(ctx context.Context, name string, qtype uint16) ([]Answer, error) {
+				if name != "." || qtype != dns.TypeNS {
+					t.Errorf("got %s %d", name, qtype)
+				}
+				err := tt.errs[len(tt.errs)-1]
+				if attempts < len(tt.errs) {
+					err = tt.errs[attempts]
+				}
+				attempts++
+				return nil, err
+			}}}
+			// done before returning, so before the first query
+			c.warmup()
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+			if c.warmups != nil {
+				t.Error("warmups kept")
+			}
+		})
+	}
+}
+
+func TestWarmupForward(t *testing.T) {
+	tests := []struct {
+		dns    string
+		warmup bool
+		want   bool
+	}{
+		{dns: "doh://127.0.0.1:1/dns-query", warmup: true, want: true},
+		{dns: "dot://127.0.0.1:1", warmup: true, want: true},
+		{dns: "doh://127.0.0.1:1/dns-query"},
+		// plaintext has no handshake
+		{dns: "udp://127.0.0.1:1", warmup: true},
+		{dns: "tcp://127.0.0.1:1", warmup: true},
+	}
+	for _, tt := range tests {
+		c := new(DNSClient)
+		c.Init(&config.Config{})
+		if _, err := c.newTransport(config.Server{DNS: tt.dns, Warmup: tt.warmup}); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(c.warmups) == 1; got != tt.want {
+			t.Errorf("%s: warmup = %v, want %v", tt.dns, got, tt.want)
+		}
+		c.Close()
+	}
+}
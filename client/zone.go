@@ -0,0 +1,205 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+const zoneReloadInterval = 10 * time.Second
+
+// dnsZone answers the domains of a zone file authoritatively. RFC 1035
+type dnsZone struct {
+	path   string
+	origin string
+
+	sync.RWMutex
+	records map[string]*zoneNode // MAP(domain) => answers, empty for empty non-terminal
+	modTime time.Time
+}
+
+// zoneNode is the answers of a domain, precomputed at load.
+type zoneNode struct {
+	all    []Answer
+	byType map[uint16][]Answer
+	// the CNAME, with the records of its target in the zone by type
+	cname []Answer
+}
+
+// newZone loads the zone file, which is watched until stop is closed.
+func newZone(path string, origin string, stop <-chan struct{}) (*dnsZone, error) {
+	z := &dnsZone{path: path, origin: origin}
+	if err := z.load(); err != nil {
+		return nil, err
+	}
+	go z.watch(stop)
+	return z, nil
+}
+
+func (z *dnsZone) load() error {
+	f, err := os.Open(z.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	records := make(map[string]*zoneNode)
+	node := func(name string) *zoneNode {
+		n, found := records[name]
+		if !found {
+			n = &zoneNode{byType: make(map[uint16][]Answer)}
+			records[name] = n
+		}
+		return n
+	}
+	var soa string
+	zp := dns.NewZoneParser(f, z.origin, z.path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		ans, err := rr2ans(rr)
+		if err != nil {
+			return err
+		}
+		ans.Name = strings.ToLower(ans.Name)
+		n := node(ans.Name)
+		n.all = append(n.all, ans)
+		n.byType[ans.Type] = append(n.byType[ans.Type], ans)
+		if ans.Type == dns.TypeSOA && len(soa) == 0 {
+			soa = ans.Name
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	if len(soa) == 0 {
+		return errors.New("zone without SOA: " + z.path)
+	}
+
+	for name, n := range records {
+		n.cname = n.byType[dns.TypeCNAME]
+		// empty non-terminals exist without records
+		for name != soa && name != "." {
+			name = parentDomain(name)
+			node(name)
+		}
+	}
+
+	z.Lock()
+	defer z.Unlock()
+	if len(z.origin) == 0 {
+		z.origin = soa
+	}
+	z.records = records
+	z.modTime = stat.ModTime()
+	return nil
+}
+
+// watch reloads the zone file when it is changed.
+func (z *dnsZone) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(zoneReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		stat, err := os.Stat(z.path)
+		if err != nil {
+			logger.Module("client.zone").Error().Str("path", z.path).Err(err).Send()
+			continue
+		}
+		z.RLock()
+		changed := !stat.ModTime().Equal(z.modTime)
+		z.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := z.load(); err != nil {
+			logger.Module("client.zone").Error().Str("path", z.path).Err(err).Msg("reload")
+			continue
+		}
+		logger.Module("client.zone").Info().Str("path", z.path).Msg("reload")
+	}
+}
+
+// answer returns the records of name, or a CNAME and the records of its target in the zone.
+// The answers are shared, they should not be changed.
+func (z *dnsZone) answer(name string, qtype uint16) Result {
+	z.RLock()
+	defer z.RUnlock()
+
+	name = strings.ToLower(name)
+	n, found := z.records[name]
+	if !found {
+		return Result{Rcode: dns.RcodeNameError, Authoritative: true}
+	}
+
+	if qtype == dns.TypeANY {
+		return Result{Answer: n.all, Authoritative: true}
+	}
+	if ans := n.byType[qtype]; len(ans) > 0 || len(n.cname) == 0 {
+		return Result{Answer: ans, Authoritative: true}
+	}
+	ans := n.cname
+	for _, cname := range n.cname {
+		if target, found := z.records[strings.ToLower(dns.Fqdn(cname.Data))]; found {
+			ans = append(append([]Answer(nil), ans...), target.byType[qtype]...)
+		}
+	}
+	return Result{Answer: ans, Authoritative: true}
+}
+
+// ReloadZones reloads all zone files now, instead of waiting for them to be checked.
+func (c *DNSClient) ReloadZones() error {
+	var err error
+	for _, v := range append([]*dnsView{&c.view}, c.views...) {
+		for _, z := range v.zones {
+			if e := z.load(); e != nil {
+				logger.Module("client.zone").Error().Str("path", z.path).Err(e).Msg("reload")
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// zone returns the answers from the zone of the longest domain.
+func (v *dnsView) zone(name string, qtype uint16) (Result, bool) {
+	if len(v.zones) == 0 {
+		return Result{}, false
+	}
+	domain := strings.ToLower(name)
+	for {
+		if z, found := v.zones[domain]; found {
+			logger.Module("client.zone").Debug().Str("domain", name).Uint16("type", qtype).Str("path", z.path).Msg("zone hit")
+			r := z.answer(name, qtype)
+			// a copy, the answers may be changed by the caller
+			r.Answer = append([]Answer(nil), r.Answer...)
+			return r, true
+		}
+		if domain == "." {
+			return Result{}, false
+		}
+		domain = parentDomain(domain)
+	}
+}
+
+// parentDomain returns "example.com." for "www.example.com.", "." for "com.".
+func parentDomain(domain string) string {
+	parent := domain[strings.IndexByte(domain, '.')+1:]
+	if len(parent) == 0 {
+		return "."
+	}
+	return parent
+}
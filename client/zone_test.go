@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/config"
+)
+
+const testZone = `$ORIGIN example.com.
+@       60 IN SOA ns admin 1 60 60 60 60
+www     60 IN A 1.1.1.1
+www     60 IN A 2.2.2.2
+alias   60 IN CNAME www
+a.b.c   60 IN TXT "deep"
+`
+
+func loadTestZone(t *testing.T, stop <-chan struct{}) *dnsZone {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "example.zone")
+	if err := ioutil.WriteFile(path, []byte(testZone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	z, err := newZone(path, "", stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestZoneAnswer(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	z := loadTestZone(t, stop)
+
+	tests := []struct {
+		name   string
+		query  string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{name: "records", query: "www.example.com.", qtype: dns.TypeA, answer: 2},
+		{name: "case insensitive", query: "WWW.Example.com.", qtype: dns.TypeA, answer: 2},
+		{name: "no data", query: "www.example.com.", qtype: dns.TypeAAAA},
+		{name: "cname with target", query: "alias.example.com.", qtype: dns.TypeA, answer: 3},
+		{name: "empty non-terminal", query: "b.c.example.com.", qtype: dns.TypeA},
+		{name: "nxdomain", query: "none.example.com.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "any", query: "www.example.com.", qtype: dns.TypeANY, answer: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := z.answer(tt.query, tt.qtype)
+			if !r.Authoritative || r.Rcode != tt.rcode || len(r.Answer) != tt.answer {
+				t.Errorf("got rcode %d with %v, want rcode %d with %d answers", r.Rcode, r.Answer, tt.rcode, tt.answer)
+			}
+		})
+	}
+}
+
+func TestZoneWatchStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	stop := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		loadTestZone(t, stop)
+	}
+	if n := runtime.NumGoroutine(); n < before+3 {
+		t.Fatalf("got %d goroutines, want %d watching", n, before+3)
+	}
+	close(stop)
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("got %d goroutines after stop, want %d", n, before)
+	}
+}
+
+func TestZoneQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeZone(t, dir, "example.zone", "1.1.1.1")
+	c := new(DNSClient)
+	c.Init(&config.Config{Forward: []config.Server{{DNS: "zone://" + path, Domain: []string{"example.com"}}}})
+	defer c.Close()
+	ctx := WithDO(context.Background(), true)
+
+	tests := []struct {
+		name string
+		// before the query
+		change func(t *testing.T)
+		want   string
+	}{
+		{name: "loaded", want: "1.1.1.1"},
+		{name: "not cached", change: func(t *testing.T) {
+			key := c.cacheKey(ctx, &c.view, "www.example.com.", dns.TypeA)
+			if _, _, _, found := c.cacheGet(key); found {
+				t.Errorf("zone answers cached")
+			}
+		}, want: "1.1.1.1"},
+		{name: "not changed by caller", change: func(t *testing.T) {
+			ans := c.QueryContext(ctx, "www.example.com.", dns.TypeA)
+			ans[0].Data = "9.9.9.9"
+		}, want: "1.1.1.1"},
+		{name: "reloaded", change: func(t *testing.T) {
+			writeZone(t, dir, "example.zone", "2.2.2.2")
+			if err := c.ReloadZones(); err != nil {
+				t.Fatal(err)
+			}
+		}, want: "2.2.2.2"},
+		{name: "kept if reload failed", change: func(t *testing.T) {
+			if err := ioutil.WriteFile(path, []byte("www.example.com. 60 IN A 3.3.3.3\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.ReloadZones(); err == nil {
+				t.Errorf("reloaded a zone without SOA")
+			}
+		}, want: "2.2.2.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.change != nil {
+				tt.change(t)
+			}
+			r := c.ResolveWithMeta(ctx, "www.example.com.", dns.TypeA)
+			if !r.Authoritative || len(r.Answer) != 1 || r.Answer[0].Data != tt.want {
+				t.Errorf("got %v, want %s", r.Answer, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkZoneAnswer compares the precomputed answers with parsing the zone for each query, as before they were precomputed.
+func BenchmarkZoneAnswer(b *testing.B) {
+	dir, err := ioutil.TempDir("", "shunt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "example.zone")
+	if err := ioutil.WriteFile(path, []byte(testZone), 0644); err != nil {
+		b.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	z, err := newZone(path, "", stop)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("precomputed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			z.answer("www.example.com.", dns.TypeA)
+		}
+	})
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var ans []Answer
+			zp := dns.NewZoneParser(bytes.NewReader([]byte(testZone)), "", path)
+			for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+				if hd := rr.Header(); hd.Name == "www.example.com." && hd.Rrtype == dns.TypeA {
+					a, _ := rr2ans(rr)
+					ans = append(ans, a)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/dhcmrlchtdj/dns/logger"
+)
+
+// EnvForwards is a JSON array of forwards, e.g. `[{"dns":"udp://1.1.1.1:53","domain":["."]}]`.
+const EnvForwards = "SHUNT_FORWARDS"
+
+// LoadEnv merges forwards from environment, before the ones from file.
+// The first forward of a domain wins, so the environment takes precedence.
+func (c *Config) LoadEnv() {
+	val, found := os.LookupEnv(EnvForwards)
+	if !found || len(val) == 0 {
+		return
+	}
+
+	logger.Module("config").Info().Str("env", EnvForwards).Msg("load config")
+
+	var forwards []Server
+	if err := json.Unmarshal([]byte(val), &forwards); err != nil {
+		logger.Module("config").Error().Str("env", EnvForwards).Err(err).Send()
+		panic(err)
+	}
+	c.Forward = append(forwards, c.Forward...)
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLoadEnv(t *testing.T) {
+	file := []Server{{DNS: "udp://2.2.2.2:53", Domain: []string{"example.com"}}}
+	tests := []struct {
+		name  string
+		env   string
+		unset bool
+		file  []Server
+		want  []Server
+		err   bool
+	}{
+		{name: "unset", unset: true, file: file, want: file},
+		{name: "empty", env: "", file: file, want: file},
+		{
+			name: "env only",
+			env:  `[{"dns":"udp://1.1.1.1:53","domain":["."]}]`,
+			want: []Server{{DNS: "udp://1.1.1.1:53", Domain: []string{"."}}},
+		},
+		{
+			name: "env before file",
+			env:  `[{"dns":"udp://1.1.1.1:53","domain":["example.com"],"force_tcp":true}]`,
+			file: file,
+			want: []Server{{DNS: "udp://1.1.1.1:53", Domain: []string{"example.com"}, ForceTCP: true}, file[0]},
+		},
+		{name: "invalid", env: `{"dns":"udp://1.1.1.1:53"}`, file: file, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.unset {
+				os.Unsetenv(EnvForwards)
+			} else {
+				os.Setenv(EnvForwards, tt.env)
+				defer os.Unsetenv(EnvForwards)
+			}
+
+			cfg := &Config{Forward: append([]Server(nil), tt.file...)}
+			failed := false
+			func() {
+				defer func() {
+					if recover() != nil {
+						failed = true
+					}
+				}()
+				cfg.LoadEnv()
+			}()
+			if failed != tt.err {
+				t.Fatalf("failed = %v, want %v", failed, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(cfg.Forward, tt.want) {
+				t.Errorf("got %+v, want %+v", cfg.Forward, tt.want)
+			}
+		})
+	}
+}
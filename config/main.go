@@ -4,31 +4,141 @@ import (
 	"encoding/json"
 	"os"
 
-	"github.com/rs/zerolog/log"
+	"github.com/dhcmrlchtdj/dns/logger"
 )
 
 ///
 
 type Config struct {
-	Port     int      `json:"port,omitempty"`
-	LogLevel string   `json:"logLevel,omitempty"`
-	Forward  []Server `json:"forward"`
+	Port                 int                 `json:"port,omitempty"`
+	LogLevel             string              `json:"logLevel,omitempty"`
+	ShutdownTimeout      int                 `json:"shutdownTimeout,omitempty"`
+	MaxUDPSize           int                 `json:"maxUDPSize,omitempty"`
+	Log                  map[string]string   `json:"log,omitempty"`
+	Via                  string              `json:"via,omitempty"`
+	ACL                  *ACL                `json:"acl,omitempty"`
+	Strict               bool                `json:"strict,omitempty"`
+	RttAlpha             float64             `json:"rttAlpha,omitempty"`
+	Private              []string            `json:"private,omitempty"`
+	Bootstrap            []string            `json:"bootstrap,omitempty"`
+	Any                  string              `json:"any,omitempty"`
+	Chaos                map[string]string   `json:"chaos,omitempty"`
+	MaxServedTTL         int                 `json:"maxServedTTL,omitempty"`
+	MinServedTTL         int                 `json:"minServedTTL,omitempty"`
+	PerRecordTTL         bool                `json:"perRecordTTL,omitempty"`
+	MinTTL               int                 `json:"minTTL,omitempty"`
+	MaxTTL               int                 `json:"maxTTL,omitempty"`
+	TypeTTL              map[string]TTLRange `json:"typeTTL,omitempty"`
+	TTLMultiplier        map[string]float64  `json:"ttlMultiplier,omitempty"`
+	StaleIfError         bool                `json:"staleIfError,omitempty"`
+	StaleWhileRevalidate bool                `json:"staleWhileRevalidate,omitempty"`
+	StaleMaxAge          int                 `json:"staleMaxAge,omitempty"`
+	ExtendTTL            int                 `json:"extendTTL,omitempty"`
+	DegradedAfter        int                 `json:"degradedAfter,omitempty"`
+	PruneInterval        int                 `json:"pruneInterval,omitempty"`
+	Revalidate           []string            `json:"revalidate,omitempty"`
+	Rotate               []string            `json:"rotate,omitempty"`
+	ServeStale           []string            `json:"serveStale,omitempty"`
+	ServfailTTL          int                 `json:"servfailTTL,omitempty"`
+	NegativeTTL          int                 `json:"negativeTTL,omitempty"`
+	NegativeMaxTTL       int                 `json:"negativeMaxTTL,omitempty"`
+	CacheReferral        bool                `json:"cacheReferral,omitempty"`
+	OfflineAfter         int                 `json:"offlineAfter,omitempty"`
+	CachePrefix          string              `json:"cachePrefix,omitempty"`
+	MaxAnswers           int                 `json:"maxAnswers,omitempty"`
+	MaxDataLength        int                 `json:"maxDataLength,omitempty"`
+	NormalizeName        bool                `json:"normalizeName,omitempty"`
+	TypeMismatch         string              `json:"typeMismatch,omitempty"`
+	RebindProtection     bool                `json:"rebindProtection,omitempty"`
+	PrivatePTR           string              `json:"privatePTR,omitempty"`
+	SpecialNames         map[string]string   `json:"specialNames,omitempty"`
+	Sources              []string            `json:"sources,omitempty"`
+	Forward              []Server            `json:"forward"`
+	View                 []View              `json:"view,omitempty"`
+	Rewrite              []Rewrite           `json:"rewrite,omitempty"`
+	FaultInjection       *FaultInjection     `json:"faultInjection,omitempty"`
+	QueryLog             *QueryLog           `json:"queryLog,omitempty"`
+}
+
+// TTLRange clamps TTL of answers, 0 is unlimited.
+type TTLRange struct {
+	Min int `json:"min,omitempty"`
+	Max int `json:"max,omitempty"`
+}
+
+type Rewrite struct {
+	Name   string `json:"name,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Data   string `json:"data,omitempty"`
+	Action string `json:"action"`
+	Value  string `json:"value,omitempty"`
+}
+
+// FaultInjection is for testing only, it requires SHUNT_FAULT_INJECTION=1 in environment.
+type FaultInjection struct {
+	Delay   int     `json:"delay,omitempty"`   // ms
+	Failure float64 `json:"failure,omitempty"` // the fraction of failed queries
+}
+
+// ACL restricts the clients of server by CIDR, e.g. "192.168.0.0/16".
+// The deny list wins, and other clients are denied if the allow list is not empty.
+type ACL struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// QueryLog writes one JSON line per query to Path, which is renamed to Path + ".1" after MaxSize MB (100 by default).
+type QueryLog struct {
+	Path    string `json:"path"`
+	MaxSize int    `json:"maxSize,omitempty"`
+}
+
+type View struct {
+	Name    string   `json:"name"`
+	Client  []string `json:"client"`
+	Forward []Server `json:"forward"`
 }
 
 type Server struct {
-	DNS    string   `json:"dns"`
-	HttpsProxy string `json:"https_proxy,omitempty"`
-	Domain []string `json:"domain"`
+	DNS             string   `json:"dns"`
+	Transport       []string `json:"transport,omitempty"`
+	HttpsProxy      string   `json:"https_proxy,omitempty"`
+	DoHFormat       string   `json:"doh_format,omitempty"`
+	DoHRetry        int      `json:"doh_retry,omitempty"`
+	DoHBackoff      int      `json:"doh_backoff,omitempty"`
+	DoHJitter       int      `json:"doh_jitter,omitempty"`
+	Bind            string   `json:"bind,omitempty"`
+	IdleTimeout     int      `json:"idle_timeout,omitempty"`
+	Warmup          bool     `json:"warmup,omitempty"`
+	Cookie          bool     `json:"cookie,omitempty"`
+	ForceTCP        bool     `json:"force_tcp,omitempty"`
+	Upgrade         bool     `json:"upgrade,omitempty"`
+	AttemptTimeout  int      `json:"attempt_timeout,omitempty"`
+	TotalTimeout    int      `json:"total_timeout,omitempty"`
+	Domain          []string `json:"domain"`
+	Padding         int      `json:"padding,omitempty"`
+	Fallback        string   `json:"fallback,omitempty"`
+	FallbackAfter   int      `json:"fallback_after,omitempty"`
+	BreakerAfter    int      `json:"breaker_after,omitempty"`
+	BreakerCooldown int      `json:"breaker_cooldown,omitempty"`
+	AllowPrivate    []string `json:"allow_private,omitempty"`
+	Bailiwick       string   `json:"bailiwick,omitempty"`
+	Strategy        string   `json:"strategy,omitempty"`
+	Merge           string   `json:"merge,omitempty"`
+	RaceFanout      int      `json:"race_fanout,omitempty"`
+	StickyTTL       int      `json:"sticky_ttl,omitempty"`
+	Public          string   `json:"public,omitempty"`
+	Shadow          string   `json:"shadow,omitempty"`
 }
 
 ///
 
 func (c *Config) Load(file string) {
-	log.Info().Str("module", "config").Str("path", file).Msg("load config")
+	logger.Module("config").Info().Str("path", file).Msg("load config")
 
 	f, err := os.Open(file)
 	if err != nil {
-		log.Error().Str("module", "config").Str("path", file).Err(err).Send()
+		logger.Module("config").Error().Str("path", file).Err(err).Send()
 		panic(err)
 	}
 	defer f.Close()
@@ -36,7 +146,7 @@ func (c *Config) Load(file string) {
 	dec := json.NewDecoder(f)
 	dec.UseNumber()
 	if err := dec.Decode(c); err != nil {
-		log.Error().Str("module", "config").Str("path", file).Err(err).Send()
+		logger.Module("config").Error().Str("path", file).Err(err).Send()
 		panic(err)
 	}
 }
@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+///
+
+var (
+	defaultLevel = zerolog.InfoLevel
+	moduleLevel  = map[string]zerolog.Level{}
+	loggers      = new(sync.Map) // MAP(module) => *zerolog.Logger
+)
+
+// SetLevel sets the default level, and the level of modules like "client.cache".
+// It should be called before any query.
+func SetLevel(level zerolog.Level, modules map[string]zerolog.Level) {
+	defaultLevel = level
+	moduleLevel = modules
+
+	global := level
+	for _, l := range modules {
+		if l < global {
+			global = l
+		}
+	}
+	zerolog.SetGlobalLevel(global)
+
+	loggers.Range(func(key, _ interface{}) bool {
+		loggers.Delete(key)
+		return true
+	})
+}
+
+// Module returns the logger of module.
+// The level of "client.cache" falls back to the level of "client", then the default level.
+func Module(module string) *zerolog.Logger {
+	l, found := loggers.Load(module)
+	if found {
+		return l.(*zerolog.Logger)
+	}
+
+	level := defaultLevel
+	for m := module; len(m) > 0; {
+		if l, found := moduleLevel[m]; found {
+			level = l
+			break
+		}
+		idx := strings.LastIndexByte(m, '.')
+		if idx < 0 {
+			break
+		}
+		m = m[:idx]
+	}
+
+	logger := log.With().Str("module", module).Logger().Level(level)
+	loggers.Store(module, &logger)
+	return &logger
+}
+
+///
+
+func ParseLevel(s string) zerolog.Level {
+	switch s {
+	case "debug":
+		return zerolog.DebugLevel
+	case "info":
+		return zerolog.InfoLevel
+	case "warn":
+		return zerolog.WarnLevel
+	case "error":
+		return zerolog.ErrorLevel
+	default:
+		panic("invalid log level: " + s)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
+	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog"
@@ -12,11 +17,21 @@ import (
 
 	"github.com/dhcmrlchtdj/dns/client"
 	"github.com/dhcmrlchtdj/dns/config"
+	"github.com/dhcmrlchtdj/dns/logger"
 )
 
+const defaultShutdownTimeout = 5 * time.Second
+
 type Dns struct {
-	server dns.Server
-	client client.DNSClient
+	server    dns.Server
+	tcpServer dns.Server
+	client    client.DNSClient
+	resolver  client.Resolver
+	refuseAny bool
+	chaos     map[string]string
+	acl       *acl
+	// cap the payload size of clients over UDP, 0 is unlimited
+	maxUDPSize int
 }
 
 func main() {
@@ -29,47 +44,143 @@ func main() {
 			Net:     "udp",
 			Handler: dnsMux,
 		},
+		tcpServer: dns.Server{
+			Addr:    ":" + strconv.Itoa(cfg.Port),
+			Net:     "tcp",
+			Handler: dnsMux,
+		},
+		refuseAny:  cfg.Any != "forward",
+		chaos:      make(map[string]string),
+		acl:        newACL(cfg.ACL),
+		maxUDPSize: cfg.MaxUDPSize,
+	}
+	for name, txt := range cfg.Chaos {
+		s.chaos[dns.Fqdn(strings.ToLower(name))] = txt
 	}
 	dnsMux.HandleFunc(".", s.handleRequest)
-	s.client.Init(cfg.Forward)
+	s.client.Init(cfg)
+	s.resolver = &s.client
 
-	log.Info().Str("module", "main").Int("port", cfg.Port).Msg("Start DNS server")
-	err := s.server.ListenAndServe()
-	if err != nil {
-		panic(err)
+	logger.Module("main").Info().Int("port", cfg.Port).Msg("Start DNS server")
+	for _, server := range []*dns.Server{&s.server, &s.tcpServer} {
+		go func(server *dns.Server) {
+			err := server.ListenAndServe()
+			if err != nil {
+				panic(err)
+			}
+		}(server)
 	}
-	defer s.server.Shutdown()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	logger.Module("main").Info().Msg("Stop DNS server")
+	timeout := defaultShutdownTimeout
+	if cfg.ShutdownTimeout > 0 {
+		timeout = time.Duration(cfg.ShutdownTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// the queries being handled run to completion, the new ones are dropped
+	s.server.ShutdownContext(ctx)
+	s.tcpServer.ShutdownContext(ctx)
+	s.client.CloseContext(ctx)
 }
 
 ///
 
 func (s *Dns) handleRequest(w dns.ResponseWriter, query *dns.Msg) {
-	log.Debug().Str("module", "main").Msg("handle request")
+	logger.Module("main").Debug().Msg("handle request")
 
 	m := new(dns.Msg)
 	m.SetReply(query)
 
-	if query.Opcode == dns.OpcodeQuery {
-		s.Query(m)
+	if !s.acl.allowed(w.RemoteAddr()) {
+		m.Rcode = dns.RcodeRefused
+	} else if query.Opcode == dns.OpcodeQuery {
+		ctx := context.Background()
+		if ip := remoteIP(w.RemoteAddr()); ip != nil {
+			ctx = client.WithClientIP(ctx, ip)
+		}
+		if opt := query.IsEdns0(); opt != nil {
+			ctx = client.WithDO(ctx, opt.Do())
+			m.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		}
+		s.Query(ctx, m)
+	}
+
+	limit := 0
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		// RFC 6891, the response over UDP is limited by the payload size of client, 512 without EDNS
+		size := dns.MinMsgSize
+		if opt := query.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			// a size less than 512 is treated as 512
+			size = int(opt.UDPSize())
+		}
+		if s.maxUDPSize > 0 && size > s.maxUDPSize {
+			// a larger response is truncated, the client retries over TCP
+			size = s.maxUDPSize
+			if size < dns.MinMsgSize {
+				size = dns.MinMsgSize
+			}
+		}
+		m.Truncate(size)
+		limit = size
+	} else {
+		m.Compress = true
+	}
+	if client.HasPadding(query) {
+		// RFC 7830, padded only if the client asks for it
+		client.PadResponse(m, limit)
 	}
 
 	err := w.WriteMsg(m)
 	if err != nil {
-		log.Debug().Str("module", "main").Err(err).Msg("handle request write")
+		logger.Module("main").Debug().Err(err).Msg("handle request write")
 	}
 }
 
-func (s *Dns) Query(m *dns.Msg) {
-	log.Debug().Str("module", "main").Msg("query")
+func (s *Dns) Query(ctx context.Context, m *dns.Msg) {
+	logger.Module("main").Debug().Msg("query")
 
 	for _, q := range m.Question {
-		answers := s.client.Query(q.Name, q.Qtype)
-		for _, ans := range answers {
-			record := fmt.Sprintf("%s %d %s %s", ans.Name, ans.TTL, dns.Type(ans.Type).String(), ans.Data)
-			rr, err := dns.NewRR(record)
+		if q.Qclass == dns.ClassCHAOS {
+			// version.bind, id.server, etc.
+			txt, found := s.chaos[strings.ToLower(q.Name)]
+			if !found || q.Qtype != dns.TypeTXT {
+				m.Rcode = dns.RcodeRefused
+				continue
+			}
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+				Txt: []string{txt},
+			})
+			continue
+		}
+		if q.Qtype == dns.TypeANY && s.refuseAny {
+			// RFC 8482, Providing Minimal-Sized Responses to DNS Queries That Have QTYPE=ANY
+			m.Answer = append(m.Answer, &dns.HINFO{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 3600},
+				Cpu: "RFC8482",
+			})
+			continue
+		}
+		r := s.resolver.ResolveWithMeta(ctx, q.Name, q.Qtype)
+		if r.Rcode != dns.RcodeSuccess {
+			m.Rcode = r.Rcode
+		}
+		if r.Authoritative {
+			m.Authoritative = true
+		}
+		if opt := m.IsEdns0(); opt != nil && r.ExtendedError != nil {
+			opt.Option = append(opt.Option, r.ExtendedError.Option())
+		}
+		for _, ans := range r.Answer {
+			rr, err := ans.ToRR()
 			if err != nil {
-				log.Error().Str("module", "main").Str("record", record).Err(err).Send()
-				panic(err)
+				logger.Module("main").Error().Str("domain", ans.Name).Str("data", ans.Data).Err(err).Send()
+				continue
 			}
 			m.Answer = append(m.Answer, rr)
 		}
@@ -84,7 +195,7 @@ func initConfig() *config.Config {
 
 	port := flag.Int("port", 0, "DNS server port.")
 	configFile := flag.String("conf", "", "Path to config file.")
-	logLevel := flag.String("log-level", "", "Log level. debug, info, error")
+	logLevel := flag.String("log-level", "", "Log level. debug, info, warn, error")
 	flag.Parse()
 
 	cfg := new(config.Config)
@@ -92,6 +203,7 @@ func initConfig() *config.Config {
 	if len(*configFile) > 0 {
 		cfg.Load(*configFile)
 	}
+	cfg.LoadEnv()
 
 	if *port != 0 {
 		cfg.Port = *port
@@ -100,24 +212,21 @@ func initConfig() *config.Config {
 		panic("'0' is not a valid port number")
 	}
 
+	if cfg.Any != "" && cfg.Any != "refuse" && cfg.Any != "forward" {
+		panic("invalid any: " + cfg.Any)
+	}
+
+	level := zerolog.InfoLevel
 	if len(*logLevel) > 0 {
-		zerolog.SetGlobalLevel(string2level(*logLevel))
+		level = logger.ParseLevel(*logLevel)
 	} else if len(cfg.LogLevel) > 0 {
-		zerolog.SetGlobalLevel(string2level(cfg.LogLevel))
+		level = logger.ParseLevel(cfg.LogLevel)
 	}
+	modules := make(map[string]zerolog.Level)
+	for module, l := range cfg.Log {
+		modules[module] = logger.ParseLevel(l)
+	}
+	logger.SetLevel(level, modules)
 
 	return cfg
 }
-
-func string2level(s string) zerolog.Level {
-	switch s {
-	case "debug":
-		return zerolog.DebugLevel
-	case "info":
-		return zerolog.InfoLevel
-	case "error":
-		return zerolog.ErrorLevel
-	default:
-		panic("invalid log level: " + s)
-	}
-}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/dhcmrlchtdj/dns/client"
+	"github.com/dhcmrlchtdj/dns/client/clienttest"
+)
+
+func TestQueryAny(t *testing.T) {
+	resolver := &clienttest.StaticResolver{
+		Answers: []client.Answer{{Name: "example.com.", Type: dns.TypeA, TTL: 60, Data: "1.1.1.1"}},
+		// ANY isn't answered by the resolver, so it is told by rcode
+		Rcode: dns.RcodeNameError,
+	}
+	tests := []struct {
+		name      string
+		refuseAny bool
+		qtype     uint16
+		rcode     int
+		want      uint16
+	}{
+		{name: "refused", refuseAny: true, qtype: dns.TypeANY, rcode: dns.RcodeSuccess, want: dns.TypeHINFO},
+		{name: "forwarded", refuseAny: false, qtype: dns.TypeANY, rcode: dns.RcodeNameError},
+		{name: "other type refusing", refuseAny: true, qtype: dns.TypeA, rcode: dns.RcodeSuccess, want: dns.TypeA},
+		{name: "other type forwarding", refuseAny: false, qtype: dns.TypeA, rcode: dns.RcodeSuccess, want: dns.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Dns{resolver: resolver, refuseAny: tt.refuseAny}
+			query := new(dns.Msg)
+			query.SetQuestion("example.com.", tt.qtype)
+			m := new(dns.Msg)
+			m.SetReply(query)
+			s.Query(context.Background(), m)
+
+			if m.Rcode != tt.rcode {
+				t.Errorf("got rcode %d, want %d", m.Rcode, tt.rcode)
+			}
+			if tt.want == 0 {
+				if len(m.Answer) != 0 {
+					t.Errorf("got %v, want no answers", m.Answer)
+				}
+				return
+			}
+			if len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != tt.want {
+				t.Fatalf("got %v, want a %s record", m.Answer, dns.TypeToString[tt.want])
+			}
+			if hinfo, ok := m.Answer[0].(*dns.HINFO); ok && hinfo.Cpu != "RFC8482" {
+				t.Errorf("got HINFO %q, want RFC8482", hinfo.Cpu)
+			}
+		})
+	}
+}
+
+func TestQueryChaos(t *testing.T) {
+	resolver := &clienttest.StaticResolver{
+		Answers: []client.Answer{{Name: "version.bind.", Type: dns.TypeTXT, TTL: 60, Data: "forwarded"}},
+	}
+	tests := []struct {
+		name  string
+		query string
+		class uint16
+		qtype uint16
+		rcode int
+		want  string
+	}{
+		{name: "configured", query: "version.bind.", class: dns.ClassCHAOS, qtype: dns.TypeTXT, want: "shunt"},
+		{name: "case insensitive", query: "VERSION.Bind.", class: dns.ClassCHAOS, qtype: dns.TypeTXT, want: "shunt"},
+		{name: "not configured", query: "id.server.", class: dns.ClassCHAOS, qtype: dns.TypeTXT, rcode: dns.RcodeRefused},
+		{name: "not TXT", query: "version.bind.", class: dns.ClassCHAOS, qtype: dns.TypeA, rcode: dns.RcodeRefused},
+		{name: "internet class is forwarded", query: "version.bind.", class: dns.ClassINET, qtype: dns.TypeTXT, want: "forwarded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Dns{resolver: resolver, chaos: map[string]string{"version.bind.": "shunt"}}
+			query := new(dns.Msg)
+			query.SetQuestion(tt.query, tt.qtype)
+			query.Question[0].Qclass = tt.class
+			m := new(dns.Msg)
+			m.SetReply(query)
+			s.Query(context.Background(), m)
+
+			if m.Rcode != tt.rcode {
+				t.Errorf("got rcode %d, want %d", m.Rcode, tt.rcode)
+			}
+			if tt.want == "" {
+				if len(m.Answer) != 0 {
+					t.Errorf("got %v, want no answers", m.Answer)
+				}
+				return
+			}
+			if len(m.Answer) != 1 {
+				t.Fatalf("got %v, want a TXT record", m.Answer)
+			}
+			txt, ok := m.Answer[0].(*dns.TXT)
+			if !ok || len(txt.Txt) != 1 || txt.Txt[0] != tt.want {
+				t.Fatalf("got %v, want TXT %q", m.Answer[0], tt.want)
+			}
+			if txt.Hdr.Name != tt.query || txt.Hdr.Class != tt.class {
+				t.Errorf("got name %q class %d, want %q %d", txt.Hdr.Name, txt.Hdr.Class, tt.query, tt.class)
+			}
+		})
+	}
+}
+
+// recordWriter records the response of handleRequest.
+type recordWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *recordWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *recordWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+var (
+	udpClient = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10053}
+	tcpClient = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10053}
+)
+
+// addresses is n A records of name, 1.1.1.1 to 1.1.1.n.
+func addresses(name string, n int) []client.Answer {
+	ans := make([]client.Answer, 0, n)
+	for i := 1; i <= n; i++ {
+		ans = append(ans, client.Answer{Name: name, Type: dns.TypeA, TTL: 60, Data: "1.1.1." + strconv.Itoa(i)})
+	}
+	return ans
+}
+
+func hasPaddingOption(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandlePadding(t *testing.T) {
+	resolver := &clienttest.StaticResolver{Answers: append(addresses("www.example.com.", 1), addresses("many.example.com.", 28)...)}
+	tests := []struct {
+		name   string
+		query  string
+		remote net.Addr
+		// 0 is without EDNS
+		bufsize uint16
+		padding bool
+		padded  bool
+	}{
+		{name: "padded", query: "www.example.com.", remote: udpClient, bufsize: 1232, padding: true, padded: true},
+		{name: "not asked", query: "www.example.com.", remote: udpClient, bufsize: 1232},
+		{name: "over tcp", query: "many.example.com.", remote: tcpClient, bufsize: 1232, padding: true, padded: true},
+		{name: "over client bufsize", query: "many.example.com.", remote: udpClient, bufsize: 512, padding: true},
+		{name: "within client bufsize", query: "many.example.com.", remote: udpClient, bufsize: 4096, padding: true, padded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Dns{resolver: resolver}
+			query := new(dns.Msg)
+			query.SetQuestion(tt.query, dns.TypeA)
+			if tt.bufsize > 0 {
+				query.SetEdns0(tt.bufsize, false)
+			}
+			if tt.padding {
+				opt := query.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+			}
+			w := &recordWriter{remote: tt.remote}
+			s.handleRequest(w, query)
+
+			if hasPaddingOption(w.msg) != tt.padded {
+				t.Fatalf("padded = %v, want %v", hasPaddingOption(w.msg), tt.padded)
+			}
+			if tt.padded && w.msg.Len()%468 != 0 {
+				t.Errorf("length %d is not a multiple of 468", w.msg.Len())
+			}
+			if _, udp := tt.remote.(*net.UDPAddr); udp && w.msg.Len() > int(tt.bufsize) {
+				t.Errorf("length %d is over client bufsize %d", w.msg.Len(), tt.bufsize)
+			}
+			if w.msg.Truncated {
+				t.Errorf("truncated, got %d answers", len(w.msg.Answer))
+			}
+		})
+	}
+}
+
+func TestHandleBufsize(t *testing.T) {
+	resolver := &clienttest.StaticResolver{Answers: append(addresses("www.example.com.", 1), addresses("many.example.com.", 100)...)}
+	tests := []struct {
+		name   string
+		query  string
+		remote net.Addr
+		// 0 is without EDNS
+		bufsize   uint16
+		limit     int
+		truncated bool
+	}{
+		{name: "without EDNS", query: "many.example.com.", remote: udpClient, limit: 512, truncated: true},
+		{name: "small bufsize is 512", query: "many.example.com.", remote: udpClient, bufsize: 100, limit: 512, truncated: true},
+		{name: "client bufsize", query: "many.example.com.", remote: udpClient, bufsize: 1232, limit: 1232, truncated: true},
+		{name: "large bufsize", query: "many.example.com.", remote: udpClient, bufsize: 4096, limit: 4096},
+		{name: "fits", query: "www.example.com.", remote: udpClient, limit: 512},
+		{name: "tcp is not limited", query: "many.example.com.", remote: tcpClient, bufsize: 512, limit: dns.MaxMsgSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Dns{resolver: resolver}
+			query := new(dns.Msg)
+			query.SetQuestion(tt.query, dns.TypeA)
+			if tt.bufsize > 0 {
+				query.SetEdns0(tt.bufsize, false)
+			}
+			w := &recordWriter{remote: tt.remote}
+			s.handleRequest(w, query)
+
+			if w.msg.Len() > tt.limit {
+				t.Errorf("length %d is over %d", w.msg.Len(), tt.limit)
+			}
+			if w.msg.Truncated != tt.truncated {
+				t.Errorf("truncated = %v, want %v", w.msg.Truncated, tt.truncated)
+			}
+			if want := len(resolver.Query(tt.query, dns.TypeA)); !tt.truncated && len(w.msg.Answer) != want {
+				t.Errorf("got %d answers, want %d", len(w.msg.Answer), want)
+			}
+			if (w.msg.IsEdns0() != nil) != (tt.bufsize > 0) {
+				t.Errorf("OPT %v, want EDNS %v", w.msg.IsEdns0(), tt.bufsize > 0)
+			}
+		})
+	}
+}
+
+func TestHandleMaxUDPSize(t *testing.T) {
+	resolver := &clienttest.StaticResolver{Answers: addresses("many.example.com.", 100)}
+	tests := []struct {
+		name       string
+		maxUDPSize int
+		remote     net.Addr
+		bufsize    uint16
+		limit      int
+		truncated  bool
+	}{
+		{name: "client bufsize by default", remote: udpClient, bufsize: 4096, limit: 4096},
+		{name: "capped", maxUDPSize: 1232, remote: udpClient, bufsize: 4096, limit: 1232, truncated: true},
+		{name: "smaller client bufsize", maxUDPSize: 1232, remote: udpClient, bufsize: 600, limit: 600, truncated: true},
+		{name: "cap is at least 512", maxUDPSize: 100, remote: udpClient, bufsize: 4096, limit: 512, truncated: true},
+		{name: "tcp is not capped", maxUDPSize: 1232, remote: tcpClient, bufsize: 4096, limit: dns.MaxMsgSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Dns{resolver: resolver, maxUDPSize: tt.maxUDPSize}
+			query := new(dns.Msg)
+			query.SetQuestion("many.example.com.", dns.TypeA)
+			query.SetEdns0(tt.bufsize, false)
+			w := &recordWriter{remote: tt.remote}
+			s.handleRequest(w, query)
+
+			if w.msg.Len() > tt.limit {
+				t.Errorf("length %d is over %d", w.msg.Len(), tt.limit)
+			}
+			if w.msg.Truncated != tt.truncated {
+				t.Errorf("truncated = %v, want %v", w.msg.Truncated, tt.truncated)
+			}
+			if !tt.truncated && len(w.msg.Answer) != 100 {
+				t.Errorf("got %d answers, want 100", len(w.msg.Answer))
+			}
+		})
+	}
+}